@@ -0,0 +1,54 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/hassanaziz0012/swipenotes-api/pkg/shared"
+)
+
+// Handler is the Vercel serverless function handler for /api/admin/maintenance
+//
+// GET reports the current maintenance status. POST {"enabled": true} turns
+// the runtime toggle on for duration_seconds (default one hour), making the
+// extraction endpoints return 503 without a redeploy; {"enabled": false}
+// turns it off. Maintenance set by MAINTENANCE_MODE can only be cleared by
+// unsetting the variable. Requires the admin bearer token.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w, done := shared.StartAccessLog(w, r)
+	defer done()
+
+	if !shared.RequireMethod(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+
+	if err := shared.CheckAdminAuth(r); err != nil {
+		shared.WriteError(w, r, err)
+		return
+	}
+
+	store, err := shared.GetRateLimitStore()
+	if err != nil {
+		shared.WriteError(w, r, fmt.Errorf("rate limit store initialization: %w", err))
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		var req shared.MaintenanceRequest
+		if err := shared.DecodeRequestBody(r, &req); err != nil {
+			shared.WriteError(w, r, err)
+			return
+		}
+		ttl, err := req.TTL()
+		if err != nil {
+			shared.WriteError(w, r, err)
+			return
+		}
+		if err := shared.SetMaintenance(r.Context(), store, req.Enabled, ttl); err != nil {
+			shared.WriteError(w, r, fmt.Errorf("maintenance toggle: %w", err))
+			return
+		}
+	}
+
+	shared.WriteJSON(w, r, http.StatusOK, shared.GetMaintenanceStatus(r.Context(), store))
+}
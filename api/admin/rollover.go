@@ -0,0 +1,47 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/hassanaziz0012/swipenotes-api/pkg/shared"
+)
+
+// Handler is the Vercel serverless function handler for /api/admin/rollover
+//
+// Called by a daily cron, it deletes the previous day's rate-limit counters
+// and returns that day's totals, complementing TTL expiry with an explicit
+// audit point. It also sets a TTL on any live rate-limit key missing one.
+// Pass ?date=YYYY-MM-DD to roll over an earlier day. Requires the admin
+// bearer token.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w, done := shared.StartAccessLog(w, r)
+	defer done()
+
+	if !shared.RequireMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	if err := shared.CheckAdminAuth(r); err != nil {
+		shared.WriteError(w, r, err)
+		return
+	}
+
+	store, err := shared.GetRateLimitStore()
+	if err != nil {
+		shared.WriteError(w, r, fmt.Errorf("rate limit store initialization: %w", err))
+		return
+	}
+
+	day := r.URL.Query().Get("date")
+	if day == "" {
+		day = shared.PreviousRateLimitDay()
+	}
+
+	summary, err := shared.RolloverDay(r.Context(), store, day)
+	if err != nil {
+		shared.WriteError(w, r, err)
+		return
+	}
+	shared.WriteJSON(w, r, http.StatusOK, summary)
+}
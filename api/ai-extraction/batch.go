@@ -0,0 +1,41 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/hassanaziz0012/swipenotes-api/pkg/shared"
+)
+
+// Handler is the Vercel serverless function handler for /api/ai-extraction/batch
+//
+// Notes are processed in order and each one is gated by the rate limit on its
+// own, so a client with fewer remaining slots than notes gets the first notes
+// extracted and the rest reported as rate_limited. The counter is incremented
+// once per successfully extracted note.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	ec, ok := shared.BeginExtraction(w, r)
+	defer ec.End()
+	if !ok {
+		return
+	}
+
+	var req shared.BatchExtractionRequest
+	if !ec.Decode(&req) {
+		return
+	}
+	if len(req.Notes) == 0 {
+		ec.Fail(shared.NewAPIError(shared.ErrCodeBadRequest, "At least one note is required", nil))
+		return
+	}
+	if len(req.Notes) > ec.Config.MaxBatchSize {
+		ec.Fail(shared.NewAPIError(shared.ErrCodeBadRequest, fmt.Sprintf("A batch may contain at most %d notes", ec.Config.MaxBatchSize), nil))
+		return
+	}
+
+	if !ec.AcquireSlot() {
+		return
+	}
+	resp, cards := ec.ExtractBatch(req.Notes)
+	ec.WriteResult(resp, cards)
+}
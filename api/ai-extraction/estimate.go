@@ -0,0 +1,42 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/hassanaziz0012/swipenotes-api/pkg/shared"
+)
+
+// Handler is the Vercel serverless function handler for /api/ai-extraction/estimate
+//
+// It renders the extraction prompt, estimates its input and likely output
+// tokens with the same heuristics as /api/ai-extraction/preview, and prices
+// them at the configured PRICE_PER_MILLION_* rates. The AI is never called
+// and no quota is consumed.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w, done := shared.StartAccessLog(w, r)
+	defer done()
+
+	if !shared.RequireMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	if err := shared.CheckServerConfig(); err != nil {
+		shared.WriteError(w, r, shared.NewAPIError(shared.ErrCodeServerConfig, "Server configuration error", err))
+		return
+	}
+
+	var req shared.AIExtractionRequest
+	if err := shared.DecodeRequestBody(r, &req); err != nil {
+		shared.WriteError(w, r, err)
+		return
+	}
+	if err := req.Prepare(); err != nil {
+		shared.WriteError(w, r, shared.NewAPIError(shared.ErrCodeBadRequest, err.Error(), nil))
+		return
+	}
+
+	shared.WriteJSON(w, r, http.StatusOK, shared.CostEstimateResponse{
+		Estimate: shared.EstimateExtraction(&req),
+		Pricing:  shared.CurrentTokenPricing(),
+	})
+}
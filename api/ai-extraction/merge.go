@@ -0,0 +1,44 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/hassanaziz0012/swipenotes-api/pkg/shared"
+)
+
+// Handler is the Vercel serverless function handler for /api/ai-extraction/merge
+//
+// Several related notes are combined into one prompt and extracted as a
+// single de-duplicated card set with cross-note synthesis, unlike batch mode
+// which extracts each note in isolation. It is charged once, at the combined
+// content's RequestCost.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	ec, ok := shared.BeginExtraction(w, r)
+	defer ec.End()
+	if !ok {
+		return
+	}
+
+	var mergeReq shared.MergeExtractionRequest
+	if !ec.Decode(&mergeReq) {
+		return
+	}
+	req, err := mergeReq.ToExtractionRequest()
+	if err != nil {
+		ec.Fail(shared.NewAPIError(shared.ErrCodeBadRequest, err.Error(), nil))
+		return
+	}
+	if !ec.Prepare(&req) || !ec.CheckContent(req.Content) {
+		return
+	}
+
+	if !ec.Admit(shared.RequestCost(&req)) {
+		return
+	}
+	result, err := shared.ExtractCards(ec.Ctx, req)
+	if !ec.Finished(err) {
+		return
+	}
+	ec.Charge(result)
+	ec.WriteResult(result, len(result.Cards))
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/hassanaziz0012/swipenotes-api/pkg/shared"
+)
+
+// Handler is the Vercel serverless function handler for /api/ai-extraction/preview
+//
+// It estimates how many cards a note would yield and the approximate token
+// cost using local heuristics only. The AI is never called and no quota is
+// consumed; the client's current rate-limit status is included so it can
+// decide whether to proceed.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w, done := shared.StartAccessLog(w, r)
+	defer done()
+
+	if !shared.RequireMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	if err := shared.CheckServerConfig(); err != nil {
+		shared.WriteError(w, r, shared.NewAPIError(shared.ErrCodeServerConfig, "Server configuration error", err))
+		return
+	}
+
+	var req shared.AIExtractionRequest
+	if err := shared.DecodeRequestBody(r, &req); err != nil {
+		shared.WriteError(w, r, err)
+		return
+	}
+	if err := req.Prepare(); err != nil {
+		shared.WriteError(w, r, shared.NewAPIError(shared.ErrCodeBadRequest, err.Error(), nil))
+		return
+	}
+
+	resp := shared.PreviewResponse{Estimate: shared.EstimateExtraction(&req)}
+
+	// A rate-limit lookup failure only degrades the status, never the estimate
+	if store, err := shared.GetRateLimitStore(); err != nil {
+		log.Printf("Rate limit store unavailable for preview: %v", err)
+	} else {
+		// Counts only, so previewing never alerts or touches the limiter
+		clientIP := shared.GetClientIP(r)
+		clientCount, globalCount, err := shared.GetRateLimitCounts(r.Context(), store, clientIP)
+		if err != nil {
+			log.Printf("Rate limit lookup error: %v", err)
+		}
+		allowed := err == nil && shared.RateLimitAllows(clientIP, clientCount, globalCount, resp.Estimate.QuotaCost)
+		resp.RateLimit = shared.NewRateLimitStatus(allowed, clientCount, globalCount)
+	}
+
+	shared.WriteJSON(w, r, http.StatusOK, resp)
+}
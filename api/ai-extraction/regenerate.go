@@ -0,0 +1,34 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/hassanaziz0012/swipenotes-api/pkg/shared"
+)
+
+// Handler is the Vercel serverless function handler for /api/ai-extraction/regenerate
+//
+// It replaces one card the user disliked with a single alternative covering
+// the same material, consuming its model's cost in rate-limit slots.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	ec, ok := shared.BeginExtraction(w, r)
+	defer ec.End()
+	if !ok {
+		return
+	}
+
+	var req shared.RegenerateCardRequest
+	if !ec.Decode(&req) || !ec.Prepare(&req) || !ec.CheckContent(req.Content, req.CardContent) {
+		return
+	}
+
+	if !ec.Admit(shared.ModelCost(req.Model)) {
+		return
+	}
+	result, err := shared.RegenerateCard(ec.Ctx, req)
+	if !ec.Finished(err) {
+		return
+	}
+	ec.Charge(result)
+	ec.WriteResult(result, 1)
+}
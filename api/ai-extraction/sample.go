@@ -0,0 +1,29 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/hassanaziz0012/swipenotes-api/pkg/shared"
+)
+
+// Handler is the Vercel serverless function handler for /api/ai-extraction/sample
+//
+// It returns a fixed set of example cards, in the same shape as a real
+// extraction, for onboarding empty states. The AI is never called and no
+// quota is consumed.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w, done := shared.StartAccessLog(w, r)
+	defer done()
+
+	if !shared.RequireMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	sample, err := shared.SampleExtraction()
+	if err != nil {
+		shared.WriteError(w, r, err)
+		return
+	}
+	shared.RecordCardCount(w, len(sample.Cards))
+	shared.WriteJSON(w, r, http.StatusOK, sample)
+}
@@ -0,0 +1,87 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/hassanaziz0012/swipenotes-api/pkg/shared"
+)
+
+// Handler is the Vercel serverless function handler for /api/ai-extraction/stream
+//
+// The response is newline-delimited JSON. A fast tag-only call runs first and
+// its result is flushed immediately as a "tags" event; the full extraction
+// follows as a "cards" event. The combined operation is charged once, at the
+// note's RequestCost, only after the cards have been produced. The headers go
+// out before that, so the rate-limit headers carry the pre-charge counts.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	ec, ok := shared.BeginExtraction(w, r)
+	defer ec.End()
+	if !ok {
+		return
+	}
+	w, r, ctx := ec.W, ec.R, ec.Ctx
+
+	if !shared.IsEnabled(shared.FlagStreaming) {
+		ec.Fail(shared.NewAPIError(shared.ErrCodeFeatureDisabled, "Streaming is temporarily disabled. Please use /api/ai-extraction instead.", nil))
+		return
+	}
+
+	var req shared.AIExtractionRequest
+	if !ec.Decode(&req) || !ec.Prepare(&req) || !ec.CheckContent(req.Content) {
+		return
+	}
+	if !ec.Admit(shared.RequestCost(&req)) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	// Phase 1: tags only. A failure here is not fatal; the cards still carry
+	// their own suggested tags.
+	if tags, err := suggestTags(ctx, &req); err != nil {
+		log.Printf("Tag suggestion error: %v", err)
+	} else {
+		writeEvent(w, shared.StreamEvent{Event: "tags", Tags: tags})
+	}
+
+	// Phase 2: full card extraction
+	result, err := shared.ExtractCards(ctx, req)
+	if err != nil {
+		apiErr := shared.ToAPIError(err)
+		log.Printf("Extraction error: %v", apiErr)
+		writeEvent(w, shared.StreamEvent{Event: "error", Error: shared.Localize(r, apiErr.Message), Code: apiErr.Code})
+		return
+	}
+
+	ec.Charge(result)
+	shared.RecordCardCount(w, len(result.Cards))
+	writeEvent(w, shared.StreamEvent{Event: "cards", Result: result})
+}
+
+func suggestTags(ctx context.Context, req *shared.AIExtractionRequest) ([]string, error) {
+	status, body, err := shared.GenerateWithGemini(ctx, req.GeminiRequest(shared.TagSuggestionPrompt(req.ExistingTags, req.Content)))
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("gemini army returned status %d", status)
+	}
+
+	var resp shared.AIExtractionResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	return shared.ParseTagSuggestions(resp.Text)
+}
+
+func writeEvent(w http.ResponseWriter, event shared.StreamEvent) {
+	json.NewEncoder(w).Encode(event)
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,37 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/hassanaziz0012/swipenotes-api/pkg/shared"
+)
+
+// Handler is the Vercel serverless function handler for /api/ai-extraction/validate
+//
+// It runs the same input validation and preprocessing as a real extraction
+// and returns a structured report of every issue found, without calling the
+// AI or consuming quota. The report is returned with 200 whether or not the
+// note would be accepted.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w, done := shared.StartAccessLog(w, r)
+	defer done()
+
+	if !shared.RequireMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	if err := shared.CheckServerConfig(); err != nil {
+		shared.WriteError(w, r, shared.NewAPIError(shared.ErrCodeServerConfig, "Server configuration error", err))
+		return
+	}
+
+	var req shared.AIExtractionRequest
+	if err := shared.DecodeRequestBody(r, &req); err != nil {
+		shared.WriteError(w, r, err)
+		return
+	}
+
+	report := shared.ValidateExtractionRequest(&req)
+	report.Localize(shared.RequestLanguage(r))
+	shared.WriteJSON(w, r, http.StatusOK, report)
+}
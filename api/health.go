@@ -3,11 +3,27 @@ package api
 import (
 	"encoding/json"
 	"net/http"
+
+	"github.com/hassanaziz0012/swipenotes-api/pkg/shared"
 )
 
 // Handler is the Vercel serverless function handler for /api/health
+//
+// It stays 200 during maintenance so monitors can tell a deliberate outage
+// from a broken deployment; the mode is reported in the body.
 func Handler(w http.ResponseWriter, r *http.Request) {
+	w, done := shared.StartAccessLog(w, r)
+	defer done()
+
+	var store shared.RateLimitStore
+	if s, err := shared.GetRateLimitStore(); err == nil {
+		store = s
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"status": "healthy"})
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":      "healthy",
+		"maintenance": shared.GetMaintenanceStatus(r.Context(), store),
+	})
 }
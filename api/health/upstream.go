@@ -0,0 +1,34 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/hassanaziz0012/swipenotes-api/pkg/shared"
+)
+
+// Handler is the Vercel serverless function handler for /api/health/upstream
+//
+// It times a minimal request to the AI provider so upstream latency can be
+// tracked separately from our own health. No rate-limit slot is consumed.
+// Responds 503 when the provider is unreachable or failing. Requires the
+// admin bearer token.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w, done := shared.StartAccessLog(w, r)
+	defer done()
+
+	if !shared.RequireMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	if err := shared.CheckAdminAuth(r); err != nil {
+		shared.WriteError(w, r, err)
+		return
+	}
+
+	health := shared.CheckUpstreamHealth(r.Context())
+	status := http.StatusOK
+	if health.Status != shared.UpstreamStatusOK {
+		status = http.StatusServiceUnavailable
+	}
+	shared.WriteJSON(w, r, status, health)
+}
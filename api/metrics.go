@@ -0,0 +1,42 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/hassanaziz0012/swipenotes-api/pkg/shared"
+)
+
+// Handler is the Vercel serverless function handler for /api/metrics
+//
+// It reports the day's cache hit rate per store. Pass ?date=YYYY-MM-DD to
+// read an earlier day.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w, done := shared.StartAccessLog(w, r)
+	defer done()
+
+	if !shared.RequireMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	day := r.URL.Query().Get("date")
+	if _, err := time.Parse("2006-01-02", day); day != "" && err != nil {
+		shared.WriteError(w, r, shared.NewAPIError(shared.ErrCodeBadRequest, "Invalid date. Use YYYY-MM-DD", nil))
+		return
+	}
+
+	store, err := shared.GetRateLimitStore()
+	if err != nil {
+		shared.WriteError(w, r, fmt.Errorf("rate limit store initialization: %w", err))
+		return
+	}
+
+	metrics, err := shared.GetMetrics(r.Context(), store, day)
+	if err != nil {
+		shared.WriteError(w, r, fmt.Errorf("metrics lookup: %w", err))
+		return
+	}
+
+	shared.WriteJSON(w, r, http.StatusOK, metrics)
+}
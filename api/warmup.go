@@ -0,0 +1,20 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/hassanaziz0012/swipenotes-api/pkg/shared"
+)
+
+// Handler is the Vercel serverless function handler for /api/warmup
+//
+// A scheduled ping keeps this instance warm and measures cold-start cost.
+// Pass ?provider=true to also ping the AI provider.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w, done := shared.StartAccessLog(w, r)
+	defer done()
+
+	report := shared.Warmup(r.Context(), r.URL.Query().Get("provider") == "true")
+
+	shared.WriteJSON(w, r, http.StatusOK, report)
+}
@@ -0,0 +1,124 @@
+// Command extract runs a single AI extraction locally, without the HTTP
+// server or rate limiting, and prints the resulting cards as JSON.
+//
+// Usage:
+//
+//	go run ./cmd/extract -file note.md -tags go,testing
+//	cat note.md | go run ./cmd/extract
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/hassanaziz0012/swipenotes-api/pkg/shared"
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	os.Exit(run())
+}
+
+// run performs the extraction and returns the process exit code. Keeping
+// os.Exit out of it lets the deferred CloseTracing and CloseLogSink flush
+// spans and logs on the failure paths too.
+func run() int {
+	file := flag.String("file", "", "Path to the note file (reads stdin when empty)")
+	tags := flag.String("tags", "", "Comma-separated existing tags")
+	projects := flag.String("projects", "", "Comma-separated existing projects")
+	contentType := flag.String("content-type", "", "Content type: note or transcript")
+	contentFormat := flag.String("content-format", "", "Content format: markdown, json or html")
+	format := flag.String("format", "", "Card format: prose or outline")
+	model := flag.String("model", "", "Gemini model (defaults to the provider default)")
+	temperature := flag.Float64("temperature", -1, "Sampling temperature 0-2 (provider default when unset)")
+	flag.Parse()
+
+	// A missing .env is fine; the environment may already be configured
+	_ = godotenv.Load()
+
+	if err := shared.CheckCLIConfig(); err != nil {
+		log.Printf("Configuration error: %v", err)
+		return 1
+	}
+	shared.StartLogSink()
+	defer shared.CloseLogSink()
+	shared.StartTracing()
+	defer shared.CloseTracing()
+	shared.LogEffectiveConfig(shared.GetConfig())
+
+	content, err := readContent(*file)
+	if err != nil {
+		log.Printf("Failed to read note content: %v", err)
+		return 1
+	}
+
+	req := shared.AIExtractionRequest{
+		Content:          content,
+		ContentType:      *contentType,
+		ContentFormat:    *contentFormat,
+		Format:           *format,
+		Model:            *model,
+		ExistingTags:     splitList(*tags),
+		ExistingProjects: splitList(*projects),
+	}
+	if *temperature >= 0 {
+		req.Temperature = temperature
+	}
+	if err := req.Prepare(); err != nil {
+		log.Printf("Invalid request: %v", err)
+		return 1
+	}
+
+	log.Println("Warning: CLI mode bypasses rate limiting; every run calls the AI provider")
+
+	ctx, cancel := context.WithTimeout(context.Background(), shared.GetConfig().RequestTimeout)
+	defer cancel()
+
+	extraction, err := shared.ExtractCards(ctx, req)
+	if err != nil {
+		log.Printf("Extraction failed: %v", err)
+		return 1
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(extraction); err != nil {
+		log.Printf("Failed to write output: %v", err)
+		return 1
+	}
+	return 0
+}
+
+func readContent(path string) (string, error) {
+	var data []byte
+	var err error
+	if path == "" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return "", err
+	}
+	content := strings.TrimSpace(string(data))
+	if content == "" {
+		return "", fmt.Errorf("no content provided")
+	}
+	return content, nil
+}
+
+func splitList(raw string) []string {
+	var items []string
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -5,6 +5,9 @@ go 1.24.6
 require (
 	github.com/joho/godotenv v1.5.1
 	github.com/redis/go-redis/v9 v9.17.3
+	github.com/santhosh-tekuri/jsonschema/v5 v5.3.1
+	golang.org/x/sync v0.16.0
+	golang.org/x/text v0.26.0
 )
 
 require (
@@ -0,0 +1,127 @@
+package shared
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// =============================================================================
+// Access Logging
+// =============================================================================
+
+// AccessLogEntry is the metadata logged for a sampled request. It never
+// includes request or response bodies, so note content stays out of logs.
+type AccessLogEntry struct {
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Status     int     `json:"status"`
+	DurationMs float64 `json:"duration_ms"`
+	IPHash     string  `json:"ip_hash"`
+	CardCount  int     `json:"card_count"`
+}
+
+// accessLogWriter records the status and card count of a sampled response
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	cards  int
+}
+
+func (w *accessLogWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush keeps streaming responses working through the wrapper
+func (w *accessLogWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *accessLogWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// StartAccessLog samples the request at LogSampleRate. For a sampled request
+// it returns a wrapped writer to use for the response and a function that
+// logs the entry once the handler is done; otherwise w is returned unchanged
+// and the function does nothing.
+// Every handler calls it first, so it also starts the log sink and span
+// exporter for handlers that never reach CheckServerConfig.
+//
+//	w, done := shared.StartAccessLog(w, r)
+//	defer done()
+func StartAccessLog(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	StartLogSink()
+	StartTracing()
+	if !sampleRequest(GetConfig().LogSampleRate) {
+		return w, func() {}
+	}
+
+	start := time.Now()
+	lw := &accessLogWriter{ResponseWriter: w}
+	return lw, func() {
+		entry := AccessLogEntry{
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Status:     lw.status,
+			DurationMs: msSince(start),
+			IPHash:     hashIP(GetClientIP(r)),
+			CardCount:  lw.cards,
+		}
+		if entry.Status == 0 {
+			entry.Status = http.StatusOK
+		}
+		line, err := json.Marshal(entry)
+		if err != nil {
+			log.Printf("Failed to encode access log entry: %v", err)
+			return
+		}
+		log.Printf("Access: %s", line)
+	}
+}
+
+// RecordCardCount notes how many cards the response carries for the access
+// log and request span. It does nothing when neither is recording.
+func RecordCardCount(w http.ResponseWriter, n int) {
+	if lw, ok := w.(*accessLogWriter); ok {
+		lw.cards = n
+	}
+}
+
+// sampleRequest reports whether to log a request at the given rate, from 0
+// (never) to 1 (always)
+func sampleRequest(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	return rate >= 1 || rand.Float64() < rate
+}
+
+// hashIP returns a short, stable pseudonym for ip, keyed with IP_HASH_SECRET
+// when it is set
+func hashIP(ip string) string {
+	if secret := GetConfig().IPHashSecret; secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(ip))
+		return hex.EncodeToString(mac.Sum(nil)[:8])
+	}
+	sum := sha256.Sum256([]byte(ip))
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,76 @@
+package shared
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSampleRequest(t *testing.T) {
+	const trials = 20000
+	tests := []struct {
+		rate     float64
+		min, max int
+	}{
+		{-1, 0, 0},
+		{0, 0, 0},
+		{0.1, trials * 8 / 100, trials * 12 / 100},
+		{0.5, trials * 47 / 100, trials * 53 / 100},
+		{1, trials, trials},
+		{2, trials, trials},
+	}
+	for _, tt := range tests {
+		sampled := 0
+		for range trials {
+			if sampleRequest(tt.rate) {
+				sampled++
+			}
+		}
+		if sampled < tt.min || sampled > tt.max {
+			t.Errorf("rate %v sampled %d of %d, want %d-%d", tt.rate, sampled, trials, tt.min, tt.max)
+		}
+	}
+}
+
+func TestAccessLogEntry(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	for _, rate := range []float64{0, 1} {
+		logs.Reset()
+		useConfig(t, func(c *Config) { c.LogSampleRate = rate })
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/api/ai-extraction", strings.NewReader(`{"content":"secret note"}`))
+		r.RemoteAddr = "203.0.113.7:1234"
+
+		w, done := StartAccessLog(rec, r)
+		RecordCardCount(w, 3)
+		WriteJSON(w, r, http.StatusCreated, map[string]string{"content": "secret card"})
+		done()
+
+		if rate == 0 {
+			if w != http.ResponseWriter(rec) || logs.Len() != 0 {
+				t.Errorf("unsampled request was wrapped or logged: %q", logs.String())
+			}
+			continue
+		}
+		line := logs.String()
+		if strings.Contains(line, "secret") {
+			t.Errorf("access log leaked content: %q", line)
+		}
+		var entry AccessLogEntry
+		if err := json.Unmarshal([]byte(line[strings.Index(line, "{"):]), &entry); err != nil {
+			t.Fatalf("access log line %q: %v", line, err)
+		}
+		want := AccessLogEntry{Method: http.MethodPost, Path: "/api/ai-extraction", Status: http.StatusCreated, IPHash: hashIP("203.0.113.7"), CardCount: 3, DurationMs: entry.DurationMs}
+		if entry != want {
+			t.Errorf("entry = %+v, want %+v", entry, want)
+		}
+	}
+}
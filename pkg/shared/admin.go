@@ -0,0 +1,115 @@
+package shared
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// =============================================================================
+// Admin
+// =============================================================================
+
+// CheckAdminAuth verifies the request carries "Authorization: Bearer
+// <ADMIN_TOKEN>". Admin endpoints are disabled when ADMIN_TOKEN is unset.
+func CheckAdminAuth(r *http.Request) error {
+	token := GetConfig().AdminToken
+	if token == "" {
+		return NewAPIError(ErrCodeForbidden, "Admin endpoints are not enabled", nil)
+	}
+
+	provided, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+		return NewAPIError(ErrCodeUnauthorized, "Invalid or missing admin token", nil)
+	}
+	return nil
+}
+
+// RolloverSummary reports a finished day's rate-limit totals
+type RolloverSummary struct {
+	Date        string           `json:"date"`
+	GlobalCount int64            `json:"global_count"`
+	ClientCount int              `json:"client_count"`
+	Clients     map[string]int64 `json:"clients"`
+	DeletedKeys int              `json:"deleted_keys"`
+
+	// RepairedKeys counts live rate-limit keys found without a TTL
+	RepairedKeys int `json:"repaired_keys"`
+}
+
+// RolloverDay summarizes day's client and global counters, then deletes them.
+// Clients are keyed by their identifier in Redis, which is the HMAC rather
+// than the IP when HashClientIP is set. The current and future days are
+// refused so live limits can't be reset.
+func RolloverDay(ctx context.Context, store RateLimitStore, day string) (*RolloverSummary, error) {
+	date, err := time.ParseInLocation("2006-01-02", day, GetConfig().RateLimitLocation)
+	if err != nil {
+		return nil, NewAPIError(ErrCodeBadRequest, "Invalid date. Use YYYY-MM-DD", err)
+	}
+	if !date.Before(NextRateLimitReset(time.Now()).AddDate(0, 0, -1)) {
+		return nil, NewAPIError(ErrCodeBadRequest, "Only days that have already ended can be rolled over", nil)
+	}
+
+	clientKeys, err := store.Keys(ctx, redisKey("ratelimit", "client", "*", day))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list client counters: %w", err)
+	}
+	keys := append(clientKeys, globalRateLimitKey(day))
+	counts, err := store.Get(ctx, keys...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read counters: %w", err)
+	}
+
+	summary := &RolloverSummary{
+		Date:        day,
+		GlobalCount: counts[len(counts)-1],
+		ClientCount: len(clientKeys),
+		Clients:     make(map[string]int64, len(clientKeys)),
+	}
+	clientPrefix := redisKey("ratelimit", "client", "")
+	for i, key := range clientKeys {
+		id := strings.TrimSuffix(strings.TrimPrefix(key, clientPrefix), ":"+day)
+		summary.Clients[id] = counts[i]
+	}
+
+	if err := store.Delete(ctx, keys...); err != nil {
+		return nil, fmt.Errorf("failed to delete counters: %w", err)
+	}
+	summary.DeletedKeys = len(keys)
+
+	// Without a TTL a counter would never reset and could block a client
+	// for good, so the daily rollover doubles as a safety sweep
+	repaired, err := RepairRateLimitTTLs(ctx, store)
+	if err != nil {
+		log.Printf("Rate limit TTL sweep failed: %v", err)
+	}
+	summary.RepairedKeys = repaired
+	return summary, nil
+}
+
+// RepairRateLimitTTLs gives RateLimitTTL to every rate-limit key that has no
+// expiry, reporting how many were fixed
+func RepairRateLimitTTLs(ctx context.Context, store RateLimitStore) (int, error) {
+	keys, err := store.Keys(ctx, redisKey("ratelimit", "*"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to list rate limit keys: %w", err)
+	}
+	repaired, err := store.EnsureExpiry(ctx, RateLimitTTL, keys...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to set missing TTLs: %w", err)
+	}
+	if repaired > 0 {
+		log.Printf("Set missing TTL on %d rate limit keys", repaired)
+	}
+	return repaired, nil
+}
+
+// PreviousRateLimitDay returns the date key of the day before today in the
+// rate-limit time zone
+func PreviousRateLimitDay() string {
+	return time.Now().In(GetConfig().RateLimitLocation).AddDate(0, 0, -1).Format("2006-01-02")
+}
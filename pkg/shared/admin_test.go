@@ -0,0 +1,109 @@
+package shared
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRolloverDay(t *testing.T) {
+	tests := []struct {
+		name   string
+		hashed bool
+		prefix string
+	}{
+		{"unhashed", false, ""},
+		{"hashed", true, ""},
+		{"hashed with key prefix", true, "staging"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, func(c *Config) {
+				c.HashClientIP = tt.hashed
+				c.IPHashSecret = "rollover-secret"
+				c.RedisKeyPrefix = tt.prefix
+			})
+			store := useMemoryStore(t)
+			ctx := context.Background()
+			day := time.Now().In(GetConfig().RateLimitLocation).AddDate(0, 0, -3).Format("2006-01-02")
+			other := time.Now().In(GetConfig().RateLimitLocation).AddDate(0, 0, -4).Format("2006-01-02")
+
+			incr := func(by int64, keys ...string) {
+				if err := store.Increment(ctx, RateLimitTTL, by, keys...); err != nil {
+					t.Fatalf("Increment: %v", err)
+				}
+			}
+			incr(3, clientRateLimitKey("203.0.113.1", day), globalRateLimitKey(day))
+			incr(2, clientRateLimitKey("203.0.113.2", day), globalRateLimitKey(day))
+			incr(1, clientRateLimitKey("203.0.113.1", other))
+
+			summary, err := RolloverDay(ctx, store, day)
+			if err != nil {
+				t.Fatalf("RolloverDay: %v", err)
+			}
+			if summary.ClientCount != 2 || summary.GlobalCount != 5 || summary.DeletedKeys != 3 {
+				t.Errorf("summary = %+v, want 2 clients, global 5, 3 deleted", summary)
+			}
+			for ip, want := range map[string]int64{"203.0.113.1": 3, "203.0.113.2": 2} {
+				if got := summary.Clients[clientKeyID(ip)]; got != want {
+					t.Errorf("client %s = %d, want %d", clientKeyID(ip), got, want)
+				}
+			}
+
+			left, err := store.Keys(ctx, redisKey("ratelimit", "*"))
+			if err != nil {
+				t.Fatalf("Keys: %v", err)
+			}
+			if len(left) != 1 || left[0] != clientRateLimitKey("203.0.113.1", other) {
+				t.Errorf("remaining keys = %v, want only the other day's counter", left)
+			}
+		})
+	}
+}
+
+func TestRolloverDayRefusesLiveDays(t *testing.T) {
+	useConfig(t, nil)
+	store := useMemoryStore(t)
+	now := time.Now().In(GetConfig().RateLimitLocation)
+	for _, day := range []string{"not-a-date", now.Format("2006-01-02"), now.AddDate(0, 0, 1).Format("2006-01-02")} {
+		if _, err := RolloverDay(context.Background(), store, day); err == nil {
+			t.Errorf("RolloverDay(%q) succeeded, want an error", day)
+		}
+	}
+}
+
+func TestCheckAdminAuth(t *testing.T) {
+	tests := []struct {
+		name     string
+		token    string
+		header   string
+		wantCode string
+	}{
+		{"valid token", "s3cret", "Bearer s3cret", ""},
+		{"wrong token", "s3cret", "Bearer guess", ErrCodeUnauthorized},
+		{"missing header", "s3cret", "", ErrCodeUnauthorized},
+		{"not a bearer token", "s3cret", "s3cret", ErrCodeUnauthorized},
+		{"admin disabled", "", "Bearer anything", ErrCodeForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, func(c *Config) { c.AdminToken = tt.token })
+			r := httptest.NewRequest(http.MethodGet, "/api/health/upstream", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			err := CheckAdminAuth(r)
+			if tt.wantCode == "" {
+				if err != nil {
+					t.Errorf("CheckAdminAuth = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || ToAPIError(err).Code != tt.wantCode {
+				t.Errorf("CheckAdminAuth = %v, want a %s error", err, tt.wantCode)
+			}
+		})
+	}
+}
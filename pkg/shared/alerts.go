@@ -0,0 +1,94 @@
+package shared
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// =============================================================================
+// Alerts
+// =============================================================================
+
+// alertWebhookTimeout bounds each webhook delivery
+const alertWebhookTimeout = 5 * time.Second
+
+// AlertEventGlobalLimitExhausted is sent the first time the global daily
+// limit rejects a request
+const AlertEventGlobalLimitExhausted = "global_rate_limit_exhausted"
+
+// AlertPayload is the JSON body POSTed to ALERT_WEBHOOK_URL
+type AlertPayload struct {
+	Event   string `json:"event"`
+	Service string `json:"service"`
+	Date    string `json:"date"`
+	Count   int64  `json:"count"`
+	Limit   int64  `json:"limit"`
+}
+
+// globalLimitAlertKey returns the flag marking that day's alert as sent
+func globalLimitAlertKey(day string) string {
+	return redisKey("alert", "global-exhausted", day)
+}
+
+// notifyGlobalLimitExhausted fires the global-limit webhook at most once per
+// day, using a store flag shared by all instances. Delivery failures are
+// logged and never affect the request.
+func notifyGlobalLimitExhausted(ctx context.Context, store RateLimitStore, day string, count int64) {
+	cfg := GetConfig()
+	if cfg.AlertWebhookURL == "" {
+		return
+	}
+
+	first, err := store.SetIfAbsent(ctx, globalLimitAlertKey(day), RateLimitTTL)
+	if err != nil {
+		log.Printf("Failed to set global limit alert flag: %v", err)
+		return
+	}
+	if !first {
+		return
+	}
+
+	payload := AlertPayload{
+		Event:   AlertEventGlobalLimitExhausted,
+		Service: ServiceName,
+		Date:    day,
+		Count:   count,
+		Limit:   cfg.GlobalRateLimitPerDay,
+	}
+	if err := postAlert(context.WithoutCancel(ctx), cfg.AlertWebhookURL, payload); err != nil {
+		log.Printf("Failed to send global limit alert: %v", err)
+	}
+}
+
+// postAlert delivers payload to the webhook url
+func postAlert(ctx context.Context, url string, payload AlertPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal alert: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, alertWebhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create alert request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", GetConfig().GeminiUserAgent)
+
+	resp, err := outboundClient(alertWebhookTimeout).Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestGlobalLimitAlertFiresOncePerDay(t *testing.T) {
+	var mu sync.Mutex
+	var payloads []AlertPayload
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p AlertPayload
+		json.NewDecoder(r.Body).Decode(&p)
+		mu.Lock()
+		payloads = append(payloads, p)
+		mu.Unlock()
+	}))
+	defer webhook.Close()
+	useConfig(t, func(c *Config) {
+		c.AlertWebhookURL = webhook.URL
+		c.ClientRateLimitPerDay, c.GlobalRateLimitPerDay = 10, 2
+	})
+	store := NewInMemoryStore()
+	defer store.Close()
+	ctx := context.Background()
+
+	// Under the limit nothing fires
+	for _, ip := range []string{"203.0.113.1", "203.0.113.2"} {
+		if allowed, _, _, _ := CheckRateLimit(ctx, store, ip, 1); !allowed {
+			t.Fatalf("%s rejected under the global limit", ip)
+		}
+		IncrementRateLimit(ctx, store, ip, 1)
+	}
+	if len(payloads) != 0 {
+		t.Fatalf("alert fired %d times before the limit was reached", len(payloads))
+	}
+
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if allowed, _, _, _ := CheckRateLimit(ctx, store, "203.0.113.3", 1); allowed {
+				t.Error("request allowed past the global limit")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(payloads) != 1 {
+		t.Fatalf("alert fired %d times, want once", len(payloads))
+	}
+	want := AlertPayload{Event: AlertEventGlobalLimitExhausted, Service: ServiceName, Date: getTodayKey(), Count: 2, Limit: 2}
+	if payloads[0] != want {
+		t.Errorf("payload = %+v, want %+v", payloads[0], want)
+	}
+
+	// The flag is per day, so the next day's exhaustion alerts again
+	notifyGlobalLimitExhausted(ctx, store, "2000-01-01", 2)
+	if len(payloads) != 2 || payloads[1].Date != "2000-01-01" {
+		t.Errorf("another day's exhaustion did not alert: %+v", payloads)
+	}
+}
+
+func TestGlobalLimitAlertOnFirstRejection(t *testing.T) {
+	tests := []struct {
+		name  string
+		count int64 // Global slots used before the request
+		cost  int64
+	}{
+		{"cost 1 at the limit", 6, 1},
+		{"cost 2 one short of the limit", 5, 2},
+		{"cost 4 three short of the limit", 3, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var payloads []AlertPayload
+			webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var p AlertPayload
+				json.NewDecoder(r.Body).Decode(&p)
+				mu.Lock()
+				payloads = append(payloads, p)
+				mu.Unlock()
+			}))
+			defer webhook.Close()
+			useConfig(t, func(c *Config) {
+				c.AlertWebhookURL = webhook.URL
+				c.ClientRateLimitPerDay, c.GlobalRateLimitPerDay = 10, 6
+			})
+			store := NewInMemoryStore()
+			defer store.Close()
+			ctx := context.Background()
+			IncrementRateLimit(ctx, store, "203.0.113.1", tt.count)
+
+			// Previewing the request reports the rejection without alerting
+			const ip = "203.0.113.2"
+			clientCount, globalCount, err := GetRateLimitCounts(ctx, store, ip)
+			if err != nil {
+				t.Fatalf("GetRateLimitCounts: %v", err)
+			}
+			if RateLimitAllows(ip, clientCount, globalCount, tt.cost) {
+				t.Error("preview allowed a request past the global limit")
+			}
+			if len(payloads) != 0 {
+				t.Fatalf("preview fired %d alerts", len(payloads))
+			}
+
+			if allowed, _, _, _ := CheckRateLimit(ctx, store, ip, tt.cost); allowed {
+				t.Fatal("request allowed past the global limit")
+			}
+			want := AlertPayload{Event: AlertEventGlobalLimitExhausted, Service: ServiceName, Date: getTodayKey(), Count: tt.count, Limit: 6}
+			if len(payloads) != 1 || payloads[0] != want {
+				t.Errorf("payloads = %+v, want [%+v]", payloads, want)
+			}
+		})
+	}
+}
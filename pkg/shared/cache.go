@@ -0,0 +1,130 @@
+package shared
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// =============================================================================
+// Extraction Cache
+// =============================================================================
+
+// ExtractionCacheKey returns a stable hash of everything that influences an
+// extraction's output. Presentation-only options like Minimal are excluded so
+// they share a cache entry. The merged flag isn't part of the JSON body but
+// changes the prompt, so it is keyed explicitly. The request should be
+// prepared first.
+func ExtractionCacheKey(req *AIExtractionRequest) string {
+	keyed := struct {
+		AIExtractionRequest
+		Merged bool `json:"merged,omitempty"`
+	}{*req, req.merged}
+	keyed.Minimal = false
+
+	data, _ := json.Marshal(keyed)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// ETagForKey formats a cache key and the representation served for it (see
+// ResponseRepresentation) as a strong HTTP entity tag. The JSON, minimal, CSV
+// and Anki forms of one extraction differ byte for byte, so each gets its own
+// tag.
+func ETagForKey(key, representation string) string {
+	return `"` + key + "." + representation + `"`
+}
+
+// NotModified reports whether r may be answered with 304 because its
+// If-None-Match already matches etag. Besides GET and HEAD this deliberately
+// covers POST: an extraction POST is a lookup keyed by its body, so a client
+// sending back the ETag of a cached result already holds that result, and
+// the 304 saves the body. Other methods are never answered with 304.
+func NotModified(r *http.Request, etag string) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPost:
+	default:
+		return false
+	}
+	return ETagMatches(r.Header.Get("If-None-Match"), etag)
+}
+
+// ETagMatches reports whether an If-None-Match header value matches etag
+func ETagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// extractionCacheKey returns the Redis key holding a cached extraction
+func extractionCacheKey(key string) string {
+	return redisKey("cache", "extraction", key)
+}
+
+// cachedExtraction is the stored form of an extraction. It carries the
+// header-only CardsTruncated flag so a cache hit reports truncation like the
+// response that filled the cache; entries stored without it read as false.
+type cachedExtraction struct {
+	AIExtractionResponse
+	CardsTruncated bool `json:"cards_truncated,omitempty"`
+}
+
+// GetCachedExtraction returns the cached extraction for key, if present, and
+// records the lookup as a cache hit or miss. A nil client disables caching.
+func GetCachedExtraction(ctx context.Context, client *redis.Client, key string) (*AIExtractionResponse, bool, error) {
+	if client == nil || GetConfig().CacheTTL <= 0 {
+		return nil, false, nil
+	}
+
+	ctx, cancel := redisOpContext(ctx)
+	defer cancel()
+
+	data, err := client.Get(ctx, extractionCacheKey(key)).Bytes()
+	if err == redis.Nil {
+		recordCacheResult(ctx, MetricsStoreExtractionCache, false)
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	recordCacheResult(ctx, MetricsStoreExtractionCache, true)
+
+	var cached cachedExtraction
+	if err := json.Unmarshal(data, &cached); err != nil {
+		return nil, false, fmt.Errorf("failed to decode cached extraction: %w", err)
+	}
+	resp := cached.AIExtractionResponse
+	resp.CardsTruncated = cached.CardsTruncated
+	return &resp, true, nil
+}
+
+// StoreCachedExtraction caches an extraction under key for CacheTTL. Degraded
+// extractions are skipped so the AI result is served once the provider
+// recovers.
+func StoreCachedExtraction(ctx context.Context, client *redis.Client, key string, resp *AIExtractionResponse) error {
+	ttl := GetConfig().CacheTTL
+	if client == nil || ttl <= 0 || resp.Degraded {
+		return nil
+	}
+
+	// Debug output is per-response, so it never outlives a disabled flag
+	cached := cachedExtraction{AIExtractionResponse: *resp, CardsTruncated: resp.CardsTruncated}
+	cached.Debug = nil
+	data, err := json.Marshal(cached)
+	if err != nil {
+		return fmt.Errorf("failed to encode extraction: %w", err)
+	}
+	ctx, cancel := redisOpContext(ctx)
+	defer cancel()
+	return client.Set(ctx, extractionCacheKey(key), data, ttl).Err()
+}
@@ -0,0 +1,141 @@
+package shared
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestExtractionCacheKeyStability(t *testing.T) {
+	useConfig(t, nil)
+	prepared := func(req AIExtractionRequest) *AIExtractionRequest {
+		if err := req.Prepare(); err != nil {
+			t.Fatalf("Prepare: %v", err)
+		}
+		return &req
+	}
+
+	base := ExtractionCacheKey(prepared(AIExtractionRequest{Content: "Cache note", ExistingTags: []string{"go"}}))
+	if again := ExtractionCacheKey(prepared(AIExtractionRequest{Content: "Cache note", ExistingTags: []string{"go"}})); again != base {
+		t.Error("identical requests have different cache keys")
+	}
+	if minimal := ExtractionCacheKey(prepared(AIExtractionRequest{Content: "Cache note", ExistingTags: []string{"go"}, Minimal: true})); minimal != base {
+		t.Error("minimal mode changed the cache key")
+	}
+	if other := ExtractionCacheKey(prepared(AIExtractionRequest{Content: "Other note", ExistingTags: []string{"go"}})); other == base {
+		t.Error("different content shares a cache key")
+	}
+}
+
+func TestETagPerRepresentation(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  string
+		accept  string
+		minimal bool
+		want    string
+	}{
+		{"json", "/api/ai-extraction", "", false, `"k.json"`},
+		{"minimal", "/api/ai-extraction", "", true, `"k.json-minimal"`},
+		{"pretty", "/api/ai-extraction?pretty=true", "", false, `"k.json-pretty"`},
+		{"csv by accept", "/api/ai-extraction", "text/csv", false, `"k.csv"`},
+		{"anki", "/api/ai-extraction?format=anki", "", true, `"k.anki"`},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		r.Header.Set("Accept", tt.accept)
+		if got := ETagForKey("k", ResponseRepresentation(r, tt.minimal)); got != tt.want {
+			t.Errorf("%s: ETag = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	const etag = `"k.json"`
+	tests := []struct {
+		method      string
+		ifNoneMatch string
+		want        bool
+	}{
+		{http.MethodGet, etag, true},
+		{http.MethodHead, etag, true},
+		{http.MethodGet, `W/"k.json"`, true},
+		{http.MethodGet, `"other", "k.json"`, true},
+		{http.MethodGet, "*", true},
+		{http.MethodGet, `"k.csv"`, false},
+		{http.MethodGet, "", false},
+		{http.MethodPost, etag, true},
+		{http.MethodPost, `"k.csv"`, false},
+		{http.MethodPut, etag, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/api/ai-extraction", nil)
+		r.Header.Set("If-None-Match", tt.ifNoneMatch)
+		if got := NotModified(r, etag); got != tt.want {
+			t.Errorf("%s If-None-Match %q: NotModified = %v, want %v", tt.method, tt.ifNoneMatch, got, tt.want)
+		}
+	}
+}
+
+func TestFeatureTTLs(t *testing.T) {
+	cfg := useConfig(t, func(c *Config) {
+		c.CacheTTL = 2 * time.Hour
+		c.MetricsTTL = 48 * time.Hour
+	})
+	store := useMemoryStore(t)
+	srv, client := newFakeRedis(t, nil)
+	useRedisClient(t, cfg, client)
+	ctx := context.Background()
+
+	if _, hit, err := GetCachedExtraction(ctx, client, "ttl-note"); hit || err != nil {
+		t.Fatalf("GetCachedExtraction = %v, %v; want a miss", hit, err)
+	}
+	if err := StoreCachedExtraction(ctx, client, "ttl-note", &AIExtractionResponse{Text: "{}"}); err != nil {
+		t.Fatalf("StoreCachedExtraction: %v", err)
+	}
+	if err := IncrementRateLimit(ctx, store, "203.0.113.1", 1); err != nil {
+		t.Fatalf("IncrementRateLimit: %v", err)
+	}
+
+	if got := srv.expiry[extractionCacheKey("ttl-note")]; got != "ex 7200" {
+		t.Errorf("cache entry stored with %q, want CACHE_TTL of 7200s", got)
+	}
+	tests := []struct {
+		name string
+		key  string
+		want time.Duration
+	}{
+		{"metrics", cacheMetricKey(MetricsStoreExtractionCache, "miss", getTodayKey()), 48 * time.Hour},
+		{"rate limit", clientRateLimitKey("203.0.113.1", getTodayKey()), RateLimitTTL},
+	}
+	for _, tt := range tests {
+		if ttl, _ := store.TTL(ctx, tt.key); ttl <= tt.want-time.Minute || ttl > tt.want {
+			t.Errorf("%s key TTL = %s, want %s", tt.name, ttl, tt.want)
+		}
+	}
+}
+
+func TestExtractionCacheKeyMerged(t *testing.T) {
+	useConfig(t, nil)
+	mergeReq := MergeExtractionRequest{Notes: []string{"Goroutines are cheap.", "Channels synchronize."}}
+	merged, err := mergeReq.ToExtractionRequest()
+	if err != nil {
+		t.Fatalf("ToExtractionRequest: %v", err)
+	}
+	if err := merged.Prepare(); err != nil {
+		t.Fatalf("Prepare: %v", err)
+	}
+	// A plain note with the merged content renders a different prompt
+	plain := AIExtractionRequest{Content: merged.Content}
+	if err := plain.Prepare(); err != nil {
+		t.Fatalf("Prepare: %v", err)
+	}
+	if AIExtractionPrompt(&plain) == AIExtractionPrompt(&merged) {
+		t.Fatal("merged and plain requests render the same prompt")
+	}
+	if ExtractionCacheKey(&plain) == ExtractionCacheKey(&merged) {
+		t.Error("a plain note shares the cache key of the merged notes it matches")
+	}
+}
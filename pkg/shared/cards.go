@@ -0,0 +1,809 @@
+package shared
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/language"
+)
+
+// =============================================================================
+// Card Parsing & Post-Processing
+// =============================================================================
+
+// Card length enforcement modes
+const (
+	CardLengthOff        = "off"        // Only report word counts
+	CardLengthFlag       = "flag"       // Mark out-of-range cards with length_flag
+	CardLengthTruncate   = "truncate"   // Trim long cards at a sentence boundary
+	CardLengthRegenerate = "regenerate" // Ask the model once to rewrite offending cards
+)
+
+// Card ID schemes
+const (
+	CardIDSchemeHash = "hash" // Deterministic hash of content and index (default)
+	CardIDSchemeUUID = "uuid" // Random UUID per card
+)
+
+// Card difficulty ratings requested via include_difficulty
+const (
+	DifficultyEasy   = "easy"
+	DifficultyMedium = "medium"
+	DifficultyHard   = "hard"
+)
+
+// DefaultConfidence is assigned to cards the model didn't rate when
+// include_confidence was requested
+const DefaultConfidence = 0.5
+
+// Length flags set on cards outside the configured word range
+const (
+	LengthFlagTooShort = "too_short"
+	LengthFlagTooLong  = "too_long"
+)
+
+// ErrEmptyExtraction is returned when the provider responds successfully but
+// produces no usable cards
+var ErrEmptyExtraction = errors.New("AI service returned an empty extraction")
+
+// ErrInvalidExtraction is returned when the model output cannot be parsed into
+// cards
+var ErrInvalidExtraction = errors.New("AI service returned an unparseable extraction")
+
+// ExtractionOutput is the JSON produced by AIExtractionPrompt. Title and
+// Summary are only present when include_summary was requested.
+type ExtractionOutput struct {
+	Title   string `json:"title,omitempty"`
+	Summary string `json:"summary,omitempty"`
+	Cards   []Card `json:"cards"`
+}
+
+// ParseExtraction decodes the JSON produced by AIExtractionPrompt
+func ParseExtraction(text string) (*ExtractionOutput, error) {
+	var parsed ExtractionOutput
+	if err := json.Unmarshal([]byte(stripCodeFence(text)), &parsed); err != nil {
+		return nil, fmt.Errorf("failed to parse cards: %w", err)
+	}
+	return &parsed, nil
+}
+
+// ParseCards decodes only the cards from the JSON produced by AIExtractionPrompt
+func ParseCards(text string) ([]Card, error) {
+	parsed, err := ParseExtraction(text)
+	if err != nil {
+		return nil, err
+	}
+	return parsed.Cards, nil
+}
+
+// BuildExtractionResponse decodes a successful Gemini Army response body for
+// req and applies card post-processing. The Text field is re-rendered from the
+// processed cards so both representations stay consistent. Output that cannot
+// be parsed, or that does not match the response schema once processed, yields
+// ErrInvalidExtraction and empty output ErrEmptyExtraction, so callers only
+// ever receive well-formed responses containing at least one card.
+func BuildExtractionResponse(ctx context.Context, req *AIExtractionRequest, body []byte) (*AIExtractionResponse, error) {
+	ctx, span := StartSpan(ctx, "extraction.parse")
+	defer span.End()
+	span.SetAttribute("extraction.response_size", len(body))
+
+	resp, err := buildExtractionResponse(ctx, req, body)
+	if resp != nil {
+		span.SetAttribute("extraction.card_count", len(resp.Cards))
+	}
+	span.RecordError(err)
+	return resp, err
+}
+
+func buildExtractionResponse(ctx context.Context, req *AIExtractionRequest, body []byte) (*AIExtractionResponse, error) {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil, ErrEmptyExtraction
+	}
+
+	var resp AIExtractionResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("failed to decode Gemini Army response: %w", err)
+	}
+	if strings.TrimSpace(resp.Text) == "" {
+		return nil, ErrEmptyExtraction
+	}
+	if resp.Model == "" {
+		resp.Model = req.Model
+	}
+	resp.PIIRedacted = req.piiRedacted
+
+	parsed, err := ParseExtraction(resp.Text)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidExtraction, err)
+	}
+	cards := parsed.Cards
+	if len(cards) == 0 {
+		return nil, ErrEmptyExtraction
+	}
+	if req.IncludeSummary {
+		// Leave room for the ellipsis truncateRunes appends
+		resp.Title = truncateRunes(strings.TrimSpace(parsed.Title), MaxTitleChars-1)
+		resp.Summary = truncateRunes(strings.TrimSpace(parsed.Summary), MaxSummaryChars-1)
+	}
+
+	// Rank before truncating so MaxCards keeps the most important cards
+	OrderByImportance(cards, req.OrderByImportance)
+	if maxCards := GetConfig().MaxCards; len(cards) > maxCards {
+		cards = cards[:maxCards]
+		resp.CardsTruncated = true
+	}
+
+	if req.Format == CardFormatOutline {
+		EnforceOutline(cards)
+	}
+	if GetConfig().ValidationRetry {
+		cards = retryInvalidCards(ctx, req, cards)
+	}
+	cards = EnforceCardLength(ctx, req, cards)
+	ApplyForcedTags(cards, req.ForceTags)
+	LimitTags(cards, GetConfig().MaxTagsPerCard, req.ForceTags)
+	NormalizeProjects(cards, req.ExistingProjects)
+	if req.StrictProjects {
+		RestrictProjects(cards, req.ExistingProjects)
+	}
+	NormalizeDifficulty(cards, req.IncludeDifficulty)
+	NormalizeConfidence(cards, req.IncludeConfidence)
+	NormalizeIcons(cards, req.IncludeIcon)
+	resp.Languages = NormalizeLanguages(cards, req.GroupByLanguage, !req.OrderByImportance)
+	RestrictRelatedNotes(cards, req.ExistingNoteTitles, req.IncludeRelated)
+	RestrictCitations(cards, req.References, req.CiteSources)
+	AssignCardIDs(cards)
+	if len(req.PreviousCards) > 0 {
+		resp.Diff = DiffCards(req.PreviousCards, cards)
+	}
+	resp.SetCards(cards)
+
+	if err := ValidateExtractionResponse(&resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// tagPattern matches a normalized tag name, e.g. "machine-learning"
+var tagPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// NormalizeTag converts a tag to the "tag-name" convention: lowercase, with
+// whitespace and underscores replaced by single dashes
+func NormalizeTag(tag string) string {
+	fields := strings.FieldsFunc(strings.ToLower(tag), func(r rune) bool {
+		return unicode.IsSpace(r) || r == '_' || r == '-'
+	})
+	return strings.Join(fields, "-")
+}
+
+// NormalizeTags normalizes each tag and drops empty and duplicate entries,
+// preserving first-seen order
+func NormalizeTags(tags []string) []string {
+	if tags == nil {
+		return nil
+	}
+	seen := make(map[string]bool, len(tags))
+	normalized := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = NormalizeTag(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	return normalized
+}
+
+// ApplyForcedTags merges forced into every card's suggested tags. Model
+// suggestions are normalized first so a forced tag is never duplicated.
+func ApplyForcedTags(cards []Card, forced []string) {
+	if len(forced) == 0 {
+		return
+	}
+	for i := range cards {
+		cards[i].SuggestedTags = NormalizeTags(append(slices.Clone(cards[i].SuggestedTags), forced...))
+	}
+}
+
+// LimitTags keeps at most maxTags suggested tags per card. The model lists
+// tags by relevance, so the first ones are kept; tags in forced always
+// survive and count towards the limit.
+func LimitTags(cards []Card, maxTags int, forced []string) {
+	for i := range cards {
+		tags := cards[i].SuggestedTags
+		if len(tags) <= maxTags {
+			continue
+		}
+		budget := maxTags - len(forced)
+		kept := make([]string, 0, maxTags)
+		for _, tag := range tags {
+			switch {
+			case slices.Contains(forced, tag):
+				kept = append(kept, tag)
+			case budget > 0:
+				kept = append(kept, tag)
+				budget--
+			}
+		}
+		cards[i].SuggestedTags = kept
+	}
+}
+
+// projectKey reduces a project name to lowercase letters and digits, so
+// "Project X", "project-x" and "project_x" compare equal. Names without any
+// letters or digits are compared lowercased as a whole.
+func projectKey(name string) string {
+	key := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, name)
+	if key == "" {
+		return strings.ToLower(strings.TrimSpace(name))
+	}
+	return key
+}
+
+// NormalizeProjects snaps near-duplicate suggested projects across cards to
+// one canonical spelling: the matching entry in existing when there is one,
+// otherwise the first spelling suggested. Blank suggestions become nil.
+func NormalizeProjects(cards []Card, existing []string) {
+	canonical := make(map[string]string)
+	for _, project := range existing {
+		if key := projectKey(project); key != "" {
+			if _, ok := canonical[key]; !ok {
+				canonical[key] = strings.TrimSpace(project)
+			}
+		}
+	}
+
+	for i := range cards {
+		if cards[i].SuggestedProject == nil {
+			continue
+		}
+		suggested := strings.TrimSpace(*cards[i].SuggestedProject)
+		key := projectKey(suggested)
+		if key == "" {
+			cards[i].SuggestedProject = nil
+			continue
+		}
+		project, ok := canonical[key]
+		if !ok {
+			project = suggested
+			canonical[key] = project
+		}
+		cards[i].SuggestedProject = &project
+	}
+}
+
+// RestrictProjects sets each card's suggested project to the matching entry
+// in existing (compared case-insensitively), or to nil when the model
+// suggested a project outside the list
+func RestrictProjects(cards []Card, existing []string) {
+	for i := range cards {
+		if cards[i].SuggestedProject == nil {
+			continue
+		}
+		suggested := strings.TrimSpace(*cards[i].SuggestedProject)
+		cards[i].SuggestedProject = nil
+		for _, project := range existing {
+			if strings.EqualFold(suggested, strings.TrimSpace(project)) {
+				cards[i].SuggestedProject = &project
+				break
+			}
+		}
+	}
+}
+
+// NormalizeDifficulty lowercases each card's difficulty, defaulting
+// off-list values to medium. Ratings are dropped when they weren't requested.
+func NormalizeDifficulty(cards []Card, requested bool) {
+	for i := range cards {
+		if !requested {
+			cards[i].Difficulty = ""
+			continue
+		}
+		switch difficulty := strings.ToLower(strings.TrimSpace(cards[i].Difficulty)); difficulty {
+		case DifficultyEasy, DifficultyMedium, DifficultyHard:
+			cards[i].Difficulty = difficulty
+		default:
+			cards[i].Difficulty = DifficultyMedium
+		}
+	}
+}
+
+// NormalizeConfidence clamps each card's confidence to [0, 1], defaulting
+// missing values to DefaultConfidence. Ratings are dropped when they
+// weren't requested.
+func NormalizeConfidence(cards []Card, requested bool) {
+	for i := range cards {
+		if !requested {
+			cards[i].Confidence = nil
+			continue
+		}
+		confidence := DefaultConfidence
+		if c := cards[i].Confidence; c != nil {
+			confidence = min(max(*c, 0), 1)
+		}
+		cards[i].Confidence = &confidence
+	}
+}
+
+// OrderByImportance stably sorts cards by the model's priority, cards without
+// one last, then renumbers them 1..n so priorities are distinct and match the
+// returned order. Priorities are dropped when ordering wasn't requested.
+func OrderByImportance(cards []Card, requested bool) {
+	if !requested {
+		for i := range cards {
+			cards[i].Priority = nil
+		}
+		return
+	}
+	slices.SortStableFunc(cards, func(a, b Card) int {
+		switch {
+		case a.Priority == nil && b.Priority == nil:
+			return 0
+		case a.Priority == nil:
+			return 1
+		case b.Priority == nil:
+			return -1
+		}
+		return *a.Priority - *b.Priority
+	})
+	for i := range cards {
+		priority := i + 1
+		cards[i].Priority = &priority
+	}
+}
+
+// NormalizeIcons trims each card's icon and drops any that isn't a single
+// emoji, leaving the card without one. Icons are dropped when they weren't
+// requested.
+func NormalizeIcons(cards []Card, requested bool) {
+	for i := range cards {
+		icon := strings.TrimSpace(cards[i].Icon)
+		if !requested || !IsSingleEmoji(icon) {
+			icon = ""
+		}
+		cards[i].Icon = icon
+	}
+}
+
+// NormalizeLanguages canonicalizes each card's language to its ISO 639 base
+// code, dropping codes that don't parse, and returns the languages found
+// ordered by card count, ties by first appearance. With group set, cards are
+// stably grouped in that order, cards without a language last. Languages are
+// dropped when they weren't requested.
+func NormalizeLanguages(cards []Card, requested, group bool) []string {
+	counts := make(map[string]int)
+	var languages []string
+	for i := range cards {
+		code := ""
+		if requested {
+			code = canonicalLanguage(cards[i].Language)
+		}
+		cards[i].Language = code
+		if code == "" {
+			continue
+		}
+		if counts[code] == 0 {
+			languages = append(languages, code)
+		}
+		counts[code]++
+	}
+	slices.SortStableFunc(languages, func(a, b string) int {
+		return counts[b] - counts[a]
+	})
+
+	if group && len(languages) > 1 {
+		rank := func(code string) int {
+			if i := slices.Index(languages, code); i >= 0 {
+				return i
+			}
+			return len(languages)
+		}
+		slices.SortStableFunc(cards, func(a, b Card) int {
+			return rank(a.Language) - rank(b.Language)
+		})
+	}
+	return languages
+}
+
+// canonicalLanguage returns the ISO 639 base code for a BCP 47 tag such as
+// "fr" or "en-US", or "" when it isn't a known language
+func canonicalLanguage(code string) string {
+	tag, err := language.Parse(strings.TrimSpace(code))
+	if err != nil || tag == language.Und {
+		return ""
+	}
+	base, confidence := tag.Base()
+	if confidence == language.No {
+		return ""
+	}
+	return base.String()
+}
+
+// IsSingleEmoji reports whether s is exactly one emoji grapheme: a
+// pictograph with optional variation selector, skin tone or tag modifiers,
+// several joined by ZWJ, a regional-indicator flag pair, or a keycap
+func IsSingleEmoji(s string) bool {
+	runes := []rune(s)
+	if len(runes) == 0 {
+		return false
+	}
+
+	// Flags: exactly two regional indicators
+	if isRegionalIndicator(runes[0]) {
+		return len(runes) == 2 && isRegionalIndicator(runes[1])
+	}
+
+	// Keycaps: 0-9, # or * followed by an optional VS16 and U+20E3
+	if strings.ContainsRune("0123456789#*", runes[0]) {
+		rest := runes[1:]
+		if len(rest) > 0 && rest[0] == variationSelector16 {
+			rest = rest[1:]
+		}
+		return len(rest) == 1 && rest[0] == combiningKeycap
+	}
+
+	for i := 0; ; {
+		if i >= len(runes) || !isPictographic(runes[i]) {
+			return false
+		}
+		i++
+		for i < len(runes) && isEmojiModifier(runes[i]) {
+			i++
+		}
+		if i == len(runes) {
+			return true
+		}
+		if runes[i] != zeroWidthJoiner {
+			return false
+		}
+		i++
+	}
+}
+
+// Code points that combine with a base emoji
+const (
+	zeroWidthJoiner     = '\u200d'
+	variationSelector16 = '\ufe0f'
+	combiningKeycap     = '\u20e3'
+)
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1F1E6 && r <= 0x1F1FF
+}
+
+// isPictographic approximates Unicode's Extended_Pictographic property with
+// the blocks that hold emoji
+func isPictographic(r rune) bool {
+	switch {
+	case r >= 0x1F000 && r <= 0x1FAFF: // Pictographs, emoticons, transport, supplemental symbols
+		return !isRegionalIndicator(r) && !(r >= 0x1F3FB && r <= 0x1F3FF)
+	case r >= 0x2600 && r <= 0x27BF: // Miscellaneous symbols and dingbats
+		return true
+	case r >= 0x2300 && r <= 0x23FF, r >= 0x2190 && r <= 0x21FF, r >= 0x2B00 && r <= 0x2BFF, r >= 0x25A0 && r <= 0x25FF:
+		return true
+	}
+	switch r {
+	case 0x00A9, 0x00AE, 0x203C, 0x2049, 0x2122, 0x2139, 0x24C2, 0x3030, 0x303D, 0x3297, 0x3299:
+		return true
+	}
+	return false
+}
+
+// isEmojiModifier reports whether r modifies the preceding emoji: VS16, a
+// skin tone, or a tag character used by subdivision flags
+func isEmojiModifier(r rune) bool {
+	return r == variationSelector16 || (r >= 0x1F3FB && r <= 0x1F3FF) || (r >= 0xE0020 && r <= 0xE007F)
+}
+
+// RestrictRelatedNotes keeps only related notes matching a provided title
+// (compared case-insensitively, returned in the provided spelling), dropping
+// hallucinated and duplicate ones. Relations are removed entirely when they
+// weren't requested.
+func RestrictRelatedNotes(cards []Card, titles []string, requested bool) {
+	for i := range cards {
+		suggested := cards[i].RelatedNotes
+		cards[i].RelatedNotes = nil
+		if !requested {
+			continue
+		}
+		for _, s := range suggested {
+			for _, title := range titles {
+				if strings.EqualFold(strings.TrimSpace(s), title) && !slices.Contains(cards[i].RelatedNotes, title) {
+					cards[i].RelatedNotes = append(cards[i].RelatedNotes, title)
+					break
+				}
+			}
+		}
+	}
+}
+
+// RestrictCitations replaces each card's citation with the provided
+// reference it matches, either verbatim or by its prompt number such as
+// "[2]", and clears citations matching none. Citations are dropped when they
+// weren't requested.
+func RestrictCitations(cards []Card, references []string, requested bool) {
+	for i := range cards {
+		suggested := strings.Join(strings.Fields(cards[i].Citation), " ")
+		cards[i].Citation = ""
+		if !requested || suggested == "" {
+			continue
+		}
+		if n, err := strconv.Atoi(strings.Trim(suggested, "[]")); err == nil {
+			if n >= 1 && n <= len(references) {
+				cards[i].Citation = references[n-1]
+			}
+			continue
+		}
+		for _, ref := range references {
+			if strings.EqualFold(suggested, ref) {
+				cards[i].Citation = ref
+				break
+			}
+		}
+	}
+}
+
+// AssignCardIDs sets an ID on every card using the configured CardIDScheme. Hash IDs
+// are derived from the card content and position, so re-extracting a note
+// that yields the same card produces the same ID.
+func AssignCardIDs(cards []Card) {
+	scheme := GetConfig().CardIDScheme
+	for i := range cards {
+		if scheme == CardIDSchemeUUID {
+			cards[i].ID = newUUID()
+			continue
+		}
+		sum := sha256.Sum256([]byte(fmt.Sprintf("%d:%s", i, cards[i].Content)))
+		cards[i].ID = hex.EncodeToString(sum[:8])
+	}
+}
+
+// newUUID returns a random RFC 4122 version 4 UUID
+func newUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		log.Printf("Failed to generate UUID: %v", err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// SetCards replaces the response cards and re-renders Text to match,
+// including the title and summary when set
+func (r *AIExtractionResponse) SetCards(cards []Card) {
+	r.Cards = cards
+	text, err := json.Marshal(ExtractionOutput{Title: r.Title, Summary: r.Summary, Cards: cards})
+	if err == nil {
+		r.Text = string(text)
+	}
+}
+
+// outlineItemPattern matches a bullet or numbered list item, capturing its
+// indentation and text
+var outlineItemPattern = regexp.MustCompile(`^(\s*)(?:[-*+]|\d+[.)])\s+(.*)$`)
+
+// EnforceOutline rewrites each card's content as a well-formed bullet
+// outline. List items keep their nesting and are normalized to "- " markers
+// indented two spaces per level; any other non-blank line becomes a top-level
+// item.
+func EnforceOutline(cards []Card) {
+	for i := range cards {
+		var lines []string
+		for _, line := range strings.Split(cards[i].Content, "\n") {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			m := outlineItemPattern.FindStringSubmatch(line)
+			if m == nil {
+				lines = append(lines, "- "+strings.TrimSpace(line))
+				continue
+			}
+			indent := strings.ReplaceAll(m[1], "\t", "  ")
+			level := len(indent) / 2
+			lines = append(lines, strings.Repeat("  ", level)+"- "+strings.TrimSpace(m[2]))
+		}
+		cards[i].Content = strings.Join(lines, "\n")
+	}
+}
+
+// countWords returns the number of whitespace-separated words in s
+func countWords(s string) int {
+	return len(strings.Fields(s))
+}
+
+// EnforceCardLength sets word counts on every card and applies the configured
+// CardLengthMode to cards outside the CardMinWords to CardMaxWords range
+func EnforceCardLength(ctx context.Context, req *AIExtractionRequest, cards []Card) []Card {
+	cfg := GetConfig()
+	mode := cfg.CardLengthMode
+	minWords, maxWords := cfg.CardMinWords, cfg.CardMaxWords
+
+	if mode == CardLengthRegenerate {
+		cards = regenerateOutOfRangeCards(ctx, req, cards, minWords, maxWords)
+	}
+	applyCardLength(cards, mode, minWords, maxWords)
+	return cards
+}
+
+// applyCardLength sets word counts and applies the truncate and flag modes
+func applyCardLength(cards []Card, mode string, minWords, maxWords int) {
+	for i := range cards {
+		if mode == CardLengthTruncate && countWords(cards[i].Content) > maxWords {
+			cards[i].Content = truncateAtSentence(cards[i].Content, maxWords)
+		}
+
+		cards[i].WordCount = countWords(cards[i].Content)
+		cards[i].LengthFlag = ""
+		if mode == CardLengthOff {
+			continue
+		}
+		if cards[i].WordCount < minWords {
+			cards[i].LengthFlag = LengthFlagTooShort
+		} else if cards[i].WordCount > maxWords {
+			cards[i].LengthFlag = LengthFlagTooLong
+		}
+	}
+}
+
+// truncateAtSentence cuts content to at most maxWords words, backing up to the
+// last sentence terminator when one exists in the kept text
+func truncateAtSentence(content string, maxWords int) string {
+	words := strings.Fields(content)
+	if len(words) <= maxWords {
+		return content
+	}
+
+	// Locate the byte offset where word maxWords+1 begins so the original
+	// formatting (newlines, markdown) of the kept portion is preserved
+	cut := len(content)
+	seen := 0
+	inWord := false
+	for i, ch := range content {
+		isSpace := ch == ' ' || ch == '\n' || ch == '\t' || ch == '\r'
+		if !isSpace && !inWord {
+			if seen == maxWords {
+				cut = i
+				break
+			}
+			seen++
+		}
+		inWord = !isSpace
+	}
+	kept := strings.TrimSpace(content[:cut])
+
+	if idx := strings.LastIndexAny(kept, ".!?"); idx > 0 {
+		return kept[:idx+1]
+	}
+	return kept + "…"
+}
+
+// regenerateOutOfRangeCards asks the model once to rewrite every card whose
+// word count falls outside the range. Cards are left unchanged if the
+// regeneration call fails or returns a mismatched number of cards.
+func regenerateOutOfRangeCards(ctx context.Context, req *AIExtractionRequest, cards []Card, minWords, maxWords int) []Card {
+	var offending []int
+	for i, card := range cards {
+		words := countWords(card.Content)
+		if words < minWords || words > maxWords {
+			offending = append(offending, i)
+		}
+	}
+	if len(offending) == 0 {
+		return cards
+	}
+
+	contents := make([]string, len(offending))
+	for i, idx := range offending {
+		contents[i] = cards[idx].Content
+	}
+
+	status, body, err := GenerateWithGemini(ctx, req.GeminiRequest(CardLengthRegenerationPrompt(contents, minWords, maxWords)))
+	if err != nil || status != http.StatusOK {
+		log.Printf("Card regeneration failed (status %d): %v", status, err)
+		return cards
+	}
+
+	var resp AIExtractionResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		log.Printf("Card regeneration decode error: %v", err)
+		return cards
+	}
+	rewritten, err := ParseCards(resp.Text)
+	if err != nil || len(rewritten) != len(offending) {
+		log.Printf("Card regeneration returned unusable cards: %v", err)
+		return cards
+	}
+
+	for i, idx := range offending {
+		cards[idx].Content = rewritten[i].Content
+	}
+	return cards
+}
+
+// cardProblems lists why a card fails validation: too short for the length
+// mode, no usable tags, or a project outside ExistingProjects when
+// StrictProjects is set
+func cardProblems(req *AIExtractionRequest, card Card) []string {
+	cfg := GetConfig()
+	var problems []string
+	if cfg.CardLengthMode != CardLengthOff && countWords(card.Content) < cfg.CardMinWords {
+		problems = append(problems, fmt.Sprintf("shorter than %d words", cfg.CardMinWords))
+	}
+	if len(NormalizeTags(card.SuggestedTags)) == 0 {
+		problems = append(problems, "no usable tags")
+	}
+	if req.StrictProjects && card.SuggestedProject != nil && strings.TrimSpace(*card.SuggestedProject) != "" {
+		key := projectKey(*card.SuggestedProject)
+		if !slices.ContainsFunc(req.ExistingProjects, func(p string) bool { return projectKey(p) == key }) {
+			problems = append(problems, "project is not one of the existing projects")
+		}
+	}
+	return problems
+}
+
+// retryInvalidCards re-prompts the model once for every card that fails
+// validation and merges the corrected cards back in place. The retry is part
+// of the same extraction, so it costs no extra rate-limit slot. Cards are
+// left unchanged if the call fails or returns a mismatched number of cards.
+func retryInvalidCards(ctx context.Context, req *AIExtractionRequest, cards []Card) []Card {
+	var invalid []int
+	var problems [][]string
+	for i, card := range cards {
+		if p := cardProblems(req, card); len(p) > 0 {
+			invalid = append(invalid, i)
+			problems = append(problems, p)
+		}
+	}
+	if len(invalid) == 0 {
+		return cards
+	}
+
+	flagged := make([]Card, len(invalid))
+	for i, idx := range invalid {
+		flagged[i] = cards[idx]
+	}
+
+	status, body, err := GenerateWithGemini(ctx, req.GeminiRequest(CardValidationRetryPrompt(req, flagged, problems)))
+	if err != nil || status != http.StatusOK {
+		log.Printf("Card validation retry failed (status %d): %v", status, err)
+		return cards
+	}
+
+	var resp AIExtractionResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		log.Printf("Card validation retry decode error: %v", err)
+		return cards
+	}
+	corrected, err := ParseCards(resp.Text)
+	if err != nil || len(corrected) != len(invalid) {
+		log.Printf("Card validation retry returned unusable cards: %v", err)
+		return cards
+	}
+
+	for i, idx := range invalid {
+		cards[idx].Content = corrected[i].Content
+		cards[idx].SuggestedTags = corrected[i].SuggestedTags
+		cards[idx].SuggestedProject = corrected[i].SuggestedProject
+	}
+	return cards
+}
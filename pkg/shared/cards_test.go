@@ -0,0 +1,705 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// buildResponse runs BuildExtractionResponse for req over a provider response
+// carrying cards as the model output
+func buildResponse(t *testing.T, req *AIExtractionRequest, cards ...map[string]any) (*AIExtractionResponse, error) {
+	t.Helper()
+	if err := req.Prepare(); err != nil {
+		t.Fatalf("Prepare: %v", err)
+	}
+	text, _ := json.Marshal(map[string]any{"cards": cards})
+	return BuildExtractionResponse(context.Background(), req, providerResponse(string(text)))
+}
+
+// card returns a model card with content, tagged "go" unless fields say
+// otherwise
+func card(content string, fields ...any) map[string]any {
+	c := map[string]any{"content": content, "suggested_tags": []string{"go"}, "suggested_project": nil}
+	for i := 0; i+1 < len(fields); i += 2 {
+		c[fields[i].(string)] = fields[i+1]
+	}
+	return c
+}
+
+func TestBuildExtractionResponseCapsCards(t *testing.T) {
+	tests := []struct {
+		returned      int
+		wantCards     int
+		wantTruncated bool
+	}{
+		{2, 2, false},
+		{3, 3, false},
+		{10, 3, true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.returned), func(t *testing.T) {
+			useConfig(t, func(c *Config) { c.MaxCards = 3 })
+			cards := make([]map[string]any, tt.returned)
+			for i := range cards {
+				cards[i] = card(fmt.Sprintf("Card number %d", i+1))
+			}
+			resp, err := buildResponse(t, &AIExtractionRequest{Content: "Capped note"}, cards...)
+			if err != nil {
+				t.Fatalf("BuildExtractionResponse: %v", err)
+			}
+			if len(resp.Cards) != tt.wantCards || resp.CardsTruncated != tt.wantTruncated {
+				t.Errorf("got %d cards, truncated %v; want %d, %v", len(resp.Cards), resp.CardsTruncated, tt.wantCards, tt.wantTruncated)
+			}
+			text, err := ParseCards(resp.Text)
+			if err != nil || len(text) != tt.wantCards {
+				t.Errorf("text carries %d cards (%v), want %d", len(text), err, tt.wantCards)
+			}
+			if resp.Cards[0].Content != "Card number 1" {
+				t.Errorf("first card = %q, want the model's first card kept", resp.Cards[0].Content)
+			}
+		})
+	}
+}
+
+func TestAssignCardIDs(t *testing.T) {
+	newCards := func() []Card {
+		return []Card{{Content: "Same content"}, {Content: "Same content"}, {Content: "Other content"}}
+	}
+	ids := func(cards []Card) []string {
+		out := make([]string, len(cards))
+		for i, c := range cards {
+			out[i] = c.ID
+		}
+		return out
+	}
+
+	t.Run("hash", func(t *testing.T) {
+		useConfig(t, func(c *Config) { c.CardIDScheme = CardIDSchemeHash })
+		first, second := newCards(), newCards()
+		AssignCardIDs(first)
+		AssignCardIDs(second)
+		if fmt.Sprint(ids(first)) != fmt.Sprint(ids(second)) {
+			t.Errorf("IDs differ across identical inputs: %v vs %v", ids(first), ids(second))
+		}
+		if first[0].ID == first[1].ID {
+			t.Error("cards with the same content at different positions share an ID")
+		}
+		if len(first[0].ID) != 16 {
+			t.Errorf("ID %q, want 16 hex characters", first[0].ID)
+		}
+	})
+
+	t.Run("uuid", func(t *testing.T) {
+		useConfig(t, func(c *Config) { c.CardIDScheme = CardIDSchemeUUID })
+		first, second := newCards(), newCards()
+		AssignCardIDs(first)
+		AssignCardIDs(second)
+		if first[0].ID == second[0].ID {
+			t.Error("uuid scheme produced the same ID twice")
+		}
+		if len(first[0].ID) != 36 || first[0].ID[14] != '4' {
+			t.Errorf("ID %q is not a version 4 UUID", first[0].ID)
+		}
+	})
+}
+
+func TestForcedTags(t *testing.T) {
+	useConfig(t, func(c *Config) { c.MaxTagsPerCard = 4 })
+	req := &AIExtractionRequest{Content: "Forced tags note", ForceTags: []string{"Inbox", "go"}}
+	resp, err := buildResponse(t, req,
+		card("First card", "suggested_tags", []string{"Go", "concurrency"}),
+		card("Second card", "suggested_tags", []string{"inbox"}),
+		card("Third card", "suggested_tags", []string{}),
+	)
+	if err != nil {
+		t.Fatalf("BuildExtractionResponse: %v", err)
+	}
+	want := [][]string{
+		{"go", "concurrency", "inbox"},
+		{"inbox", "go"},
+		{"inbox", "go"},
+	}
+	for i, c := range resp.Cards {
+		if fmt.Sprint(c.SuggestedTags) != fmt.Sprint(want[i]) {
+			t.Errorf("card %d tags = %v, want %v", i, c.SuggestedTags, want[i])
+		}
+	}
+
+	bad := &AIExtractionRequest{Content: "x", ForceTags: []string{"not a tag!"}}
+	if err := bad.Prepare(); err == nil {
+		t.Error("Prepare accepted an invalid force tag")
+	}
+	tooMany := &AIExtractionRequest{Content: "x", ForceTags: []string{"a", "b", "c", "d", "e", "f"}}
+	if err := tooMany.Prepare(); err == nil {
+		t.Errorf("Prepare accepted more than %d force tags", MaxForceTags)
+	}
+}
+
+func TestStrictProjects(t *testing.T) {
+	existing := []string{"Swipe Notes", "Reading"}
+	tests := []struct {
+		name      string
+		strict    bool
+		suggested any
+		want      string
+	}{
+		{"existing project", true, "Swipe Notes", "Swipe Notes"},
+		{"existing project other case", true, "swipe notes", "Swipe Notes"},
+		{"hallucinated, strict", true, "Gardening", ""},
+		{"hallucinated, lenient", false, "Gardening", "Gardening"},
+		{"none suggested", true, nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, nil)
+			req := &AIExtractionRequest{Content: "Project note", ExistingProjects: existing, StrictProjects: tt.strict}
+			resp, err := buildResponse(t, req, card("A card", "suggested_project", tt.suggested))
+			if err != nil {
+				t.Fatalf("BuildExtractionResponse: %v", err)
+			}
+			got := ""
+			if p := resp.Cards[0].SuggestedProject; p != nil {
+				got = *p
+			}
+			if got != tt.want {
+				t.Errorf("suggested_project = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDifficultyRatings(t *testing.T) {
+	tests := []struct {
+		name      string
+		requested bool
+		returned  any
+		want      string
+	}{
+		{"easy", true, "easy", DifficultyEasy},
+		{"normalized case", true, " HARD ", DifficultyHard},
+		{"off-list", true, "impossible", DifficultyMedium},
+		{"missing", true, nil, DifficultyMedium},
+		{"not requested", false, "hard", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, nil)
+			req := &AIExtractionRequest{Content: "Difficulty note", IncludeDifficulty: tt.requested}
+			c := card("A card")
+			if tt.returned != nil {
+				c["difficulty"] = tt.returned
+			}
+			resp, err := buildResponse(t, req, c)
+			if err != nil {
+				t.Fatalf("BuildExtractionResponse: %v", err)
+			}
+			if got := resp.Cards[0].Difficulty; got != tt.want {
+				t.Errorf("difficulty = %q, want %q", got, tt.want)
+			}
+			if got := strings.Contains(AIExtractionPrompt(req), `"difficulty": "easy, medium or hard"`); got != tt.requested {
+				t.Errorf("prompt asks for difficulty = %v, want %v", got, tt.requested)
+			}
+		})
+	}
+}
+
+func TestIncludeSummary(t *testing.T) {
+	longSummary := strings.Repeat("s", MaxSummaryChars+50)
+	tests := []struct {
+		name                   string
+		requested              bool
+		title, summary         string
+		wantTitle, wantSummary string
+	}{
+		{"requested", true, " Go concurrency ", "Goroutines and channels.", "Go concurrency", "Goroutines and channels."},
+		{"summary too long", true, "T", longSummary, "T", strings.Repeat("s", MaxSummaryChars-1) + "…"},
+		{"not requested", false, "Go concurrency", "Goroutines and channels.", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, nil)
+			req := &AIExtractionRequest{Content: "Summary note", IncludeSummary: tt.requested}
+			if err := req.Prepare(); err != nil {
+				t.Fatalf("Prepare: %v", err)
+			}
+			if got := strings.Contains(AIExtractionPrompt(req), `"summary"`); got != tt.requested {
+				t.Errorf("prompt asks for a summary = %v, want %v", got, tt.requested)
+			}
+
+			text, _ := json.Marshal(map[string]any{"title": tt.title, "summary": tt.summary, "cards": []map[string]any{card("A card")}})
+			resp, err := BuildExtractionResponse(context.Background(), req, providerResponse(string(text)))
+			if err != nil {
+				t.Fatalf("BuildExtractionResponse: %v", err)
+			}
+			if resp.Title != tt.wantTitle || resp.Summary != tt.wantSummary {
+				t.Errorf("title, summary = %q, %q; want %q, %q", resp.Title, resp.Summary, tt.wantTitle, tt.wantSummary)
+			}
+			if n := len([]rune(resp.Summary)); n > MaxSummaryChars {
+				t.Errorf("summary is %d characters, over MaxSummaryChars", n)
+			}
+		})
+	}
+}
+
+func TestRelatedNotes(t *testing.T) {
+	titles := []string{"Go Concurrency", "Channel  Patterns"}
+	tests := []struct {
+		name      string
+		requested bool
+		suggested []string
+		want      []string
+	}{
+		{"exact titles", true, []string{"Go Concurrency"}, []string{"Go Concurrency"}},
+		{"other case and spacing", true, []string{" go concurrency ", "channel patterns"}, []string{"Go Concurrency", "Channel Patterns"}},
+		{"hallucinated title", true, []string{"Rust Ownership", "Go Concurrency"}, []string{"Go Concurrency"}},
+		{"duplicates", true, []string{"Go Concurrency", "GO CONCURRENCY"}, []string{"Go Concurrency"}},
+		{"not requested", false, []string{"Go Concurrency"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, nil)
+			req := &AIExtractionRequest{Content: "Related note", ExistingNoteTitles: slices.Clone(titles), IncludeRelated: tt.requested}
+			resp, err := buildResponse(t, req, card("A card", "related_notes", tt.suggested))
+			if err != nil {
+				t.Fatalf("BuildExtractionResponse: %v", err)
+			}
+			if got := resp.Cards[0].RelatedNotes; !slices.Equal(got, tt.want) {
+				t.Errorf("related_notes = %q, want %q", got, tt.want)
+			}
+			if got := strings.Contains(AIExtractionPrompt(req), "- Channel Patterns\n"); got != tt.requested {
+				t.Errorf("prompt lists the note titles = %v, want %v", got, tt.requested)
+			}
+		})
+	}
+
+	many := make([]string, MaxExistingNoteTitles+10)
+	for i := range many {
+		many[i] = fmt.Sprintf("Note %d", i)
+	}
+	req := &AIExtractionRequest{Content: "Capped note", ExistingNoteTitles: many, IncludeRelated: true}
+	if err := req.Prepare(); err != nil {
+		t.Fatalf("Prepare: %v", err)
+	}
+	if prompt := AIExtractionPrompt(req); strings.Count(prompt, "\n- Note ") != MaxExistingNoteTitles {
+		t.Errorf("prompt lists %d note titles, want %d", strings.Count(prompt, "\n- Note "), MaxExistingNoteTitles)
+	}
+}
+
+func TestConfidenceScores(t *testing.T) {
+	tests := []struct {
+		name      string
+		requested bool
+		returned  any
+		want      *float64
+	}{
+		{"in range", true, 0.8, ptr(0.8)},
+		{"above range", true, 1.7, ptr(1.0)},
+		{"below range", true, -0.2, ptr(0.0)},
+		{"missing", true, nil, ptr(DefaultConfidence)},
+		{"not requested", false, 0.8, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, nil)
+			req := &AIExtractionRequest{Content: "Confidence note", IncludeConfidence: tt.requested}
+			c := card("A card")
+			if tt.returned != nil {
+				c["confidence"] = tt.returned
+			}
+			resp, err := buildResponse(t, req, c)
+			if err != nil {
+				t.Fatalf("BuildExtractionResponse: %v", err)
+			}
+			got := resp.Cards[0].Confidence
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Errorf("confidence = %v, want %v", fmtPtr(got), fmtPtr(tt.want))
+			}
+			if strings.Contains(AIExtractionPrompt(req), `"confidence"`) != tt.requested {
+				t.Errorf("prompt asks for confidence = %v, want %v", !tt.requested, tt.requested)
+			}
+		})
+	}
+}
+
+func ptr[T any](v T) *T { return &v }
+
+// fmtPtr formats the value p points to, or "nil"
+func fmtPtr[T any](p *T) string {
+	if p == nil {
+		return "nil"
+	}
+	return fmt.Sprint(*p)
+}
+
+func TestOutlineFormat(t *testing.T) {
+	const instruction = "nested markdown bullet outline"
+	tests := []struct {
+		name, format, content, want string
+	}{
+		{"prose is default", "", "Goroutines are cheap.\n\nChannels connect them.", "Goroutines are cheap.\n\nChannels connect them."},
+		{"well-formed outline", CardFormatOutline, "- Goroutines\n  - cheap to start\n- Channels", "- Goroutines\n  - cheap to start\n- Channels"},
+		{"normalized markers", CardFormatOutline, "* Goroutines\n\t+ cheap to start\n    1. very cheap", "- Goroutines\n  - cheap to start\n    - very cheap"},
+		{"prose becomes items", CardFormatOutline, "Goroutines are cheap.\n\n- Channels", "- Goroutines are cheap.\n- Channels"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, nil)
+			req := &AIExtractionRequest{Content: "Outline note", Format: tt.format}
+			resp, err := buildResponse(t, req, card(tt.content))
+			if err != nil {
+				t.Fatalf("BuildExtractionResponse: %v", err)
+			}
+			if got := resp.Cards[0].Content; got != tt.want {
+				t.Errorf("content = %q, want %q", got, tt.want)
+			}
+			if got := strings.Contains(AIExtractionPrompt(req), instruction); got != (tt.format == CardFormatOutline) {
+				t.Errorf("prompt asks for an outline = %v in %q format", got, tt.format)
+			}
+		})
+	}
+}
+
+func TestNormalizeProjects(t *testing.T) {
+	tests := []struct {
+		name      string
+		existing  []string
+		suggested []any
+		want      []string
+	}{
+		{"first spelling wins", nil, []any{"Project X", "project-x", "PROJECT_X "}, []string{"Project X", "Project X", "Project X"}},
+		{"existing name preferred", []string{" project x"}, []any{"Project X", "project-x"}, []string{"project x", "project x"}},
+		{"distinct projects kept apart", nil, []any{"Reading", "Writing", "reading"}, []string{"Reading", "Writing", "Reading"}},
+		{"blank and missing", nil, []any{"  ", nil, "Go"}, []string{"", "", "Go"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, nil)
+			cards := make([]map[string]any, len(tt.suggested))
+			for i, project := range tt.suggested {
+				cards[i] = card(fmt.Sprintf("Card %d", i), "suggested_project", project)
+			}
+			resp, err := buildResponse(t, &AIExtractionRequest{Content: "Projects note", ExistingProjects: tt.existing}, cards...)
+			if err != nil {
+				t.Fatalf("BuildExtractionResponse: %v", err)
+			}
+			got := make([]string, len(resp.Cards))
+			for i, c := range resp.Cards {
+				if c.SuggestedProject != nil {
+					got[i] = *c.SuggestedProject
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("suggested projects = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsSingleEmoji(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		want bool
+	}{
+		{"pictograph", "\U0001F680", true},
+		{"variation selector", "\u2764\ufe0f", true},
+		{"skin tone", "\U0001F44D\U0001F3FD", true},
+		{"zwj sequence", "\U0001F469\u200d\U0001F4BB", true},
+		{"flag", "\U0001F1EF\U0001F1F5", true},
+		{"keycap", "1\ufe0f\u20e3", true},
+		{"two emoji", "\U0001F680\U0001F680", false},
+		{"emoji and text", "\U0001F680 go", false},
+		{"lone regional indicator", "\U0001F1EF", false},
+		{"lone skin tone", "\U0001F3FD", false},
+		{"trailing zwj", "\U0001F469\u200d", false},
+		{"digit", "1", false},
+		{"letter", "a", false},
+		{"word", "rocket", false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		if got := IsSingleEmoji(tt.s); got != tt.want {
+			t.Errorf("%s: IsSingleEmoji(%q) = %v, want %v", tt.name, tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestCardIcons(t *testing.T) {
+	tests := []struct {
+		name      string
+		requested bool
+		returned  any
+		want      string
+	}{
+		{"emoji", true, " \U0001F680 ", "\U0001F680"},
+		{"several emoji", true, "\U0001F680\U0001F4A1", ""},
+		{"text", true, "rocket", ""},
+		{"missing", true, nil, ""},
+		{"not requested", false, "\U0001F680", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, nil)
+			req := &AIExtractionRequest{Content: "Icon note", IncludeIcon: tt.requested}
+			c := card("A card")
+			if tt.returned != nil {
+				c["icon"] = tt.returned
+			}
+			resp, err := buildResponse(t, req, c)
+			if err != nil {
+				t.Fatalf("BuildExtractionResponse: %v", err)
+			}
+			if got := resp.Cards[0].Icon; got != tt.want {
+				t.Errorf("icon = %q, want %q", got, tt.want)
+			}
+			if got := strings.Contains(AIExtractionPrompt(req), `"icon"`); got != tt.requested {
+				t.Errorf("prompt asks for an icon = %v, want %v", got, tt.requested)
+			}
+		})
+	}
+}
+
+func TestLimitTags(t *testing.T) {
+	tags := []string{"go", "concurrency", "channels", "goroutines", "scheduling", "runtime"}
+	tests := []struct {
+		name    string
+		maxTags int
+		forced  []string
+		want    []string
+	}{
+		{"first tags kept", 3, nil, []string{"go", "concurrency", "channels"}},
+		{"under the cap", 10, nil, tags},
+		{"forced tag counts towards the cap", 3, []string{"runtime"}, []string{"go", "concurrency", "runtime"}},
+		{"forced tag already kept", 3, []string{"go"}, []string{"go", "concurrency", "channels"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cards := []Card{{Content: "A card", SuggestedTags: slices.Clone(tags)}}
+			LimitTags(cards, tt.maxTags, tt.forced)
+			if got := cards[0].SuggestedTags; !slices.Equal(got, tt.want) {
+				t.Errorf("tags = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	useConfig(t, func(c *Config) { c.MaxTagsPerCard = 4 })
+	resp, err := buildResponse(t, &AIExtractionRequest{Content: "Tagged note"}, card("A card", "suggested_tags", tags))
+	if err != nil {
+		t.Fatalf("BuildExtractionResponse: %v", err)
+	}
+	if got := resp.Cards[0].SuggestedTags; !slices.Equal(got, tags[:4]) {
+		t.Errorf("response tags = %q, want the first 4 of %q", got, tags)
+	}
+}
+
+func TestOrderByImportance(t *testing.T) {
+	tests := []struct {
+		name       string
+		requested  bool
+		priorities []any
+		wantOrder  []string
+	}{
+		{"sorted by priority", true, []any{3, 1, 2}, []string{"B", "C", "A"}},
+		{"ties keep model order", true, []any{2, 1, 2}, []string{"B", "A", "C"}},
+		{"unranked last", true, []any{nil, 5, nil}, []string{"B", "A", "C"}},
+		{"not requested keeps model order", false, []any{3, 1, 2}, []string{"A", "B", "C"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, nil)
+			req := &AIExtractionRequest{Content: "Priority note", OrderByImportance: tt.requested}
+			cards := make([]map[string]any, len(tt.priorities))
+			for i, priority := range tt.priorities {
+				cards[i] = card(string(rune('A' + i)))
+				if priority != nil {
+					cards[i]["priority"] = priority
+				}
+			}
+			resp, err := buildResponse(t, req, cards...)
+			if err != nil {
+				t.Fatalf("BuildExtractionResponse: %v", err)
+			}
+			var order []string
+			for i, c := range resp.Cards {
+				order = append(order, c.Content)
+				switch {
+				case !tt.requested && c.Priority != nil:
+					t.Errorf("card %d has a priority without order_by_importance", i)
+				case tt.requested && (c.Priority == nil || *c.Priority != i+1):
+					t.Errorf("card %d priority = %v, want %d", i, fmtPtr(c.Priority), i+1)
+				}
+			}
+			if !slices.Equal(order, tt.wantOrder) {
+				t.Errorf("order = %q, want %q", order, tt.wantOrder)
+			}
+			if got := strings.Contains(AIExtractionPrompt(req), `"priority"`); got != tt.requested {
+				t.Errorf("prompt asks for priorities = %v, want %v", got, tt.requested)
+			}
+		})
+	}
+}
+
+func TestValidationRetry(t *testing.T) {
+	tests := []struct {
+		name      string
+		enabled   bool
+		retry     http.HandlerFunc
+		wantCalls int32
+		wantTags  []string
+	}{
+		{"corrected", true, serveCards("Untagged card, fixed."), 1, []string{"go"}},
+		{"disabled", false, serveCards("Untagged card, fixed."), 0, []string{}},
+		{"mismatched card count", true, serveCards("One.", "Two."), 1, []string{}},
+		{"provider error", true, func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusBadGateway) }, 1, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := useConfig(t, func(c *Config) {
+				c.ValidationRetry = tt.enabled
+				c.CardLengthMode = CardLengthOff
+			})
+			var calls atomic.Int32
+			var prompt atomic.Value
+			prompt.Store("")
+			fakeProvider(t, cfg, func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				var payload struct {
+					Prompt string `json:"prompt"`
+				}
+				json.NewDecoder(r.Body).Decode(&payload)
+				prompt.Store(payload.Prompt)
+				tt.retry(w, r)
+			})
+
+			resp, err := buildResponse(t, &AIExtractionRequest{Content: "Note"},
+				card("A valid card."),
+				card("Untagged card.", "suggested_tags", []string{}),
+			)
+			if err != nil {
+				t.Fatalf("BuildExtractionResponse: %v", err)
+			}
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Fatalf("provider calls = %d, want %d", got, tt.wantCalls)
+			}
+			if resp.Cards[0].Content != "A valid card." {
+				t.Errorf("valid card changed to %q", resp.Cards[0].Content)
+			}
+			if got := resp.Cards[1].SuggestedTags; !slices.Equal(got, tt.wantTags) {
+				t.Errorf("retried card tags = %q, want %q", got, tt.wantTags)
+			}
+			if p := prompt.Load().(string); tt.wantCalls > 0 && (!strings.Contains(p, "Untagged card.") || strings.Contains(p, "A valid card.")) {
+				t.Errorf("retry prompt does not carry just the invalid card: %q", p)
+			}
+		})
+	}
+}
+
+func TestGroupByLanguage(t *testing.T) {
+	cards := []map[string]any{
+		card("Bonjour le monde", "language", "fr-FR"),
+		card("Hello world", "language", "en"),
+		card("Unlabelled card"),
+		card("Good morning", "language", "EN"),
+		card("Made-up language", "language", "not a code"),
+	}
+	tests := []struct {
+		name          string
+		requested     bool
+		byImportance  bool
+		wantOrder     []string
+		wantLanguages []string
+	}{
+		{
+			"grouped", true, false,
+			[]string{"en:Hello world", "en:Good morning", "fr:Bonjour le monde", ":Unlabelled card", ":Made-up language"},
+			[]string{"en", "fr"},
+		},
+		{
+			"importance order kept", true, true,
+			[]string{"fr:Bonjour le monde", "en:Hello world", ":Unlabelled card", "en:Good morning", ":Made-up language"},
+			[]string{"en", "fr"},
+		},
+		{
+			"not requested", false, false,
+			[]string{":Bonjour le monde", ":Hello world", ":Unlabelled card", ":Good morning", ":Made-up language"},
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, nil)
+			req := &AIExtractionRequest{Content: "Mixed-language note", GroupByLanguage: tt.requested, OrderByImportance: tt.byImportance}
+			resp, err := buildResponse(t, req, cards...)
+			if err != nil {
+				t.Fatalf("BuildExtractionResponse: %v", err)
+			}
+			var order []string
+			for _, c := range resp.Cards {
+				order = append(order, c.Language+":"+c.Content)
+			}
+			if !slices.Equal(order, tt.wantOrder) {
+				t.Errorf("cards = %q, want %q", order, tt.wantOrder)
+			}
+			if !slices.Equal(resp.Languages, tt.wantLanguages) {
+				t.Errorf("languages = %q, want %q", resp.Languages, tt.wantLanguages)
+			}
+			prompt := AIExtractionPrompt(req)
+			if strings.Contains(prompt, `"language"`) != tt.requested || strings.Contains(prompt, "ISO 639-1") != tt.requested {
+				t.Errorf("prompt asks for languages = %v, want %v", !tt.requested, tt.requested)
+			}
+		})
+	}
+}
+
+func TestCitations(t *testing.T) {
+	references := []string{"Pike, R. (2012). Go at Google.", "Donovan & Kernighan (2015). The Go Programming Language."}
+	tests := []struct {
+		name      string
+		requested bool
+		citation  any
+		want      string
+	}{
+		{"verbatim", true, "Pike, R. (2012). Go at Google.", references[0]},
+		{"case and spacing differ", true, "donovan  &  kernighan (2015). the go programming language.", references[1]},
+		{"by number", true, "[2]", references[1]},
+		{"bare number", true, "1", references[0]},
+		{"number out of range", true, "[3]", ""},
+		{"hallucinated", true, "Thompson, K. (1984). Reflections on Trusting Trust.", ""},
+		{"null", true, nil, ""},
+		{"not requested", false, "[1]", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, nil)
+			req := &AIExtractionRequest{Content: "Research note", References: references, CiteSources: tt.requested}
+			resp, err := buildResponse(t, req, card("Go was designed for large codebases.", "citation", tt.citation))
+			if err != nil {
+				t.Fatalf("BuildExtractionResponse: %v", err)
+			}
+			if got := resp.Cards[0].Citation; got != tt.want {
+				t.Errorf("citation = %q, want %q", got, tt.want)
+			}
+
+			prompt := AIExtractionPrompt(req)
+			listed := strings.Contains(prompt, "[1] "+references[0]) && strings.Contains(prompt, "[2] "+references[1])
+			if listed != tt.requested || strings.Contains(prompt, `"citation"`) != tt.requested {
+				t.Errorf("prompt lists references = %v, want %v", listed, tt.requested)
+			}
+		})
+	}
+
+	// Without references there is nothing to cite
+	req := &AIExtractionRequest{Content: "Research note", CiteSources: true}
+	if err := req.Prepare(); err != nil {
+		t.Fatalf("Prepare: %v", err)
+	}
+	if strings.Contains(AIExtractionPrompt(req), `"citation"`) {
+		t.Error("prompt asks for citations without references")
+	}
+}
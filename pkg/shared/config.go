@@ -0,0 +1,778 @@
+package shared
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	// Embedded zone database so RATE_LIMIT_TIMEZONE works on minimal runtimes
+	_ "time/tzdata"
+)
+
+// =============================================================================
+// Configuration
+// =============================================================================
+
+// Config holds every environment-driven setting, parsed and validated once.
+// Each field documents the variable it is read from and its default.
+type Config struct {
+	// Storage
+	StoreBackend    string        // STORE_BACKEND, rate-limit counter store: "redis" or "memory" (default "redis")
+	RedisURL        string        // REDIS_URL (required by the HTTP handlers with the redis backend)
+	RedisReplicaURL string        // REDIS_REPLICA_URL, optional read replica for rate-limit checks
+	RedisKeyPrefix  string        // REDIS_KEY_PREFIX, prepended to every key
+	CacheTTL        time.Duration // CACHE_TTL, extraction cache lifetime; 0 disables (default 24h)
+	MetricsTTL      time.Duration // METRICS_TTL, daily metric counter retention (default 720h)
+	RedisOpTimeout  time.Duration // REDIS_OP_TIMEOUT_MS, per-operation deadline (default 500ms)
+	RedisFailOpen   bool          // REDIS_FAIL_OPEN, allow requests when a rate-limit check times out (default false)
+
+	// Provider
+	GeminiBaseURL      string        // GEMINI_BASE_URL, provider origin (default DefaultGeminiBaseURL)
+	GeminiGeneratePath string        // GEMINI_GENERATE_PATH, generation endpoint path (default "/generate")
+	AccessKeys         []string      // ARMY_ACCESS_KEYS (comma-separated) or ARMY_ACCESS_KEY
+	GeminiUserAgent    string        // GEMINI_USER_AGENT
+	SupportedModels    []string      // SUPPORTED_MODELS (comma-separated)
+	RequestTimeout     time.Duration // REQUEST_TIMEOUT_SECONDS (default 50)
+	MaxResponseSize    int64         // MAX_GEMINI_RESPONSE_BYTES, upstream body size cap (default 4 MiB)
+	DegradedFallback   bool          // DEGRADED_FALLBACK, split notes heuristically when the provider is down (default false)
+
+	// Outbound HTTP, shared by the provider, alert and log collector calls.
+	// Proxies come from HTTP_PROXY, HTTPS_PROXY and NO_PROXY.
+	HTTPKeepAlive           time.Duration // HTTP_KEEPALIVE, TCP keep-alive probe interval (default 30s)
+	HTTPDisableKeepAlives   bool          // HTTP_DISABLE_KEEPALIVES, open a new connection per request (default false)
+	HTTPMaxIdleConns        int           // HTTP_MAX_IDLE_CONNS, idle connections kept across all hosts (default 100)
+	HTTPMaxIdleConnsPerHost int           // HTTP_MAX_IDLE_CONNS_PER_HOST (default 10)
+	HTTPIdleConnTimeout     time.Duration // HTTP_IDLE_CONN_TIMEOUT, how long an idle connection is kept (default 90s)
+
+	// Rate limiting
+	ClientRateLimitPerDay     int64            // CLIENT_RATE_LIMIT_PER_DAY (default 5)
+	GlobalRateLimitPerDay     int64            // GLOBAL_RATE_LIMIT_PER_DAY (default 50)
+	RateLimitWarningThreshold int64            // RATE_LIMIT_WARNING_THRESHOLD (default 1)
+	GlobalQuotaLowMargin      int64            // GLOBAL_QUOTA_LOW_MARGIN, remaining global requests that trigger X-Global-Quota-Low; 0 disables (default 5)
+	ExposeRateLimitHeaders    bool             // EXPOSE_RATE_LIMIT_HEADERS, send X-RateLimit-* and X-Global-Quota-Low headers (default true)
+	RateLimitLocation         *time.Location   // RATE_LIMIT_TIMEZONE, IANA name for the daily reset (default UTC)
+	BurstLimit                int64            // RATE_LIMIT_BURST, requests per client per burst window; 0 disables (default 0)
+	BurstWindow               time.Duration    // RATE_LIMIT_BURST_WINDOW_SECONDS (default 60)
+	MinRequestInterval        time.Duration    // MIN_REQUEST_INTERVAL_SECONDS, minimum gap between a client's requests; 0 disables (default 0)
+	MaxConcurrentRequests     int64            // MAX_CONCURRENT_REQUESTS, extractions a client may have in progress at once; 0 disables (default 0)
+	HashClientIP              bool             // HASH_CLIENT_IP, key rate limits by an HMAC of the IP (default false)
+	IPHashSecret              string           // IP_HASH_SECRET, HMAC key (required when HASH_CLIENT_IP is set)
+	ExemptNetworks            []*net.IPNet     // EXEMPT_IPS, comma-separated IPs or CIDRs that bypass rate limits
+	TrustedProxies            []*net.IPNet     // TRUSTED_PROXIES, comma-separated IPs or CIDRs of proxies whose X-Forwarded-For hops are skipped
+	AlertWebhookURL           string           // ALERT_WEBHOOK_URL, notified once per day when the global limit is exhausted
+	LongContentChars          int              // COST_LONG_CONTENT_CHARS, content length at which a request costs LongContentCost; 0 disables (default 20000)
+	LongContentCost           int64            // COST_LONG_CONTENT, rate-limit slots consumed by a long request (default 2)
+	ModelCosts                map[string]int64 // MODEL_COSTS, comma-separated model=cost pairs; unlisted models cost 1
+	InputTokenPrice           float64          // PRICE_PER_MILLION_INPUT_TOKENS, USD per million prompt tokens for cost estimates (default 0)
+	OutputTokenPrice          float64          // PRICE_PER_MILLION_OUTPUT_TOKENS, USD per million output tokens for cost estimates (default 0)
+
+	// Admin
+	AdminToken string // ADMIN_TOKEN, bearer token for /api/admin endpoints; unset disables them
+
+	// Maintenance
+	MaintenanceMode       bool          // MAINTENANCE_MODE, reject extractions with 503; see also /api/admin/maintenance (default false)
+	MaintenanceRetryAfter time.Duration // MAINTENANCE_RETRY_AFTER_SECONDS, Retry-After sent during maintenance (default 300)
+
+	// Feature flags
+	FeatureFlagCacheTTL time.Duration // FEATURE_FLAG_CACHE_TTL, how long flags read from Redis are reused (default 30s)
+
+	// Card post-processing
+	MaxCards         int    // MAX_CARDS (default 7)
+	MaxTagsPerCard   int    // MAX_TAGS_PER_CARD, suggested tags kept per card; forced tags are always kept (default 4)
+	MaxExistingCards int    // MAX_EXISTING_CARDS (default 20)
+	CardLengthMode   string // CARD_LENGTH_ENFORCEMENT (default "flag")
+	CardMinWords     int    // CARD_MIN_WORDS (default 50)
+	CardMaxWords     int    // CARD_MAX_WORDS (default 200)
+	CardIDScheme     string // CARD_ID_SCHEME (default "hash")
+	ValidationRetry  bool   // VALIDATION_RETRY, re-prompt once for cards that fail validation (default false)
+
+	// DefaultExistingTags (DEFAULT_EXISTING_TAGS, comma-separated) are offered
+	// to the model on every request alongside the request's existing_tags
+	DefaultExistingTags []string
+
+	// Content policy
+	ContentDenylist []*regexp.Regexp // CONTENT_DENYLIST (newline-separated) and CONTENT_DENYLIST_FILE (one per line, "#" comments), regexes rejecting a note
+
+	// Batch
+	MaxBatchSize          int // MAX_BATCH_SIZE, notes per batch request (default 10)
+	MaxMergedContentChars int // MAX_MERGED_CONTENT_CHARS, combined length of merged notes (default 60000)
+
+	// Logging
+	LogSampleRate     float64 // LOG_SAMPLE_RATE, fraction of requests access-logged, 0-1 (default 0)
+	LogCollectorURL   string  // LOG_COLLECTOR_URL, HTTP endpoint that also receives batched log lines; unset disables
+	LogCollectorToken string  // LOG_COLLECTOR_TOKEN, optional bearer token for LOG_COLLECTOR_URL
+
+	// Tracing
+	OTLPTracesEndpoint string            // OTEL_EXPORTER_OTLP_TRACES_ENDPOINT, or OTEL_EXPORTER_OTLP_ENDPOINT + "/v1/traces"; unset disables tracing
+	OTLPHeaders        map[string]string // OTEL_EXPORTER_OTLP_HEADERS, comma-separated key=value pairs sent with each export
+	OTelServiceName    string            // OTEL_SERVICE_NAME (default ServiceName)
+
+	// Debug
+	DebugIncludePrompt bool // DEBUG_INCLUDE_PROMPT, return the rendered prompt as _debug.prompt; never enable in production (default false)
+}
+
+var (
+	config     *Config
+	configErr  error
+	configOnce sync.Once
+
+	serverConfigErr  error
+	serverConfigOnce sync.Once
+)
+
+// LoadConfig reads and validates all configuration from the environment.
+// Invalid values fall back to their defaults and every problem found is
+// reported together in the returned error, so the config is always usable.
+func LoadConfig() (*Config, error) {
+	env := &envReader{}
+
+	c := &Config{
+		StoreBackend:    env.oneOf("STORE_BACKEND", StoreBackendRedis, StoreBackendRedis, StoreBackendMemory),
+		RedisURL:        os.Getenv("REDIS_URL"),
+		RedisReplicaURL: os.Getenv("REDIS_REPLICA_URL"),
+		RedisKeyPrefix:  os.Getenv("REDIS_KEY_PREFIX"),
+		CacheTTL:        env.duration("CACHE_TTL", 24*time.Hour),
+		MetricsTTL:      env.duration("METRICS_TTL", DefaultMetricsTTL),
+		RedisOpTimeout:  time.Duration(env.positiveInt("REDIS_OP_TIMEOUT_MS", 500)) * time.Millisecond,
+		RedisFailOpen:   env.bool("REDIS_FAIL_OPEN", false),
+
+		GeminiBaseURL:      env.baseURL("GEMINI_BASE_URL", DefaultGeminiBaseURL),
+		GeminiGeneratePath: env.urlPath("GEMINI_GENERATE_PATH", DefaultGeminiGeneratePath),
+		AccessKeys:         env.list("ARMY_ACCESS_KEYS"),
+		GeminiUserAgent:    os.Getenv("GEMINI_USER_AGENT"),
+		SupportedModels:    env.list("SUPPORTED_MODELS"),
+		RequestTimeout:     time.Duration(env.positiveInt("REQUEST_TIMEOUT_SECONDS", 50)) * time.Second,
+		MaxResponseSize:    env.positiveInt("MAX_GEMINI_RESPONSE_BYTES", 4<<20),
+		DegradedFallback:   env.bool("DEGRADED_FALLBACK", false),
+
+		HTTPKeepAlive:           env.duration("HTTP_KEEPALIVE", 30*time.Second),
+		HTTPDisableKeepAlives:   env.bool("HTTP_DISABLE_KEEPALIVES", false),
+		HTTPMaxIdleConns:        int(env.int("HTTP_MAX_IDLE_CONNS", 100)),
+		HTTPMaxIdleConnsPerHost: int(env.positiveInt("HTTP_MAX_IDLE_CONNS_PER_HOST", 10)),
+		HTTPIdleConnTimeout:     env.duration("HTTP_IDLE_CONN_TIMEOUT", 90*time.Second),
+
+		ClientRateLimitPerDay:     env.positiveInt("CLIENT_RATE_LIMIT_PER_DAY", DefaultClientRateLimitPerDay),
+		GlobalRateLimitPerDay:     env.positiveInt("GLOBAL_RATE_LIMIT_PER_DAY", DefaultGlobalRateLimitPerDay),
+		RateLimitWarningThreshold: env.int("RATE_LIMIT_WARNING_THRESHOLD", 1),
+		GlobalQuotaLowMargin:      env.int("GLOBAL_QUOTA_LOW_MARGIN", 5),
+		ExposeRateLimitHeaders:    env.bool("EXPOSE_RATE_LIMIT_HEADERS", true),
+		RateLimitLocation:         env.location("RATE_LIMIT_TIMEZONE"),
+		BurstLimit:                env.int("RATE_LIMIT_BURST", 0),
+		BurstWindow:               time.Duration(env.positiveInt("RATE_LIMIT_BURST_WINDOW_SECONDS", 60)) * time.Second,
+		MinRequestInterval:        time.Duration(env.int("MIN_REQUEST_INTERVAL_SECONDS", 0)) * time.Second,
+		MaxConcurrentRequests:     env.int("MAX_CONCURRENT_REQUESTS", 0),
+		HashClientIP:              env.bool("HASH_CLIENT_IP", false),
+		IPHashSecret:              os.Getenv("IP_HASH_SECRET"),
+		ExemptNetworks:            env.networks("EXEMPT_IPS"),
+		TrustedProxies:            env.networks("TRUSTED_PROXIES"),
+		AlertWebhookURL:           os.Getenv("ALERT_WEBHOOK_URL"),
+		LongContentChars:          int(env.int("COST_LONG_CONTENT_CHARS", 20000)),
+		LongContentCost:           env.positiveInt("COST_LONG_CONTENT", 2),
+		ModelCosts:                env.costs("MODEL_COSTS"),
+		InputTokenPrice:           env.price("PRICE_PER_MILLION_INPUT_TOKENS"),
+		OutputTokenPrice:          env.price("PRICE_PER_MILLION_OUTPUT_TOKENS"),
+
+		AdminToken: os.Getenv("ADMIN_TOKEN"),
+
+		MaintenanceMode:       env.bool("MAINTENANCE_MODE", false),
+		MaintenanceRetryAfter: time.Duration(env.positiveInt("MAINTENANCE_RETRY_AFTER_SECONDS", 300)) * time.Second,
+
+		FeatureFlagCacheTTL: env.duration("FEATURE_FLAG_CACHE_TTL", 30*time.Second),
+
+		MaxCards:         int(env.positiveInt("MAX_CARDS", 7)),
+		MaxTagsPerCard:   int(env.positiveInt("MAX_TAGS_PER_CARD", 4)),
+		MaxExistingCards: int(env.int("MAX_EXISTING_CARDS", 20)),
+		CardLengthMode:   env.oneOf("CARD_LENGTH_ENFORCEMENT", CardLengthFlag, CardLengthOff, CardLengthFlag, CardLengthTruncate, CardLengthRegenerate),
+		CardMinWords:     int(env.int("CARD_MIN_WORDS", 50)),
+		CardMaxWords:     int(env.positiveInt("CARD_MAX_WORDS", 200)),
+		CardIDScheme:     env.oneOf("CARD_ID_SCHEME", CardIDSchemeHash, CardIDSchemeHash, CardIDSchemeUUID),
+		ValidationRetry:  env.bool("VALIDATION_RETRY", false),
+
+		DefaultExistingTags: env.list("DEFAULT_EXISTING_TAGS"),
+
+		ContentDenylist: env.patterns("CONTENT_DENYLIST", "CONTENT_DENYLIST_FILE"),
+
+		MaxBatchSize:          int(env.positiveInt("MAX_BATCH_SIZE", 10)),
+		MaxMergedContentChars: int(env.positiveInt("MAX_MERGED_CONTENT_CHARS", 60000)),
+
+		LogSampleRate:     env.fraction("LOG_SAMPLE_RATE", 0),
+		LogCollectorURL:   env.absoluteURL("LOG_COLLECTOR_URL"),
+		LogCollectorToken: os.Getenv("LOG_COLLECTOR_TOKEN"),
+
+		OTLPTracesEndpoint: env.absoluteURL("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"),
+		OTLPHeaders:        env.headers("OTEL_EXPORTER_OTLP_HEADERS"),
+		OTelServiceName:    os.Getenv("OTEL_SERVICE_NAME"),
+
+		DebugIncludePrompt: env.bool("DEBUG_INCLUDE_PROMPT", false),
+	}
+
+	if len(c.AccessKeys) == 0 {
+		if key := os.Getenv("ARMY_ACCESS_KEY"); key != "" {
+			c.AccessKeys = []string{key}
+		} else {
+			env.fail("ARMY_ACCESS_KEY (or ARMY_ACCESS_KEYS) is required")
+		}
+	}
+	if c.GeminiUserAgent == "" {
+		c.GeminiUserAgent = fmt.Sprintf("%s/%s (+https://github.com/hassanaziz0012/swipenotes-api)", ServiceName, Version)
+	}
+	if c.OTLPTracesEndpoint == "" {
+		if base := env.absoluteURL("OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+			c.OTLPTracesEndpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+		}
+	}
+	if c.OTelServiceName == "" {
+		c.OTelServiceName = ServiceName
+	}
+	if len(c.SupportedModels) == 0 {
+		c.SupportedModels = []string{"gemini-2.5-flash", "gemini-2.5-flash-lite", "gemini-2.5-pro"}
+	}
+	for model := range c.ModelCosts {
+		if !slices.Contains(c.SupportedModels, model) {
+			env.fail(fmt.Sprintf("MODEL_COSTS lists %q, which is not in SUPPORTED_MODELS", model))
+		}
+	}
+	if c.HashClientIP && c.IPHashSecret == "" {
+		env.fail("IP_HASH_SECRET is required when HASH_CLIENT_IP is set")
+	}
+	if c.MetricsTTL == 0 {
+		env.fail("METRICS_TTL must be positive")
+		c.MetricsTTL = DefaultMetricsTTL
+	}
+	if c.CardMinWords > c.CardMaxWords {
+		env.fail(fmt.Sprintf("CARD_MIN_WORDS (%d) must not exceed CARD_MAX_WORDS (%d)", c.CardMinWords, c.CardMaxWords))
+		c.CardMinWords, c.CardMaxWords = 50, 200
+	}
+
+	return c, env.err()
+}
+
+// GetConfig returns the process-wide configuration, loading it on first use.
+// Problems are logged once and reported by CheckServerConfig.
+func GetConfig() *Config {
+	configOnce.Do(func() {
+		config, configErr = LoadConfig()
+		if configErr != nil {
+			log.Printf("Configuration error: %v", configErr)
+		}
+	})
+	return config
+}
+
+// CheckServerConfig validates the serverless handler configuration once per
+// process, so a misconfigured deployment fails before doing any work. Unlike
+// the CLI, the handlers also require REDIS_URL unless counters are kept in
+// memory.
+func CheckServerConfig() error {
+	serverConfigOnce.Do(func() {
+		cfg := GetConfig()
+		StartLogSink()
+		StartTracing()
+		LogEffectiveConfig(cfg)
+		var problems []string
+		if configErr != nil {
+			problems = append(problems, configErr.Error())
+		}
+		if cfg.StoreBackend == StoreBackendRedis && cfg.RedisURL == "" {
+			problems = append(problems, "REDIS_URL is required")
+		}
+		if len(problems) > 0 {
+			serverConfigErr = fmt.Errorf("%s", strings.Join(problems, "; "))
+		}
+	})
+	return serverConfigErr
+}
+
+// GeminiGenerateURL returns the provider's generation endpoint
+func (c *Config) GeminiGenerateURL() string {
+	return c.GeminiBaseURL + c.GeminiGeneratePath
+}
+
+// CheckCLIConfig validates the configuration needed by the CLI
+func CheckCLIConfig() error {
+	GetConfig()
+	return configErr
+}
+
+// =============================================================================
+// Startup Logging
+// =============================================================================
+
+// EffectiveConfig is the non-secret view of Config logged at startup. Secrets
+// are reduced to whether (or how many) are set, and REDIS_URL has its
+// password masked.
+type EffectiveConfig struct {
+	StoreBackend    string `json:"store_backend"`
+	RedisURL        string `json:"redis_url,omitempty"`
+	RedisReplicaURL string `json:"redis_replica_url,omitempty"`
+	RedisKeyPrefix  string `json:"redis_key_prefix,omitempty"`
+	CacheTTL        string `json:"cache_ttl"`
+	MetricsTTL      string `json:"metrics_ttl"`
+	RedisOpTimeout  string `json:"redis_op_timeout"`
+	RedisFailOpen   bool   `json:"redis_fail_open"`
+
+	Provider         string   `json:"provider"`
+	GeneratePath     string   `json:"generate_path"`
+	AccessKeyCount   int      `json:"access_key_count"`
+	GeminiUserAgent  string   `json:"gemini_user_agent"`
+	SupportedModels  []string `json:"supported_models"`
+	RequestTimeout   string   `json:"request_timeout"`
+	MaxResponseSize  int64    `json:"max_response_bytes"`
+	DegradedFallback bool     `json:"degraded_fallback"`
+
+	OutboundProxy           string `json:"outbound_proxy,omitempty"`
+	HTTPKeepAlive           string `json:"http_keepalive"`
+	HTTPDisableKeepAlives   bool   `json:"http_disable_keepalives"`
+	HTTPMaxIdleConns        int    `json:"http_max_idle_conns"`
+	HTTPMaxIdleConnsPerHost int    `json:"http_max_idle_conns_per_host"`
+	HTTPIdleConnTimeout     string `json:"http_idle_conn_timeout"`
+
+	ClientRateLimitPerDay     int64            `json:"client_rate_limit_per_day"`
+	GlobalRateLimitPerDay     int64            `json:"global_rate_limit_per_day"`
+	RateLimitWarningThreshold int64            `json:"rate_limit_warning_threshold"`
+	GlobalQuotaLowMargin      int64            `json:"global_quota_low_margin"`
+	ExposeRateLimitHeaders    bool             `json:"expose_rate_limit_headers"`
+	RateLimitTimezone         string           `json:"rate_limit_timezone"`
+	BurstLimit                int64            `json:"burst_limit"`
+	BurstWindow               string           `json:"burst_window"`
+	MinRequestInterval        string           `json:"min_request_interval"`
+	MaxConcurrentRequests     int64            `json:"max_concurrent_requests"`
+	HashClientIP              bool             `json:"hash_client_ip"`
+	ExemptNetworks            []string         `json:"exempt_networks,omitempty"`
+	TrustedProxies            []string         `json:"trusted_proxies,omitempty"`
+	AlertWebhookSet           bool             `json:"alert_webhook_set"`
+	AdminTokenSet             bool             `json:"admin_token_set"`
+	LongContentChars          int              `json:"long_content_chars"`
+	LongContentCost           int64            `json:"long_content_cost"`
+	ModelCosts                map[string]int64 `json:"model_costs,omitempty"`
+	InputTokenPrice           float64          `json:"input_token_price"`
+	OutputTokenPrice          float64          `json:"output_token_price"`
+
+	MaintenanceMode       bool   `json:"maintenance_mode"`
+	MaintenanceRetryAfter string `json:"maintenance_retry_after"`
+
+	FeatureFlagCacheTTL string `json:"feature_flag_cache_ttl"`
+
+	MaxCards              int    `json:"max_cards"`
+	MaxTagsPerCard        int    `json:"max_tags_per_card"`
+	MaxExistingCards      int    `json:"max_existing_cards"`
+	CardLengthMode        string `json:"card_length_mode"`
+	CardMinWords          int    `json:"card_min_words"`
+	CardMaxWords          int    `json:"card_max_words"`
+	CardIDScheme          string `json:"card_id_scheme"`
+	ValidationRetry       bool   `json:"validation_retry"`
+	MaxBatchSize          int    `json:"max_batch_size"`
+	MaxMergedContentChars int    `json:"max_merged_content_chars"`
+
+	DefaultExistingTags []string `json:"default_existing_tags,omitempty"`
+
+	ContentDenylistPatterns int `json:"content_denylist_patterns"`
+
+	LogSampleRate   float64 `json:"log_sample_rate"`
+	LogCollectorURL string  `json:"log_collector_url,omitempty"`
+
+	OTLPTracesEndpoint string `json:"otlp_traces_endpoint,omitempty"`
+	OTLPHeaderCount    int    `json:"otlp_header_count"`
+	OTelServiceName    string `json:"otel_service_name"`
+
+	DebugIncludePrompt bool `json:"debug_include_prompt"`
+}
+
+// Effective returns the configuration with secrets redacted
+func (c *Config) Effective() EffectiveConfig {
+	exempt := make([]string, len(c.ExemptNetworks))
+	for i, network := range c.ExemptNetworks {
+		exempt[i] = network.String()
+	}
+	proxies := make([]string, len(c.TrustedProxies))
+	for i, network := range c.TrustedProxies {
+		proxies[i] = network.String()
+	}
+
+	return EffectiveConfig{
+		StoreBackend:    c.StoreBackend,
+		RedisURL:        redactURL(c.RedisURL),
+		RedisReplicaURL: redactURL(c.RedisReplicaURL),
+		RedisKeyPrefix:  c.RedisKeyPrefix,
+		CacheTTL:        c.CacheTTL.String(),
+		MetricsTTL:      c.MetricsTTL.String(),
+		RedisOpTimeout:  c.RedisOpTimeout.String(),
+		RedisFailOpen:   c.RedisFailOpen,
+
+		Provider:         c.GeminiBaseURL,
+		GeneratePath:     c.GeminiGeneratePath,
+		AccessKeyCount:   len(c.AccessKeys),
+		GeminiUserAgent:  c.GeminiUserAgent,
+		SupportedModels:  c.SupportedModels,
+		RequestTimeout:   c.RequestTimeout.String(),
+		MaxResponseSize:  c.MaxResponseSize,
+		DegradedFallback: c.DegradedFallback,
+
+		OutboundProxy:           redactURL(proxyFor(c.GeminiBaseURL)),
+		HTTPKeepAlive:           c.HTTPKeepAlive.String(),
+		HTTPDisableKeepAlives:   c.HTTPDisableKeepAlives,
+		HTTPMaxIdleConns:        c.HTTPMaxIdleConns,
+		HTTPMaxIdleConnsPerHost: c.HTTPMaxIdleConnsPerHost,
+		HTTPIdleConnTimeout:     c.HTTPIdleConnTimeout.String(),
+
+		ClientRateLimitPerDay:     c.ClientRateLimitPerDay,
+		GlobalRateLimitPerDay:     c.GlobalRateLimitPerDay,
+		RateLimitWarningThreshold: c.RateLimitWarningThreshold,
+		GlobalQuotaLowMargin:      c.GlobalQuotaLowMargin,
+		ExposeRateLimitHeaders:    c.ExposeRateLimitHeaders,
+		RateLimitTimezone:         c.RateLimitLocation.String(),
+		BurstLimit:                c.BurstLimit,
+		BurstWindow:               c.BurstWindow.String(),
+		MinRequestInterval:        c.MinRequestInterval.String(),
+		MaxConcurrentRequests:     c.MaxConcurrentRequests,
+		HashClientIP:              c.HashClientIP,
+		ExemptNetworks:            exempt,
+		TrustedProxies:            proxies,
+		AlertWebhookSet:           c.AlertWebhookURL != "",
+		AdminTokenSet:             c.AdminToken != "",
+		LongContentChars:          c.LongContentChars,
+		LongContentCost:           c.LongContentCost,
+		ModelCosts:                c.ModelCosts,
+		InputTokenPrice:           c.InputTokenPrice,
+		OutputTokenPrice:          c.OutputTokenPrice,
+
+		MaintenanceMode:       c.MaintenanceMode,
+		MaintenanceRetryAfter: c.MaintenanceRetryAfter.String(),
+
+		FeatureFlagCacheTTL: c.FeatureFlagCacheTTL.String(),
+
+		MaxCards:              c.MaxCards,
+		MaxTagsPerCard:        c.MaxTagsPerCard,
+		MaxExistingCards:      c.MaxExistingCards,
+		CardLengthMode:        c.CardLengthMode,
+		CardMinWords:          c.CardMinWords,
+		CardMaxWords:          c.CardMaxWords,
+		CardIDScheme:          c.CardIDScheme,
+		ValidationRetry:       c.ValidationRetry,
+		MaxBatchSize:          c.MaxBatchSize,
+		MaxMergedContentChars: c.MaxMergedContentChars,
+
+		DefaultExistingTags: c.DefaultExistingTags,
+
+		ContentDenylistPatterns: len(c.ContentDenylist),
+
+		LogSampleRate:   c.LogSampleRate,
+		LogCollectorURL: redactURL(c.LogCollectorURL),
+
+		OTLPTracesEndpoint: redactURL(c.OTLPTracesEndpoint),
+		OTLPHeaderCount:    len(c.OTLPHeaders),
+		OTelServiceName:    c.OTelServiceName,
+
+		DebugIncludePrompt: c.DebugIncludePrompt,
+	}
+}
+
+// LogEffectiveConfig logs the redacted configuration as a single JSON line.
+// The handlers log it once per instance from CheckServerConfig.
+func LogEffectiveConfig(c *Config) {
+	line, err := json.Marshal(c.Effective())
+	if err != nil {
+		log.Printf("Failed to encode effective configuration: %v", err)
+		return
+	}
+	log.Printf("Effective configuration: %s", line)
+}
+
+// redactURL masks any password in raw. Unparseable values are dropped
+// entirely since they may still contain credentials.
+func redactURL(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "[unparseable]"
+	}
+	return u.Redacted()
+}
+
+// =============================================================================
+// Environment Parsing
+// =============================================================================
+
+// envReader parses environment variables, collecting every validation problem
+// instead of stopping at the first
+type envReader struct {
+	problems []string
+}
+
+func (e *envReader) fail(problem string) {
+	e.problems = append(e.problems, problem)
+}
+
+func (e *envReader) err() error {
+	if len(e.problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid configuration: %s", strings.Join(e.problems, "; "))
+}
+
+// int reads a non-negative integer, falling back to def when unset or invalid
+func (e *envReader) int(key string, def int64) int64 {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def
+	}
+	v, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || v < 0 {
+		e.fail(fmt.Sprintf("%s must be a non-negative integer, got %q", key, raw))
+		return def
+	}
+	return v
+}
+
+// positiveInt reads an integer greater than zero
+func (e *envReader) positiveInt(key string, def int64) int64 {
+	v := e.int(key, def)
+	if v == 0 {
+		e.fail(fmt.Sprintf("%s must be greater than zero", key))
+		return def
+	}
+	return v
+}
+
+// fraction reads a number between 0 and 1 inclusive
+func (e *envReader) fraction(key string, def float64) float64 {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def
+	}
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil || !(v >= 0 && v <= 1) {
+		e.fail(fmt.Sprintf("%s must be a number between 0 and 1, got %q", key, raw))
+		return def
+	}
+	return v
+}
+
+// price reads a non-negative decimal amount, defaulting to zero
+func (e *envReader) price(key string) float64 {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return 0
+	}
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil || !(v >= 0) || math.IsInf(v, 0) {
+		e.fail(fmt.Sprintf("%s must be a non-negative number, got %q", key, raw))
+		return 0
+	}
+	return v
+}
+
+// oneOf reads a value that must be one of allowed, falling back to def
+func (e *envReader) oneOf(key, def string, allowed ...string) string {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def
+	}
+	for _, value := range allowed {
+		if raw == value {
+			return raw
+		}
+	}
+	e.fail(fmt.Sprintf("%s must be one of %s, got %q", key, strings.Join(allowed, ", "), raw))
+	return def
+}
+
+// bool reads a boolean such as "true", "1" or "false"
+func (e *envReader) bool(key string, def bool) bool {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def
+	}
+	v, err := strconv.ParseBool(raw)
+	if err != nil {
+		e.fail(fmt.Sprintf("%s must be a boolean, got %q", key, raw))
+		return def
+	}
+	return v
+}
+
+// duration reads a Go duration string such as "6h" or "90s"
+func (e *envReader) duration(key string, def time.Duration) time.Duration {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d < 0 {
+		e.fail(fmt.Sprintf("%s must be a non-negative duration like \"6h\", got %q", key, raw))
+		return def
+	}
+	return d
+}
+
+// location reads an IANA time zone name, falling back to UTC
+func (e *envReader) location(key string) *time.Location {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(raw)
+	if err != nil {
+		e.fail(fmt.Sprintf("%s must be an IANA time zone, got %q", key, raw))
+		return time.UTC
+	}
+	return loc
+}
+
+// networks reads a comma-separated list of IPs and CIDRs. Plain IPs become
+// single-address networks.
+func (e *envReader) networks(key string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, item := range e.list(key) {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				e.fail(fmt.Sprintf("%s entry %q is not a valid IP or CIDR", key, item))
+				continue
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			e.fail(fmt.Sprintf("%s entry %q is not a valid IP or CIDR", key, item))
+			continue
+		}
+		nets = append(nets, network)
+	}
+	return nets
+}
+
+// patterns compiles the newline-separated regexes in key followed by those in
+// the file named by fileKey. Blank lines and lines starting with "#" are
+// skipped, so the file can be remounted without a code change.
+func (e *envReader) patterns(key, fileKey string) []*regexp.Regexp {
+	var lines []string
+	lines = append(lines, strings.Split(os.Getenv(key), "\n")...)
+	if path := os.Getenv(fileKey); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			e.fail(fmt.Sprintf("%s could not be read: %v", fileKey, err))
+		}
+		lines = append(lines, strings.Split(string(data), "\n")...)
+	}
+
+	var patterns []*regexp.Regexp
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pattern, err := regexp.Compile(line)
+		if err != nil {
+			e.fail(fmt.Sprintf("%s pattern %q is invalid: %v", key, line, err))
+			continue
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns
+}
+
+// baseURL reads an absolute http(s) URL with no query or fragment, so paths
+// can be appended to it. A trailing slash is dropped.
+func (e *envReader) baseURL(key, def string) string {
+	raw := strings.TrimSuffix(os.Getenv(key), "/")
+	if raw == "" {
+		return def
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		e.fail(fmt.Sprintf("%s must be an absolute http(s) URL without query or fragment, got %q", key, raw))
+		return def
+	}
+	return raw
+}
+
+// absoluteURL reads an optional absolute http(s) URL
+func (e *envReader) absoluteURL(key string) string {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return ""
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		e.fail(fmt.Sprintf("%s must be an absolute http(s) URL, got %q", key, redactURL(raw)))
+		return ""
+	}
+	return raw
+}
+
+// urlPath reads a URL path that must start with "/"
+func (e *envReader) urlPath(key, def string) string {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def
+	}
+	u, err := url.Parse(raw)
+	if err != nil || !strings.HasPrefix(raw, "/") || strings.HasPrefix(raw, "//") || u.Path != raw {
+		e.fail(fmt.Sprintf("%s must be a URL path starting with \"/\", got %q", key, raw))
+		return def
+	}
+	return raw
+}
+
+// headers reads comma-separated key=value pairs in the OTEL_EXPORTER_OTLP_HEADERS
+// format, with percent-encoded values
+func (e *envReader) headers(key string) map[string]string {
+	headers := make(map[string]string)
+	for _, item := range e.list(key) {
+		name, raw, _ := strings.Cut(item, "=")
+		name = strings.TrimSpace(name)
+		value, err := url.PathUnescape(strings.TrimSpace(raw))
+		if name == "" || err != nil {
+			// Values are usually credentials, so the entry isn't echoed
+			e.fail(fmt.Sprintf("%s entries must look like key=value", key))
+			continue
+		}
+		headers[name] = value
+	}
+	return headers
+}
+
+// costs reads comma-separated model=cost pairs with positive integer costs
+func (e *envReader) costs(key string) map[string]int64 {
+	costs := make(map[string]int64)
+	for _, item := range e.list(key) {
+		model, raw, _ := strings.Cut(item, "=")
+		model = strings.TrimSpace(model)
+		cost, err := strconv.ParseInt(strings.TrimSpace(raw), 10, 64)
+		if model == "" || err != nil || cost < 1 {
+			e.fail(fmt.Sprintf("%s entry %q must look like model=cost with a positive cost", key, item))
+			continue
+		}
+		costs[model] = cost
+	}
+	return costs
+}
+
+// list reads a comma-separated list, dropping empty entries
+func (e *envReader) list(key string) []string {
+	var items []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
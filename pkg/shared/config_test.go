@@ -0,0 +1,76 @@
+package shared
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestGeminiURLConfig(t *testing.T) {
+	tests := []struct {
+		name, baseURL, path string
+		want                string
+		wantErr             bool
+	}{
+		{"defaults", "", "", DefaultGeminiBaseURL + DefaultGeminiGeneratePath, false},
+		{"base url override", "http://localhost:8080", "", "http://localhost:8080" + DefaultGeminiGeneratePath, false},
+		{"trailing slash trimmed", "https://staging.example.com/army/", "", "https://staging.example.com/army" + DefaultGeminiGeneratePath, false},
+		{"path override", "", "/v2/generate", DefaultGeminiBaseURL + "/v2/generate", false},
+		{"relative base url", "localhost:8080", "", "", true},
+		{"unsupported scheme", "ftp://example.com", "", "", true},
+		{"base url with query", "https://example.com?key=1", "", "", true},
+		{"relative path", "", "generate", "", true},
+		{"path with query", "", "/generate?x=1", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("GEMINI_BASE_URL", tt.baseURL)
+			t.Setenv("GEMINI_GENERATE_PATH", tt.path)
+			c, err := LoadConfig()
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("LoadConfig accepted %q%q", tt.baseURL, tt.path)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfig: %v", err)
+			}
+			if got := c.GeminiGenerateURL(); got != tt.want {
+				t.Errorf("GeminiGenerateURL = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestModelCostsConfig(t *testing.T) {
+	tests := []struct {
+		name, costs string
+		want        map[string]int64
+		wantErr     bool
+	}{
+		{"unset", "", map[string]int64{}, false},
+		{"one model", "gemini-2.5-pro=3", map[string]int64{"gemini-2.5-pro": 3}, false},
+		{"several models", " gemini-2.5-pro = 3 , gemini-2.5-flash-lite=1", map[string]int64{"gemini-2.5-pro": 3, "gemini-2.5-flash-lite": 1}, false},
+		{"missing cost", "gemini-2.5-pro", nil, true},
+		{"zero cost", "gemini-2.5-pro=0", nil, true},
+		{"unsupported model", "gpt-4=2", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("MODEL_COSTS", tt.costs)
+			c, err := LoadConfig()
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("LoadConfig accepted MODEL_COSTS=%q", tt.costs)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfig: %v", err)
+			}
+			if !maps.Equal(c.ModelCosts, tt.want) {
+				t.Errorf("ModelCosts = %v, want %v", c.ModelCosts, tt.want)
+			}
+		})
+	}
+}
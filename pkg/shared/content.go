@@ -0,0 +1,256 @@
+package shared
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// =============================================================================
+// Content Formats
+// =============================================================================
+
+// MergeNotes concatenates several notes into one content string, delimiting
+// each with a numbered separator. The combined length is capped at maxChars
+// runes to protect the token budget.
+func MergeNotes(notes []string, maxChars int) (string, error) {
+	if len(notes) < 2 {
+		return "", errors.New("At least two notes are required")
+	}
+
+	var sb strings.Builder
+	for i, note := range notes {
+		note = strings.TrimSpace(note)
+		if note == "" {
+			return "", fmt.Errorf("Note %d is empty", i+1)
+		}
+		if i > 0 {
+			sb.WriteString("\n\n")
+		}
+		fmt.Fprintf(&sb, "--- Note %d ---\n%s", i+1, note)
+	}
+
+	merged := sb.String()
+	if length := utf8.RuneCountInString(merged); length > maxChars {
+		return "", fmt.Errorf("Combined notes are too long (%d characters). Maximum is %d", length, maxChars)
+	}
+	return merged, nil
+}
+
+// StructuredNote is the expected shape of Content when ContentFormat is
+// "json". Sections nest arbitrarily; each level's heading becomes context for
+// the sections beneath it.
+//
+//	{
+//	  "title": "Optional note title",
+//	  "body": "Optional text before the first section",
+//	  "sections": [
+//	    {
+//	      "heading": "Section heading",
+//	      "body": "Section text",
+//	      "sections": [ ... ]
+//	    }
+//	  ]
+//	}
+type StructuredNote struct {
+	Title    string        `json:"title"`
+	Body     string        `json:"body"`
+	Sections []NoteSection `json:"sections"`
+}
+
+// NoteSection is a headed section of a StructuredNote
+type NoteSection struct {
+	Heading  string        `json:"heading"`
+	Body     string        `json:"body"`
+	Sections []NoteSection `json:"sections"`
+}
+
+// FlattenStructuredNote parses a StructuredNote and renders it as markdown,
+// mapping nesting depth to heading levels so the hierarchy survives prompting
+func FlattenStructuredNote(raw string) (string, error) {
+	decoder := json.NewDecoder(strings.NewReader(raw))
+	decoder.DisallowUnknownFields()
+
+	var note StructuredNote
+	if err := decoder.Decode(&note); err != nil {
+		return "", fmt.Errorf("Invalid JSON content: %v", err)
+	}
+
+	var sb strings.Builder
+	if note.Title != "" {
+		fmt.Fprintf(&sb, "# %s\n\n", strings.TrimSpace(note.Title))
+	}
+	if note.Body != "" {
+		fmt.Fprintf(&sb, "%s\n\n", strings.TrimSpace(note.Body))
+	}
+	writeSections(&sb, note.Sections, 2)
+
+	flattened := strings.TrimSpace(sb.String())
+	if flattened == "" {
+		return "", errors.New("JSON content contains no text")
+	}
+	return flattened, nil
+}
+
+func writeSections(sb *strings.Builder, sections []NoteSection, level int) {
+	// Markdown stops at h6; deeper sections keep the deepest heading level
+	if level > 6 {
+		level = 6
+	}
+	for _, section := range sections {
+		if section.Heading != "" {
+			fmt.Fprintf(sb, "%s %s\n\n", strings.Repeat("#", level), strings.TrimSpace(section.Heading))
+		}
+		if section.Body != "" {
+			fmt.Fprintf(sb, "%s\n\n", strings.TrimSpace(section.Body))
+		}
+		writeSections(sb, section.Sections, level+1)
+	}
+}
+
+// =============================================================================
+// HTML Conversion
+// =============================================================================
+
+var (
+	htmlCommentPattern = regexp.MustCompile(`(?s)<!--.*?-->|<![^-][^>]*>`)
+	htmlTagPattern     = regexp.MustCompile(`<(/?)([a-zA-Z][a-zA-Z0-9]*)(?:"[^"]*"|'[^']*'|[^'">])*>`)
+	htmlOpenTagPattern = regexp.MustCompile(`<[/!a-zA-Z]`)
+	blankLinesPattern  = regexp.MustCompile(`\n{3,}`)
+)
+
+// htmlDroppedElements are removed along with everything inside them
+var htmlDroppedElements = []*regexp.Regexp{
+	regexp.MustCompile(`(?is)<head\b.*?</head\s*>`),
+	regexp.MustCompile(`(?is)<script\b.*?</script\s*>`),
+	regexp.MustCompile(`(?is)<style\b.*?</style\s*>`),
+	regexp.MustCompile(`(?is)<template\b.*?</template\s*>`),
+	regexp.MustCompile(`(?is)<noscript\b.*?</noscript\s*>`),
+}
+
+// htmlBlockElements break the text into paragraphs
+var htmlBlockElements = map[string]bool{
+	"p": true, "div": true, "section": true, "article": true, "header": true,
+	"footer": true, "main": true, "aside": true, "blockquote": true, "pre": true,
+	"table": true, "ul": true, "ol": true, "dl": true, "hr": true, "body": true,
+}
+
+// HTMLToText converts an HTML document, such as a forwarded newsletter, to
+// plain markdown-ish text. Scripts, styles and the document head are dropped,
+// links keep their text, headings and list items keep markdown markers, table
+// cells are joined with " | ", entities are decoded and whitespace collapsed.
+func HTMLToText(raw string) (string, error) {
+	s := htmlCommentPattern.ReplaceAllString(raw, "")
+	for _, pattern := range htmlDroppedElements {
+		s = pattern.ReplaceAllString(s, "")
+	}
+
+	s = htmlTagPattern.ReplaceAllStringFunc(s, func(tag string) string {
+		match := htmlTagPattern.FindStringSubmatch(tag)
+		closing, name := match[1] == "/", strings.ToLower(match[2])
+		switch {
+		case name == "br":
+			return "\n"
+		case name == "tr":
+			if closing {
+				return ""
+			}
+			return "\n"
+		case len(name) == 2 && name[0] == 'h' && name[1] >= '1' && name[1] <= '6':
+			if closing {
+				return "\n\n"
+			}
+			return "\n\n" + strings.Repeat("#", int(name[1]-'0')) + " "
+		case name == "li" || name == "dt":
+			if closing {
+				return ""
+			}
+			return "\n- "
+		case name == "td" || name == "th":
+			if closing {
+				return ""
+			}
+			return " | "
+		case htmlBlockElements[name]:
+			return "\n\n"
+		}
+		return ""
+	})
+
+	// Anything tag-like left over never closed, e.g. "<p class=" at the end
+	if loc := htmlOpenTagPattern.FindStringIndex(s); loc != nil {
+		return "", fmt.Errorf("Invalid HTML content: unterminated tag near %q", truncateRunes(s[loc[0]:], 20))
+	}
+
+	s = strings.ReplaceAll(html.UnescapeString(s), "\u00a0", " ")
+
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		line = strings.Join(strings.Fields(line), " ")
+		// Rows open with a cell separator; drop the leading one
+		lines[i] = strings.TrimPrefix(line, "| ")
+	}
+	text := strings.TrimSpace(blankLinesPattern.ReplaceAllString(strings.Join(lines, "\n"), "\n\n"))
+	if text == "" {
+		return "", errors.New("HTML content contains no text")
+	}
+	return text, nil
+}
+
+// =============================================================================
+// Media Stripping
+// =============================================================================
+
+var (
+	markdownImagePattern = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	markdownLinkPattern  = regexp.MustCompile(`\[([^\]]+)\]\([^)]*\)`)
+	dataURIPattern       = regexp.MustCompile(`data:[\w/+.-]+;base64,[A-Za-z0-9+/=]+`)
+)
+
+// StripMedia removes markdown image embeds (keeping any alt text as
+// "[image: alt]"), collapses links to their text and drops inline base64 data
+// URIs, none of which help extraction. It returns the stripped content and
+// the number of bytes removed.
+func StripMedia(content string) (string, int) {
+	stripped := markdownImagePattern.ReplaceAllStringFunc(content, func(match string) string {
+		alt := strings.TrimSpace(markdownImagePattern.FindStringSubmatch(match)[1])
+		if alt == "" {
+			return ""
+		}
+		return "[image: " + alt + "]"
+	})
+	stripped = markdownLinkPattern.ReplaceAllString(stripped, "$1")
+	stripped = dataURIPattern.ReplaceAllString(stripped, "")
+	return stripped, len(content) - len(stripped)
+}
+
+// =============================================================================
+// Unicode Normalization
+// =============================================================================
+
+// NormalizeText converts s to Unicode NFC and removes zero-width characters
+// and control characters other than newlines and tabs, so visually identical
+// notes produce identical prompts
+func NormalizeText(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '\n', '\t':
+			return r
+		case '\r':
+			return -1
+		case '\u200b', '\u200c', '\u200d', '\u2060', '\ufeff': // Zero-width characters and BOM
+			return -1
+		}
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, norm.NFC.String(s))
+}
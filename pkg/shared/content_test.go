@@ -0,0 +1,225 @@
+package shared
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMergeNotes(t *testing.T) {
+	tests := []struct {
+		name     string
+		notes    []string
+		maxChars int
+		want     string
+		wantErr  string
+	}{
+		{
+			name:     "concatenates with markers",
+			notes:    []string{"  First note  ", "Second note"},
+			maxChars: 1000,
+			want:     "--- Note 1 ---\nFirst note\n\n--- Note 2 ---\nSecond note",
+		},
+		{name: "single note", notes: []string{"Only one"}, maxChars: 1000, wantErr: "At least two notes"},
+		{name: "blank note", notes: []string{"First", "   "}, maxChars: 1000, wantErr: "Note 2 is empty"},
+		{name: "over the cap", notes: []string{strings.Repeat("a", 20), strings.Repeat("b", 20)}, maxChars: 50, wantErr: "Combined notes are too long"},
+		{name: "at the cap", notes: []string{"ab", "cd"}, maxChars: len("--- Note 1 ---\nab\n\n--- Note 2 ---\ncd"), want: "--- Note 1 ---\nab\n\n--- Note 2 ---\ncd"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := MergeNotes(tt.notes, tt.maxChars)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("MergeNotes: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("merged = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeRequestPrompt(t *testing.T) {
+	useConfig(t, nil)
+	merge := MergeExtractionRequest{Notes: []string{"Goroutines", "Channels"}}
+	req, err := merge.ToExtractionRequest()
+	if err != nil {
+		t.Fatalf("ToExtractionRequest: %v", err)
+	}
+	if err := req.Prepare(); err != nil {
+		t.Fatalf("Prepare: %v", err)
+	}
+	if prompt := AIExtractionPrompt(&req); !strings.Contains(prompt, "Produce one unified card set") {
+		t.Error("merged prompt is missing the synthesis instruction")
+	}
+
+	withContent := MergeExtractionRequest{Notes: []string{"a", "b"}, AIExtractionRequest: AIExtractionRequest{Content: "c"}}
+	if _, err := withContent.ToExtractionRequest(); err == nil {
+		t.Error("ToExtractionRequest accepted content alongside notes")
+	}
+}
+
+func TestStripMedia(t *testing.T) {
+	longURL := "https://example.com/article?utm_source=newsletter&utm_medium=email&utm_campaign=" + strings.Repeat("x", 200)
+	tests := []struct {
+		name, content, want string
+	}{
+		{"image with alt text", "Before ![Architecture diagram](https://example.com/a.png) after", "Before [image: Architecture diagram] after"},
+		{"image without alt text", "Before ![](https://example.com/a.png) after", "Before  after"},
+		{"base64 image", "![chart](data:image/png;base64,iVBORw0KGgoAAAANSUhEUgAA==)", "[image: chart]"},
+		{"long link", "Read [the article](" + longURL + ") first", "Read the article first"},
+		{"bare data uri", "Inline data:image/gif;base64,R0lGODlhAQABAAAAACw= here", "Inline  here"},
+		{"plain text", "Nothing to strip [here] (or here)", "Nothing to strip [here] (or here)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, removed := StripMedia(tt.content)
+			if got != tt.want {
+				t.Errorf("StripMedia = %q, want %q", got, tt.want)
+			}
+			if removed != len(tt.content)-len(tt.want) {
+				t.Errorf("removed %d bytes, want %d", removed, len(tt.content)-len(tt.want))
+			}
+		})
+	}
+}
+
+func TestStripMediaRequest(t *testing.T) {
+	useConfig(t, nil)
+	const content = "Caching ![diagram](data:image/png;base64,AAAA) helps. See [docs](https://example.com/docs)."
+	tests := []struct {
+		strip        bool
+		want         string
+		wantStripped int
+	}{
+		{true, "Caching [image: diagram] helps. See docs.", len(content) - len("Caching [image: diagram] helps. See docs.")},
+		{false, content, 0},
+	}
+	for _, tt := range tests {
+		req := &AIExtractionRequest{Content: content, StripMedia: tt.strip}
+		if err := req.Prepare(); err != nil {
+			t.Fatalf("Prepare: %v", err)
+		}
+		if req.Content != tt.want || req.MediaBytesStripped() != tt.wantStripped {
+			t.Errorf("strip_media %v: content %q, %d bytes stripped; want %q, %d", tt.strip, req.Content, req.MediaBytesStripped(), tt.want, tt.wantStripped)
+		}
+	}
+
+	onlyMedia := &AIExtractionRequest{Content: "![](https://example.com/a.png)", StripMedia: true}
+	if err := onlyMedia.Prepare(); err == nil {
+		t.Error("Prepare accepted a note that was only media")
+	}
+}
+
+func TestNormalizeText(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"combining characters", "cafe\u0301 re\u0301sume\u0301", "café résumé"},
+		{"already composed", "café", "café"},
+		{"zero-width characters", "\ufeffzero\u200bwidth\u200c join\u200d\u2060er", "zerowidth joiner"},
+		{"control characters", "bell\a and\x00 null\r\n", "bell and null\n"},
+		{"keeps newlines and tabs", "a\tb\nc", "a\tb\nc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NormalizeText(tt.in); got != tt.want {
+				t.Errorf("NormalizeText(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrepareNormalizesContent(t *testing.T) {
+	useConfig(t, nil)
+	const want = "Café notes"
+	composed := &AIExtractionRequest{Content: want}
+	decomposed := &AIExtractionRequest{Content: "\ufeffCafe\u0301\u200b notes"}
+	for _, req := range []*AIExtractionRequest{composed, decomposed} {
+		if err := req.Prepare(); err != nil {
+			t.Fatalf("Prepare: %v", err)
+		}
+		if req.Content != want {
+			t.Errorf("normalized content = %q, want %q", req.Content, want)
+		}
+	}
+	if AIExtractionPrompt(composed) != AIExtractionPrompt(decomposed) {
+		t.Error("visually identical notes produced different prompts")
+	}
+
+	invalid := &AIExtractionRequest{Content: "bad \xc3\x28 bytes"}
+	if err := invalid.Prepare(); err == nil || err.Error() != "Content must be valid UTF-8" {
+		t.Errorf("Prepare(invalid UTF-8) = %v, want the UTF-8 error", err)
+	}
+}
+
+func TestHTMLToText(t *testing.T) {
+	tests := []struct {
+		name, html, want string
+	}{
+		{
+			"newsletter",
+			`<!DOCTYPE html><html><head><title>Weekly</title><style>p { color: red }</style></head>
+<body><h1>Go Weekly</h1><p>Read the <a href="https://go.dev/blog">release notes</a>&nbsp;today.</p>
+<script>track()</script><!-- footer --></body></html>`,
+			"# Go Weekly\n\nRead the release notes today.",
+		},
+		{
+			"table",
+			`<table><tr><th>Version</th><th>Released</th></tr><tr><td>1.24</td><td>February</td></tr></table>`,
+			"Version | Released\n1.24 | February",
+		},
+		{
+			"lists and line breaks",
+			`<p>Agenda:<br>Monday</p><ul><li>Generics</li><li>Iterators</li></ul>`,
+			"Agenda:\nMonday\n\n- Generics\n- Iterators",
+		},
+		{
+			"entities and whitespace",
+			"<div>Fish &amp; chips   &lt;3\n\n\n\n&quot;tasty&quot;</div>",
+			"Fish & chips <3\n\n\"tasty\"",
+		},
+		{
+			"attributes with angle brackets",
+			`<p title="a > b">Comparison</p>`,
+			"Comparison",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := HTMLToText(tt.html)
+			if err != nil {
+				t.Fatalf("HTMLToText: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("HTMLToText = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	for _, bad := range []string{`<p>Cut off <a href="https://go.dev`, `<div><script>only()</script></div>`} {
+		if _, err := HTMLToText(bad); err == nil {
+			t.Errorf("HTMLToText(%q) succeeded, want an error", bad)
+		}
+	}
+}
+
+func TestPrepareConvertsHTMLContent(t *testing.T) {
+	useConfig(t, nil)
+	req := &AIExtractionRequest{Content: `<p>Channels <b>synchronize</b> goroutines.</p>`, ContentFormat: ContentFormatHTML}
+	if err := req.Prepare(); err != nil {
+		t.Fatalf("Prepare: %v", err)
+	}
+	if req.Content != "Channels synchronize goroutines." || req.ContentFormat != ContentFormatMarkdown {
+		t.Errorf("prepared %q as %q, want the converted text as markdown", req.Content, req.ContentFormat)
+	}
+
+	bad := &AIExtractionRequest{Content: `<p>Unterminated <a href="x`, ContentFormat: ContentFormatHTML}
+	if err := bad.Prepare(); err == nil {
+		t.Error("Prepare accepted malformed HTML")
+	}
+}
@@ -0,0 +1,145 @@
+package shared
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// =============================================================================
+// Degraded Extraction
+// =============================================================================
+
+// DegradedModel is reported as the model of heuristic extractions
+const DegradedModel = "heuristic"
+
+// degradedWarning explains a degraded result to clients
+const degradedWarning = "The AI service is unavailable, so these cards were split from your note's paragraphs and headings without AI. You have not been charged."
+
+// headingPattern matches an ATX markdown heading, capturing its text
+var headingPattern = regexp.MustCompile(`^#{1,6}\s+(.*?)\s*#*\s*$`)
+
+// isProviderOutage reports whether err means the provider could not be
+// reached or is failing, as opposed to returning unusable output
+func isProviderOutage(err error) bool {
+	if errors.Is(err, ErrProviderUnavailable) || errors.Is(err, ErrProviderRequest) {
+		return true
+	}
+	var upstreamErr *UpstreamError
+	return errors.As(err, &upstreamErr) &&
+		(upstreamErr.StatusCode >= http.StatusInternalServerError || upstreamErr.StatusCode == http.StatusTooManyRequests)
+}
+
+// DegradedExtraction builds cards from a prepared req without calling the
+// provider, one per section of SplitSections. Forced tags, length handling
+// (without regeneration) and IDs are applied as for AI extractions.
+func DegradedExtraction(req *AIExtractionRequest) (*AIExtractionResponse, error) {
+	cfg := GetConfig()
+
+	sections := SplitSections(req.Content, cfg.CardMinWords)
+	if len(sections) == 0 {
+		return nil, ErrEmptyExtraction
+	}
+	resp := AIExtractionResponse{
+		Model:       DegradedModel,
+		Warning:     degradedWarning,
+		PIIRedacted: req.piiRedacted,
+		Degraded:    true,
+	}
+	if len(sections) > cfg.MaxCards {
+		sections = sections[:cfg.MaxCards]
+		resp.CardsTruncated = true
+	}
+
+	cards := make([]Card, len(sections))
+	for i, section := range sections {
+		cards[i] = Card{Content: section, SuggestedTags: []string{}}
+	}
+
+	mode := cfg.CardLengthMode
+	if mode == CardLengthRegenerate {
+		mode = CardLengthFlag
+	}
+	applyCardLength(cards, mode, cfg.CardMinWords, cfg.CardMaxWords)
+	ApplyForcedTags(cards, req.ForceTags)
+	AssignCardIDs(cards)
+	if len(req.PreviousCards) > 0 {
+		resp.Diff = DiffCards(req.PreviousCards, cards)
+	}
+	resp.SetCards(cards)
+
+	if err := ValidateExtractionResponse(&resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// SplitSections splits markdown content into card-sized sections. Headings
+// start a new section and prefix its text; within a section, paragraphs are
+// joined until they reach minWords, with a short trailing paragraph folded
+// into the one before it.
+func SplitSections(content string, minWords int) []string {
+	var sections []string
+	var heading string
+	var paragraphs []string
+	var paragraph []string
+
+	endParagraph := func() {
+		if len(paragraph) > 0 {
+			paragraphs = append(paragraphs, strings.Join(paragraph, "\n"))
+			paragraph = nil
+		}
+	}
+	endSection := func() {
+		endParagraph()
+		for _, chunk := range groupParagraphs(paragraphs, minWords) {
+			if heading != "" {
+				chunk = heading + "\n\n" + chunk
+			}
+			sections = append(sections, chunk)
+		}
+		paragraphs = nil
+	}
+
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if m := headingPattern.FindStringSubmatch(line); m != nil {
+			endSection()
+			heading = m[1]
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			endParagraph()
+			continue
+		}
+		paragraph = append(paragraph, line)
+	}
+	endSection()
+	return sections
+}
+
+// groupParagraphs joins consecutive paragraphs until each group has at least
+// minWords words
+func groupParagraphs(paragraphs []string, minWords int) []string {
+	var groups []string
+	var current []string
+	words := 0
+	for _, p := range paragraphs {
+		current = append(current, p)
+		words += countWords(p)
+		if words >= minWords {
+			groups = append(groups, strings.Join(current, "\n\n"))
+			current, words = nil, 0
+		}
+	}
+	if len(current) > 0 {
+		tail := strings.Join(current, "\n\n")
+		if len(groups) > 0 {
+			groups[len(groups)-1] += "\n\n" + tail
+		} else {
+			groups = append(groups, tail)
+		}
+	}
+	return groups
+}
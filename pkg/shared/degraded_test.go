@@ -0,0 +1,62 @@
+package shared
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSplitSections(t *testing.T) {
+	words := func(word string, n int) string { return strings.TrimSpace(strings.Repeat(word+" ", n)) }
+	tests := []struct {
+		name     string
+		content  string
+		minWords int
+		want     []string
+	}{
+		{"single paragraph", "Just one short paragraph.", 5, []string{"Just one short paragraph."}},
+		{"paragraphs grouped to minWords", words("a", 3) + "\n\n" + words("b", 3) + "\n\n" + words("c", 6), 5,
+			[]string{words("a", 3) + "\n\n" + words("b", 3), words("c", 6)}},
+		{"short tail folded back", words("a", 6) + "\n\n" + words("b", 2), 5,
+			[]string{words("a", 6) + "\n\n" + words("b", 2)}},
+		{"headings start sections", "# Goroutines\nCheap threads.\n\n## Channels ##\nTyped pipes.", 50,
+			[]string{"Goroutines\n\nCheap threads.", "Channels\n\nTyped pipes."}},
+		{"heading without body", "# Empty\n\n# Full\nBody text.", 1, []string{"Full\n\nBody text."}},
+		{"blank", "\n\n  \n", 5, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SplitSections(tt.content, tt.minWords); !slices.Equal(got, tt.want) {
+				t.Errorf("SplitSections = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDegradedFallback(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		cfg := useConfig(t, func(c *Config) { c.DegradedFallback = enabled })
+		fakeProvider(t, cfg, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		})
+
+		resp, err := ExtractCards(context.Background(), AIExtractionRequest{Content: "# Outage\nThe provider is down.", ForceTags: []string{"inbox"}})
+		if !enabled {
+			if err == nil {
+				t.Error("extraction succeeded during an outage without DEGRADED_FALLBACK")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("ExtractCards: %v", err)
+		}
+		if !resp.Degraded || resp.Model != DegradedModel || resp.ConsumesQuota() {
+			t.Errorf("degraded %v, model %q, charged %v; want an uncharged heuristic result", resp.Degraded, resp.Model, resp.ConsumesQuota())
+		}
+		if len(resp.Cards) != 1 || resp.Cards[0].Content != "Outage\n\nThe provider is down." || !slices.Equal(resp.Cards[0].SuggestedTags, []string{"inbox"}) {
+			t.Errorf("cards = %+v", resp.Cards)
+		}
+	}
+}
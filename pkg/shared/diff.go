@@ -0,0 +1,145 @@
+package shared
+
+import (
+	"math"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// =============================================================================
+// Re-extraction Diff
+// =============================================================================
+
+// MaxPreviousCards caps the previous_cards a request may compare against
+const MaxPreviousCards = 50
+
+// diffMatchThreshold is the smallest word similarity at which a new card is
+// considered a revision of a previous one rather than an unrelated card
+const diffMatchThreshold = 0.5
+
+// PreviousCard is a card from an earlier extraction of the same note. ID is
+// optional and echoed back in the diff.
+type PreviousCard struct {
+	ID      string `json:"id,omitempty"`
+	Content string `json:"content"`
+}
+
+// PreviousCardRef identifies a previous card by its position in
+// previous_cards and, when one was sent, its ID
+type PreviousCardRef struct {
+	PreviousIndex int    `json:"previous_index"`
+	PreviousID    string `json:"previous_id,omitempty"`
+}
+
+// CardMatch pairs a new card with the previous card it revises
+type CardMatch struct {
+	ID string `json:"id"`
+	PreviousCardRef
+	Similarity float64 `json:"similarity"`
+}
+
+// CardDiff compares an extraction's cards with the request's previous_cards.
+// Unchanged cards have the same words as their previous card; changed cards
+// share at least half their distinct words with it.
+type CardDiff struct {
+	Added     []string          `json:"added"`
+	Changed   []CardMatch       `json:"changed"`
+	Unchanged []CardMatch       `json:"unchanged"`
+	Removed   []PreviousCardRef `json:"removed"`
+}
+
+// DiffCards matches cards against previous one-to-one, most similar pairs
+// first, by the Jaccard similarity of their lowercase word sets. Cards must
+// already have IDs.
+func DiffCards(previous []PreviousCard, cards []Card) *CardDiff {
+	type pair struct {
+		card, prev int
+		similarity float64
+	}
+
+	prevWords := make([]map[string]bool, len(previous))
+	for i, p := range previous {
+		prevWords[i] = wordSet(p.Content)
+	}
+	var pairs []pair
+	for i, card := range cards {
+		words := wordSet(card.Content)
+		for j := range previous {
+			if s := jaccard(words, prevWords[j]); s >= diffMatchThreshold {
+				pairs = append(pairs, pair{i, j, s})
+			}
+		}
+	}
+	slices.SortStableFunc(pairs, func(a, b pair) int {
+		switch {
+		case a.similarity > b.similarity:
+			return -1
+		case a.similarity < b.similarity:
+			return 1
+		}
+		return 0
+	})
+
+	diff := &CardDiff{Added: []string{}, Changed: []CardMatch{}, Unchanged: []CardMatch{}, Removed: []PreviousCardRef{}}
+	matchedCard := make([]bool, len(cards))
+	matchedPrev := make([]bool, len(previous))
+	matches := make([]*pair, len(cards))
+	for _, p := range pairs {
+		if matchedCard[p.card] || matchedPrev[p.prev] {
+			continue
+		}
+		matchedCard[p.card], matchedPrev[p.prev] = true, true
+		matches[p.card] = &p
+	}
+
+	// Report in card order rather than match order
+	for i, p := range matches {
+		if p == nil {
+			diff.Added = append(diff.Added, cards[i].ID)
+			continue
+		}
+		match := CardMatch{
+			ID:              cards[i].ID,
+			PreviousCardRef: PreviousCardRef{PreviousIndex: p.prev, PreviousID: previous[p.prev].ID},
+			Similarity:      math.Round(p.similarity*100) / 100,
+		}
+		if p.similarity == 1 {
+			diff.Unchanged = append(diff.Unchanged, match)
+		} else {
+			diff.Changed = append(diff.Changed, match)
+		}
+	}
+	for j, p := range previous {
+		if !matchedPrev[j] {
+			diff.Removed = append(diff.Removed, PreviousCardRef{PreviousIndex: j, PreviousID: p.ID})
+		}
+	}
+	return diff
+}
+
+// wordSet returns the distinct lowercase words of s, ignoring punctuation
+// and markdown markers
+func wordSet(s string) map[string]bool {
+	words := make(map[string]bool)
+	for _, word := range strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		words[word] = true
+	}
+	return words
+}
+
+// jaccard returns |a ∩ b| / |a ∪ b|, or 1 when both are empty
+func jaccard(a, b map[string]bool) float64 {
+	if len(a) == 0 && len(b) == 0 {
+		return 1
+	}
+	shared := 0
+	for word := range a {
+		if b[word] {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(a)+len(b)-shared)
+}
@@ -0,0 +1,88 @@
+package shared
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffCards(t *testing.T) {
+	previous := []PreviousCard{
+		{ID: "p-goroutines", Content: "Goroutines are cheap to start."},
+		{Content: "Channels synchronize goroutines."},
+		{ID: "p-defer", Content: "Defer runs when the function returns."},
+	}
+	cards := []Card{
+		{ID: "a", Content: "**Goroutines** are cheap to start!"},
+		{ID: "b", Content: "Select waits on multiple channels."},
+		{ID: "c", Content: "Defer runs when the surrounding function returns."},
+	}
+	tests := []struct {
+		name     string
+		previous []PreviousCard
+		cards    []Card
+		want     CardDiff
+	}{
+		{
+			"added, changed, unchanged and removed", previous, cards,
+			CardDiff{
+				Added:     []string{"b"},
+				Changed:   []CardMatch{{ID: "c", PreviousCardRef: PreviousCardRef{2, "p-defer"}, Similarity: 0.86}},
+				Unchanged: []CardMatch{{ID: "a", PreviousCardRef: PreviousCardRef{0, "p-goroutines"}, Similarity: 1}},
+				Removed:   []PreviousCardRef{{1, ""}},
+			},
+		},
+		{
+			"no previous cards", nil, cards[:2],
+			CardDiff{Added: []string{"a", "b"}, Changed: []CardMatch{}, Unchanged: []CardMatch{}, Removed: []PreviousCardRef{}},
+		},
+		{
+			"every card removed", previous[:2], nil,
+			CardDiff{Added: []string{}, Changed: []CardMatch{}, Unchanged: []CardMatch{}, Removed: []PreviousCardRef{{0, "p-goroutines"}, {1, ""}}},
+		},
+		{
+			"previous cards match once", previous[:1], []Card{{ID: "x", Content: previous[0].Content}, {ID: "y", Content: previous[0].Content}},
+			CardDiff{
+				Added:     []string{"y"},
+				Changed:   []CardMatch{},
+				Unchanged: []CardMatch{{ID: "x", PreviousCardRef: PreviousCardRef{0, "p-goroutines"}, Similarity: 1}},
+				Removed:   []PreviousCardRef{},
+			},
+		},
+		{
+			"most similar pair first", []PreviousCard{{Content: "alpha beta gamma delta"}}, []Card{{ID: "near", Content: "alpha beta gamma epsilon"}, {ID: "same", Content: "Alpha beta gamma delta"}},
+			CardDiff{
+				Added:     []string{"near"},
+				Changed:   []CardMatch{},
+				Unchanged: []CardMatch{{ID: "same", PreviousCardRef: PreviousCardRef{0, ""}, Similarity: 1}},
+				Removed:   []PreviousCardRef{},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DiffCards(tt.previous, tt.cards); !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("DiffCards = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractionDiffAgainstPreviousCards(t *testing.T) {
+	useConfig(t, nil)
+	req := &AIExtractionRequest{Content: "Go note", PreviousCards: []PreviousCard{{ID: "old", Content: "Goroutines are cheap to start."}}}
+	resp, err := buildResponse(t, req, card("Goroutines are cheap to start."), card("Interfaces are satisfied implicitly."))
+	if err != nil {
+		t.Fatalf("BuildExtractionResponse: %v", err)
+	}
+	if resp.Diff == nil || len(resp.Diff.Unchanged) != 1 || resp.Diff.Unchanged[0].ID != resp.Cards[0].ID || !reflect.DeepEqual(resp.Diff.Added, []string{resp.Cards[1].ID}) {
+		t.Errorf("diff = %+v, want the first card unchanged and the second added", resp.Diff)
+	}
+
+	fresh, err := buildResponse(t, &AIExtractionRequest{Content: "Go note"}, card("Goroutines are cheap to start."))
+	if err != nil {
+		t.Fatalf("BuildExtractionResponse: %v", err)
+	}
+	if fresh.Diff != nil {
+		t.Errorf("diff = %+v without previous_cards, want none", fresh.Diff)
+	}
+}
@@ -0,0 +1,177 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// =============================================================================
+// Typed Errors
+// =============================================================================
+
+// Error codes returned in ErrorResponse.Code
+const (
+	ErrCodeBadRequest          = "bad_request"
+	ErrCodeMethodNotAllowed    = "method_not_allowed"
+	ErrCodeUnauthorized        = "unauthorized"
+	ErrCodeForbidden           = "forbidden"
+	ErrCodeRateLimited         = "rate_limited"
+	ErrCodeBurstLimited        = "burst_limited"
+	ErrCodeCooldown            = "cooldown"
+	ErrCodeConcurrencyLimited  = "concurrency_limited"
+	ErrCodePolicyViolation     = "policy_violation"
+	ErrCodeProviderUnavailable = "provider_unavailable"
+	ErrCodeUpstream            = "upstream_error"
+	ErrCodeUpstreamRejected    = "upstream_rejected"
+	ErrCodeUpstreamAuth        = "upstream_auth_error"
+	ErrCodeUpstreamRateLimited = "upstream_rate_limited"
+	ErrCodeEmptyExtraction     = "empty_extraction"
+	ErrCodeInvalidExtraction   = "invalid_extraction"
+	ErrCodeTimeout             = "request_timeout"
+	ErrCodeMaintenance         = "maintenance"
+	ErrCodeFeatureDisabled     = "feature_disabled"
+	ErrCodeServerConfig        = "server_config_error"
+	ErrCodeInternal            = "internal_error"
+)
+
+// errorStatuses maps each error code to its HTTP status
+var errorStatuses = map[string]int{
+	ErrCodeBadRequest:          http.StatusBadRequest,
+	ErrCodeMethodNotAllowed:    http.StatusMethodNotAllowed,
+	ErrCodeUnauthorized:        http.StatusUnauthorized,
+	ErrCodeForbidden:           http.StatusForbidden,
+	ErrCodeRateLimited:         http.StatusTooManyRequests,
+	ErrCodeBurstLimited:        http.StatusTooManyRequests,
+	ErrCodeCooldown:            http.StatusTooManyRequests,
+	ErrCodeConcurrencyLimited:  http.StatusTooManyRequests,
+	ErrCodePolicyViolation:     http.StatusUnprocessableEntity,
+	ErrCodeProviderUnavailable: http.StatusServiceUnavailable,
+	ErrCodeUpstream:            http.StatusBadGateway,
+	ErrCodeUpstreamRejected:    http.StatusUnprocessableEntity,
+	ErrCodeUpstreamAuth:        http.StatusBadGateway,
+	ErrCodeUpstreamRateLimited: http.StatusServiceUnavailable,
+	ErrCodeEmptyExtraction:     http.StatusBadGateway,
+	ErrCodeInvalidExtraction:   http.StatusBadGateway,
+	ErrCodeTimeout:             http.StatusGatewayTimeout,
+	ErrCodeMaintenance:         http.StatusServiceUnavailable,
+	ErrCodeFeatureDisabled:     http.StatusServiceUnavailable,
+	ErrCodeServerConfig:        http.StatusInternalServerError,
+	ErrCodeInternal:            http.StatusInternalServerError,
+}
+
+// APIError is an error with a category code and a client-facing message. The
+// wrapped Err holds the underlying cause, which is logged but never returned
+// to clients.
+type APIError struct {
+	Code    string
+	Message string
+	Err     error
+
+	// ResetAt is when a rate-limited client may retry (zero when not applicable)
+	ResetAt time.Time
+
+	// RetryAfter, when set, is sent as the Retry-After header
+	RetryAfter time.Duration
+}
+
+// NewAPIError creates an APIError with the given code and message
+func NewAPIError(code, message string, err error) *APIError {
+	return &APIError{Code: code, Message: message, Err: err}
+}
+
+func (e *APIError) Error() string {
+	if e.Err != nil {
+		return e.Code + ": " + e.Message + ": " + e.Err.Error()
+	}
+	return e.Code + ": " + e.Message
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// Status returns the HTTP status for the error's code
+func (e *APIError) Status() int {
+	return HTTPStatusForCode(e.Code)
+}
+
+// HTTPStatusForCode returns the HTTP status for an error code, defaulting to
+// 500 for unknown codes
+func HTTPStatusForCode(code string) int {
+	if status, ok := errorStatuses[code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// ToAPIError classifies any error into an APIError
+func ToAPIError(err error) *APIError {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return NewAPIError(ErrCodeTimeout, "Request took too long to process. You have not been charged; please try again.", err)
+	case errors.Is(err, ErrMissingAccessKey):
+		return NewAPIError(ErrCodeServerConfig, "Server configuration error", err)
+	case errors.Is(err, ErrProviderUnavailable):
+		return NewAPIError(ErrCodeProviderUnavailable, "Our AI provider upstream is currently unavailable. Please try again in a couple minutes.", err)
+	case errors.Is(err, ErrEmptyExtraction):
+		return NewAPIError(ErrCodeEmptyExtraction, "The AI service returned no cards for this note. You have not been charged; please try again.", err)
+	case errors.Is(err, ErrInvalidExtraction):
+		return NewAPIError(ErrCodeInvalidExtraction, "The AI service returned a malformed extraction. You have not been charged; please try again.", err)
+	case errors.Is(err, ErrProviderResponseTooLarge):
+		return NewAPIError(ErrCodeUpstream, "The AI service returned an oversized response. You have not been charged; please try again.", err)
+	case errors.Is(err, ErrProviderRequest):
+		return NewAPIError(ErrCodeUpstream, "Failed to call AI service", err)
+	}
+
+	var upstreamErr *UpstreamError
+	if errors.As(err, &upstreamErr) {
+		return upstreamAPIError(upstreamErr.StatusCode, err)
+	}
+
+	return NewAPIError(ErrCodeInternal, "Internal server error", err)
+}
+
+// upstreamAPIError maps a non-200 provider status to a stable error code.
+// The provider's body stays in the wrapped error for logging only.
+func upstreamAPIError(status int, err error) *APIError {
+	switch {
+	case status == http.StatusBadRequest:
+		return NewAPIError(ErrCodeUpstreamRejected, "The AI service could not process this note. You have not been charged.", err)
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return NewAPIError(ErrCodeUpstreamAuth, "The AI service rejected our credentials. You have not been charged; please try again later.", err)
+	case status == http.StatusTooManyRequests:
+		return NewAPIError(ErrCodeUpstreamRateLimited, "The AI service is receiving too many requests. You have not been charged; please try again in a minute.", err)
+	default:
+		return NewAPIError(ErrCodeUpstream, "AI service returned an error", err)
+	}
+}
+
+// WriteError logs err and writes it as a JSON ErrorResponse with the status
+// mapped from its category, honoring ?pretty=true on r and localizing the
+// message for its Accept-Language. Upstream error bodies are logged, never
+// forwarded.
+func WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	apiErr := ToAPIError(err)
+	log.Printf("Request failed: %v", apiErr)
+
+	lang := RequestLanguage(r)
+	w.Header().Set("Content-Language", lang)
+	w.Header().Add("Vary", "Accept-Language")
+	resp := ErrorResponse{Error: Translate(lang, apiErr.Message), Code: apiErr.Code}
+	if !apiErr.ResetAt.IsZero() {
+		resp.ResetAt = apiErr.ResetAt.Format(time.RFC3339)
+	}
+	if apiErr.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(apiErr.RetryAfter.Seconds())))
+	}
+	WriteJSON(w, r, apiErr.Status(), resp)
+}
@@ -0,0 +1,138 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPStatusForCode(t *testing.T) {
+	tests := []struct {
+		code string
+		want int
+	}{
+		{ErrCodeBadRequest, http.StatusBadRequest},
+		{ErrCodeMethodNotAllowed, http.StatusMethodNotAllowed},
+		{ErrCodeUnauthorized, http.StatusUnauthorized},
+		{ErrCodeForbidden, http.StatusForbidden},
+		{ErrCodeRateLimited, http.StatusTooManyRequests},
+		{ErrCodeBurstLimited, http.StatusTooManyRequests},
+		{ErrCodeCooldown, http.StatusTooManyRequests},
+		{ErrCodeConcurrencyLimited, http.StatusTooManyRequests},
+		{ErrCodePolicyViolation, http.StatusUnprocessableEntity},
+		{ErrCodeProviderUnavailable, http.StatusServiceUnavailable},
+		{ErrCodeUpstream, http.StatusBadGateway},
+		{ErrCodeEmptyExtraction, http.StatusBadGateway},
+		{ErrCodeInvalidExtraction, http.StatusBadGateway},
+		{ErrCodeTimeout, http.StatusGatewayTimeout},
+		{ErrCodeMaintenance, http.StatusServiceUnavailable},
+		{ErrCodeFeatureDisabled, http.StatusServiceUnavailable},
+		{ErrCodeServerConfig, http.StatusInternalServerError},
+		{ErrCodeInternal, http.StatusInternalServerError},
+		{"no_such_code", http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		if got := HTTPStatusForCode(tt.code); got != tt.want {
+			t.Errorf("HTTPStatusForCode(%q) = %d, want %d", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestToAPIError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"api error", NewAPIError(ErrCodeBadRequest, "bad", nil), ErrCodeBadRequest},
+		{"wrapped api error", fmt.Errorf("check: %w", NewAPIError(ErrCodeCooldown, "slow down", nil)), ErrCodeCooldown},
+		{"deadline", fmt.Errorf("call: %w", context.DeadlineExceeded), ErrCodeTimeout},
+		{"missing key", ErrMissingAccessKey, ErrCodeServerConfig},
+		{"provider unavailable", ErrProviderUnavailable, ErrCodeProviderUnavailable},
+		{"empty extraction", ErrEmptyExtraction, ErrCodeEmptyExtraction},
+		{"invalid extraction", ErrInvalidExtraction, ErrCodeInvalidExtraction},
+		{"provider request", ErrProviderRequest, ErrCodeUpstream},
+		{"unknown", errors.New("boom"), ErrCodeInternal},
+	}
+	for _, tt := range tests {
+		if got := ToAPIError(tt.err).Code; got != tt.want {
+			t.Errorf("%s: code = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	useConfig(t, nil)
+	resetAt := time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC)
+	apiErr := NewAPIError(ErrCodeRateLimited, "Client rate limit exceeded.", errors.New("internal detail"))
+	apiErr.ResetAt = resetAt
+	apiErr.RetryAfter = 90 * time.Second
+
+	rec := httptest.NewRecorder()
+	WriteError(rec, httptest.NewRequest(http.MethodPost, "/api/ai-extraction", nil), apiErr)
+
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("status = %d, want 429", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "90" {
+		t.Errorf("Retry-After = %q, want 90", got)
+	}
+	var body ErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	want := ErrorResponse{Error: "Client rate limit exceeded.", Code: ErrCodeRateLimited, ResetAt: resetAt.Format(time.RFC3339)}
+	if body != want {
+		t.Errorf("body = %+v, want %+v", body, want)
+	}
+}
+
+func TestUpstreamErrorMapping(t *testing.T) {
+	const leak = "internal upstream detail"
+	tests := []struct {
+		status     int
+		body       string
+		wantCode   string
+		wantStatus int
+	}{
+		{http.StatusBadRequest, `{"error":"bad prompt: ` + leak + `"}`, ErrCodeUpstreamRejected, http.StatusUnprocessableEntity},
+		{http.StatusUnauthorized, leak, ErrCodeUpstreamAuth, http.StatusBadGateway},
+		{http.StatusForbidden, leak, ErrCodeUpstreamAuth, http.StatusBadGateway},
+		{http.StatusTooManyRequests, leak, ErrCodeUpstreamRateLimited, http.StatusServiceUnavailable},
+		{http.StatusInternalServerError, leak, ErrCodeUpstream, http.StatusBadGateway},
+		{http.StatusServiceUnavailable, `{"error":{"code":503,"status":"UNAVAILABLE","message":"` + leak + `"}}`, ErrCodeProviderUnavailable, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.status), func(t *testing.T) {
+			cfg := useConfig(t, func(c *Config) { c.AccessKeys = []string{"test-key"} })
+			fakeProvider(t, cfg, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			})
+
+			_, err := ExtractCards(context.Background(), AIExtractionRequest{Content: "Upstream error note"})
+			if err == nil {
+				t.Fatal("ExtractCards succeeded")
+			}
+			rec := httptest.NewRecorder()
+			WriteError(rec, httptest.NewRequest(http.MethodPost, "/api/ai-extraction", nil), err)
+
+			var body ErrorResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("response is not an ErrorResponse: %s", rec.Body)
+			}
+			if body.Code != tt.wantCode || rec.Code != tt.wantStatus {
+				t.Errorf("got %d %q, want %d %q", rec.Code, body.Code, tt.wantStatus, tt.wantCode)
+			}
+			if strings.Contains(rec.Body.String(), leak) {
+				t.Errorf("upstream body forwarded: %s", rec.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package shared
+
+import (
+	"encoding/csv"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// =============================================================================
+// Export Formats
+// =============================================================================
+
+// Response formats for a successful extraction, selected with ?format= or
+// the Accept header
+const (
+	ResponseFormatJSON = "json"
+	ResponseFormatCSV  = "csv"
+	ResponseFormatAnki = "anki"
+)
+
+// NegotiateResponseFormat picks the extraction response format. An explicit
+// ?format= wins over Accept; anything unrecognized gets JSON.
+func NegotiateResponseFormat(r *http.Request) string {
+	switch strings.ToLower(r.URL.Query().Get("format")) {
+	case ResponseFormatCSV:
+		return ResponseFormatCSV
+	case ResponseFormatAnki:
+		return ResponseFormatAnki
+	case ResponseFormatJSON:
+		return ResponseFormatJSON
+	}
+	for _, mediaType := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, _ = strings.Cut(mediaType, ";")
+		if strings.EqualFold(strings.TrimSpace(mediaType), "text/csv") {
+			return ResponseFormatCSV
+		}
+	}
+	return ResponseFormatJSON
+}
+
+// ResponseRepresentation names the exact form an extraction response takes
+// for r: its negotiated format and, for JSON, whether it is minimal or
+// indented
+func ResponseRepresentation(r *http.Request, minimal bool) string {
+	format := NegotiateResponseFormat(r)
+	if format != ResponseFormatJSON {
+		return format
+	}
+	if minimal {
+		format += "-minimal"
+	}
+	if WantsPretty(r) {
+		format += "-pretty"
+	}
+	return format
+}
+
+// WriteCardsCSV writes cards as CSV with content, tags (semicolon-joined) and
+// project columns under a header row. Fields with commas, quotes or newlines
+// are quoted per RFC 4180.
+func WriteCardsCSV(w http.ResponseWriter, status int, cards []Card) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.WriteHeader(status)
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"content", "tags", "project"})
+	for _, card := range cards {
+		project := ""
+		if card.SuggestedProject != nil {
+			project = *card.SuggestedProject
+		}
+		cw.Write([]string{card.Content, strings.Join(card.SuggestedTags, ";"), project})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		log.Printf("Failed to write CSV response: %v", err)
+	}
+}
+
+// WriteCardsAnki writes cards as Anki-importable tab-separated text with
+// front, back and tags columns. Header lines tell Anki the separator, that
+// fields are HTML and which column holds tags. A card whose content opens
+// with a markdown heading uses the heading as the front and the rest as the
+// back; otherwise the whole card is the front.
+func WriteCardsAnki(w http.ResponseWriter, status int, cards []Card) {
+	w.Header().Set("Content-Type", "text/tab-separated-values; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="swipenotes-cards.txt"`)
+	w.WriteHeader(status)
+
+	io.WriteString(w, "#separator:tab\n#html:true\n#tags column:3\n")
+	for _, card := range cards {
+		front, back := ankiFields(card.Content)
+		tags := make([]string, len(card.SuggestedTags))
+		for i, tag := range card.SuggestedTags {
+			// Anki separates tags with spaces
+			tags[i] = strings.Join(strings.Fields(tag), "_")
+		}
+		io.WriteString(w, ankiEscape(front)+"\t"+ankiEscape(back)+"\t"+ankiEscape(strings.Join(tags, " "))+"\n")
+	}
+}
+
+// ankiFields splits card content into a front and back
+func ankiFields(content string) (string, string) {
+	content = strings.TrimSpace(content)
+	first, rest, _ := strings.Cut(content, "\n")
+	if m := headingPattern.FindStringSubmatch(first); m != nil && strings.TrimSpace(rest) != "" {
+		return m[1], strings.TrimSpace(rest)
+	}
+	return content, ""
+}
+
+// ankiEscape HTML-escapes a field and encodes line breaks and tabs so the
+// field stays on one line of its column
+func ankiEscape(s string) string {
+	s = html.EscapeString(s)
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	s = strings.ReplaceAll(s, "\n", "<br>")
+	return strings.ReplaceAll(s, "\t", "&#9;")
+}
@@ -0,0 +1,113 @@
+package shared
+
+import (
+	"encoding/csv"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateResponseFormat(t *testing.T) {
+	tests := []struct {
+		name, query, accept, want string
+	}{
+		{"default", "", "", ResponseFormatJSON},
+		{"accept csv", "", "text/csv", ResponseFormatCSV},
+		{"accept csv among others", "", "application/json;q=0.5, Text/CSV;q=0.9", ResponseFormatCSV},
+		{"format csv", "?format=CSV", "", ResponseFormatCSV},
+		{"format wins over accept", "?format=json", "text/csv", ResponseFormatJSON},
+		{"unknown format", "?format=xml", "", ResponseFormatJSON},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/ai-extraction"+tt.query, nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			if got := NegotiateResponseFormat(r); got != tt.want {
+				t.Errorf("format = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteCardsCSV(t *testing.T) {
+	project := "Work, mostly"
+	tests := []struct {
+		name string
+		card Card
+		want string
+	}{
+		{"plain", Card{Content: "Go is compiled", SuggestedTags: []string{"go"}}, "Go is compiled,go,\n"},
+		{"comma", Card{Content: "Maps, slices and channels", SuggestedTags: []string{"go", "types"}}, `"Maps, slices and channels",go;types,` + "\n"},
+		{"newline", Card{Content: "Line one\nLine two"}, "\"Line one\nLine two\",,\n"},
+		{"quote", Card{Content: `Say "hi"`}, `"Say ""hi""",,` + "\n"},
+		{"project with comma", Card{Content: "Standup", SuggestedProject: &project}, `Standup,,"Work, mostly"` + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			WriteCardsCSV(rec, http.StatusOK, []Card{tt.card})
+
+			if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/csv") {
+				t.Errorf("Content-Type = %q, want text/csv", ct)
+			}
+			body := rec.Body.String()
+			header, row, _ := strings.Cut(body, "\n")
+			if header != "content,tags,project" {
+				t.Errorf("header = %q", header)
+			}
+			if row != tt.want {
+				t.Errorf("row = %q, want %q", row, tt.want)
+			}
+
+			// The escaped row reads back as the original fields
+			records, err := csv.NewReader(strings.NewReader(body)).ReadAll()
+			if err != nil {
+				t.Fatalf("reading the CSV back: %v", err)
+			}
+			wantProject := ""
+			if tt.card.SuggestedProject != nil {
+				wantProject = *tt.card.SuggestedProject
+			}
+			want := []string{tt.card.Content, strings.Join(tt.card.SuggestedTags, ";"), wantProject}
+			if len(records) != 2 || !slices.Equal(records[1], want) {
+				t.Errorf("records = %q, want a header and %q", records, want)
+			}
+		})
+	}
+}
+
+func TestWriteCardsAnki(t *testing.T) {
+	tests := []struct {
+		name string
+		card Card
+		want string
+	}{
+		{"plain", Card{Content: "Go is compiled", SuggestedTags: []string{"go"}}, "Go is compiled\t\tgo"},
+		{"heading splits front and back", Card{Content: "## What is a goroutine?\nA lightweight thread.\nScheduled by Go."}, "What is a goroutine?\tA lightweight thread.<br>Scheduled by Go.\t"},
+		{"heading alone", Card{Content: "# Just a heading"}, "# Just a heading\t\t"},
+		{"html", Card{Content: `Use <b> & "quotes"`}, "Use &lt;b&gt; &amp; &#34;quotes&#34;\t\t"},
+		{"tabs and newlines", Card{Content: "a\tb\r\nc"}, "a&#9;b<br>c\t\t"},
+		{"tags with spaces", Card{Content: "Card", SuggestedTags: []string{"machine learning", "go"}}, "Card\t\tmachine_learning go"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			WriteCardsAnki(rec, http.StatusOK, []Card{tt.card})
+
+			if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/tab-separated-values") {
+				t.Errorf("Content-Type = %q, want text/tab-separated-values", ct)
+			}
+			lines := strings.Split(strings.TrimSuffix(rec.Body.String(), "\n"), "\n")
+			if want := []string{"#separator:tab", "#html:true", "#tags column:3"}; len(lines) != 4 || !slices.Equal(lines[:3], want) {
+				t.Fatalf("lines = %q, want the Anki headers and one card", lines)
+			}
+			if lines[3] != tt.want {
+				t.Errorf("card line = %q, want %q", lines[3], tt.want)
+			}
+		})
+	}
+}
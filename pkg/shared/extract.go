@@ -0,0 +1,180 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// =============================================================================
+// Core Extraction
+// =============================================================================
+
+// ErrInvalidRequest is the cause of bad_request errors returned by ExtractCards
+var ErrInvalidRequest = errors.New("invalid extraction request")
+
+// ErrProviderUnavailable is returned when Gemini Army reports 503 UNAVAILABLE
+var ErrProviderUnavailable = errors.New("AI provider is unavailable")
+
+// UpstreamError is returned when Gemini Army responds with a non-200 status
+type UpstreamError struct {
+	StatusCode int
+	Body       []byte
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("Gemini Army API returned status %d: %s", e.StatusCode, string(e.Body))
+}
+
+// extractionGroup coalesces concurrent identical extractions within this
+// process so a retry storm results in a single provider call
+var extractionGroup singleflight.Group
+
+// ExtractCards runs a complete extraction for req: validation, prompt
+// generation, the provider call and card post-processing. It has no HTTP or
+// rate-limit coupling so it can back the serverless handlers, the CLI and
+// tests alike. The returned response always contains at least one card.
+//
+// Concurrent calls for the same request share one provider call, bounded by
+// the first caller's deadline. Every caller receives its own copy of the
+// result, or gives up with its context's error when its own deadline passes
+// first; all but the caller that performed the call see Coalesced set and
+// should not be charged.
+func ExtractCards(ctx context.Context, req AIExtractionRequest) (*AIExtractionResponse, error) {
+	ctx, span := StartSpan(ctx, "extraction.extract")
+	defer span.End()
+	span.SetAttribute("extraction.content_length", len(req.Content))
+
+	resp, err := extractCardsShared(ctx, req)
+	if resp != nil {
+		span.SetAttribute("extraction.card_count", len(resp.Cards))
+		span.SetAttribute("extraction.coalesced", resp.Coalesced)
+		span.SetAttribute("extraction.degraded", resp.Degraded)
+	}
+	span.RecordError(err)
+	return resp, err
+}
+
+// extractCardsShared prepares req and runs its provider call, shared with any
+// concurrent identical request
+func extractCardsShared(ctx context.Context, req AIExtractionRequest) (*AIExtractionResponse, error) {
+	if err := req.Prepare(); err != nil {
+		return nil, NewAPIError(ErrCodeBadRequest, err.Error(), ErrInvalidRequest)
+	}
+
+	leader := false
+	calls := extractionGroup.DoChan(ExtractionCacheKey(&req), func() (any, error) {
+		leader = true
+		// Detach from the leader's cancellation so one client disconnecting
+		// doesn't fail every coalesced caller, while keeping what is left of
+		// its REQUEST_TIMEOUT_SECONDS budget
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			deadline = time.Now().Add(GetConfig().RequestTimeout)
+		}
+		callCtx, cancel := context.WithDeadline(context.WithoutCancel(ctx), deadline)
+		defer cancel()
+		return extractCards(callCtx, &req)
+	})
+
+	// A coalesced caller stops waiting once its own deadline passes, even
+	// though the shared call carries on for the others
+	var call singleflight.Result
+	select {
+	case call = <-calls:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	v, err := call.Val, call.Err
+	if err != nil {
+		if GetConfig().DegradedFallback && isProviderOutage(err) {
+			log.Printf("AI provider unavailable, serving degraded extraction: %v", err)
+			return DegradedExtraction(&req)
+		}
+		return nil, err
+	}
+
+	result := *v.(*AIExtractionResponse)
+	result.Cards = slices.Clone(result.Cards)
+	result.Coalesced = !leader
+	return &result, nil
+}
+
+// extractCards performs the provider call and post-processing for a prepared
+// request
+func extractCards(ctx context.Context, req *AIExtractionRequest) (*AIExtractionResponse, error) {
+	prompt := AIExtractionPrompt(req)
+	status, body, err := GenerateWithGemini(ctx, req.GeminiRequest(prompt))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkUpstreamStatus(status, body); err != nil {
+		return nil, err
+	}
+
+	resp, err := BuildExtractionResponse(ctx, req, body)
+	if err != nil {
+		return nil, err
+	}
+	if GetConfig().DebugIncludePrompt {
+		resp.Debug = &ExtractionDebug{Prompt: prompt}
+	}
+	return resp, nil
+}
+
+// RegenerateCard produces a single alternative card for req.CardContent using
+// the original note as source material
+func RegenerateCard(ctx context.Context, req RegenerateCardRequest) (*RegenerateCardResponse, error) {
+	if err := req.Prepare(); err != nil {
+		return nil, NewAPIError(ErrCodeBadRequest, err.Error(), ErrInvalidRequest)
+	}
+
+	status, body, err := GenerateWithGemini(ctx, req.GeminiRequest(CardRegenerationPrompt(&req)))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkUpstreamStatus(status, body); err != nil {
+		return nil, err
+	}
+
+	extraction, err := BuildExtractionResponse(ctx, &req.AIExtractionRequest, body)
+	if err != nil {
+		return nil, err
+	}
+	return &RegenerateCardResponse{
+		Card:          extraction.Cards[0],
+		Model:         extraction.Model,
+		UsageMetadata: extraction.UsageMetadata,
+	}, nil
+}
+
+// checkUpstreamStatus converts a non-200 Gemini Army response into an error
+func checkUpstreamStatus(status int, body []byte) error {
+	if status == http.StatusOK {
+		return nil
+	}
+
+	var geminiErr struct {
+		Error struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+			Status  string `json:"status"`
+		} `json:"error"`
+	}
+
+	// Check for specific 503 UNAVAILABLE error
+	if err := json.Unmarshal(body, &geminiErr); err == nil {
+		if geminiErr.Error.Code == 503 && geminiErr.Error.Status == "UNAVAILABLE" {
+			return fmt.Errorf("%w: %s", ErrProviderUnavailable, geminiErr.Error.Message)
+		}
+	}
+
+	return &UpstreamError{StatusCode: status, Body: body}
+}
@@ -0,0 +1,142 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestExtractCardsCoalescesIdenticalRequests(t *testing.T) {
+	cfg := useConfig(t, nil)
+	var calls atomic.Int32
+	gate := make(chan struct{})
+	body := providerResponse(cardsOutput("Goroutines are cheap to start."))
+	fakeProvider(t, cfg, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		<-gate
+		w.Write(body)
+	})
+
+	const n = 8
+	var wg sync.WaitGroup
+	results := make([]*AIExtractionResponse, n)
+	errs := make([]error, n)
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = ExtractCards(context.Background(), AIExtractionRequest{Content: "Coalescing note"})
+		}()
+	}
+	// Hold the provider call until every request has joined it
+	time.Sleep(100 * time.Millisecond)
+	close(gate)
+	wg.Wait()
+
+	if got := calls.Load(); got != 1 {
+		t.Fatalf("provider calls = %d, want 1", got)
+	}
+	coalesced := 0
+	for i := range n {
+		if errs[i] != nil {
+			t.Fatalf("request %d: %v", i, errs[i])
+		}
+		if len(results[i].Cards) != 1 {
+			t.Errorf("request %d: got %d cards, want 1", i, len(results[i].Cards))
+		}
+		if results[i].Coalesced {
+			coalesced++
+		}
+	}
+	if coalesced != n-1 {
+		t.Errorf("coalesced results = %d, want %d", coalesced, n-1)
+	}
+}
+
+func TestExtractCardsKeepsCallerDeadline(t *testing.T) {
+	cfg := useConfig(t, func(c *Config) { c.RequestTimeout = time.Minute })
+	stall := make(chan struct{})
+	fakeProvider(t, cfg, func(w http.ResponseWriter, r *http.Request) {
+		<-stall
+	})
+	t.Cleanup(func() { close(stall) })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := ExtractCards(ctx, AIExtractionRequest{Content: "Deadline note"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want a deadline error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("returned after %s, want the caller's 100ms deadline", elapsed)
+	}
+}
+
+func TestExtractCardsFollowerStopsAtOwnDeadline(t *testing.T) {
+	cfg := useConfig(t, nil)
+	var calls atomic.Int32
+	gate := make(chan struct{})
+	body := providerResponse(cardsOutput("Channels synchronize goroutines."))
+	fakeProvider(t, cfg, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		<-gate
+		w.Write(body)
+	})
+
+	req := AIExtractionRequest{Content: "Follower note"}
+	leaderDone := make(chan error, 1)
+	go func() {
+		_, err := ExtractCards(context.Background(), req)
+		leaderDone <- err
+	}()
+	for calls.Load() == 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := ExtractCards(ctx, req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("follower err = %v, want a deadline error", err)
+	}
+
+	close(gate)
+	if err := <-leaderDone; err != nil {
+		t.Errorf("leader err = %v", err)
+	}
+}
+
+func TestDebugIncludePrompt(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		cfg := useConfig(t, func(c *Config) { c.DebugIncludePrompt = enabled })
+		fakeProvider(t, cfg, serveCards("Goroutines are cheap to start."))
+
+		resp, err := ExtractCards(context.Background(), AIExtractionRequest{Content: "Debug prompt note", ExistingTags: []string{"go"}})
+		if err != nil {
+			t.Fatalf("ExtractCards: %v", err)
+		}
+		body, _ := json.Marshal(resp)
+		var decoded struct {
+			Debug *struct {
+				Prompt string `json:"prompt"`
+			} `json:"_debug"`
+		}
+		json.Unmarshal(body, &decoded)
+
+		if !enabled {
+			if decoded.Debug != nil {
+				t.Errorf("_debug present with DEBUG_INCLUDE_PROMPT off: %s", body)
+			}
+			continue
+		}
+		if decoded.Debug == nil || !strings.Contains(decoded.Debug.Prompt, "Debug prompt note") || !strings.Contains(decoded.Debug.Prompt, "Existing tags: go") {
+			t.Errorf("_debug.prompt missing the rendered prompt: %s", body)
+		}
+	}
+}
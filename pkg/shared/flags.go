@@ -0,0 +1,78 @@
+package shared
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// =============================================================================
+// Feature Flags
+// =============================================================================
+
+// Feature flags, stored as fields of the "flags" Redis hash, e.g.
+// HSET flags streaming false. A flag missing from the hash keeps its default.
+const (
+	FlagCache     = "cache"     // Serve and store cached extractions (default on)
+	FlagStreaming = "streaming" // Accept /api/ai-extraction/stream requests (default on)
+)
+
+// flagDefaults holds each known flag's value when the hash doesn't set it.
+// Unknown flags are off.
+var flagDefaults = map[string]bool{
+	FlagCache:     true,
+	FlagStreaming: true,
+}
+
+// flagCache keeps the last read of the flags hash for FeatureFlagCacheTTL so
+// checking a flag doesn't cost a Redis call per request
+var flagCache struct {
+	mu        sync.Mutex
+	values    map[string]string
+	fetchedAt time.Time
+}
+
+func featureFlagsKey() string {
+	return redisKey("flags")
+}
+
+// IsEnabled reports whether flag is on. Without Redis, or when the hash
+// can't be read and nothing is cached, every flag has its default.
+func IsEnabled(flag string) bool {
+	if raw, ok := loadFlags()[flag]; ok {
+		if enabled, err := strconv.ParseBool(raw); err == nil {
+			return enabled
+		}
+		log.Printf("Feature flag %q has invalid value %q; using its default", flag, raw)
+	}
+	return flagDefaults[flag]
+}
+
+// loadFlags returns the cached flags hash, refreshing it once it is older
+// than FeatureFlagCacheTTL. A failed refresh keeps the previous values and is
+// retried after another TTL, so a Redis outage isn't hit on every request.
+func loadFlags() map[string]string {
+	flagCache.mu.Lock()
+	defer flagCache.mu.Unlock()
+
+	if !flagCache.fetchedAt.IsZero() && time.Since(flagCache.fetchedAt) < GetConfig().FeatureFlagCacheTTL {
+		return flagCache.values
+	}
+	flagCache.fetchedAt = time.Now()
+
+	client := GetCacheClient()
+	if client == nil {
+		return flagCache.values
+	}
+	ctx, cancel := redisOpContext(context.Background())
+	defer cancel()
+	values, err := client.HGetAll(ctx, featureFlagsKey()).Result()
+	if err != nil {
+		log.Printf("Feature flag lookup error: %v", err)
+		return flagCache.values
+	}
+	flagCache.values = values
+	return values
+}
@@ -0,0 +1,61 @@
+package shared
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIsEnabled(t *testing.T) {
+	cfg := useConfig(t, func(c *Config) { c.FeatureFlagCacheTTL = 50 * time.Millisecond })
+	srv, client := newFakeRedis(t, nil)
+	srv.hash = map[string]string{FlagStreaming: "false", FlagCache: "maybe", "beta-prompt": "true"}
+	useRedisClient(t, cfg, client)
+	flagCache.fetchedAt = time.Time{}
+	t.Cleanup(func() { flagCache.values, flagCache.fetchedAt = nil, time.Time{} })
+
+	tests := []struct {
+		flag string
+		want bool
+	}{
+		{FlagStreaming, false},
+		{FlagCache, true}, // An invalid value keeps the default
+		{"beta-prompt", true},
+		{"unknown", false},
+	}
+	for _, tt := range tests {
+		if got := IsEnabled(tt.flag); got != tt.want {
+			t.Errorf("IsEnabled(%q) = %v, want %v", tt.flag, got, tt.want)
+		}
+	}
+	if n := srv.count("HGETALL"); n != 1 {
+		t.Errorf("flags read %d times within the cache TTL, want once", n)
+	}
+
+	// Changes show up once the cached read expires
+	srv.set(func() { srv.hash[FlagStreaming] = "true" })
+	if IsEnabled(FlagStreaming) {
+		t.Error("flag change visible before the cache expired")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !IsEnabled(FlagStreaming) {
+		t.Error("flag change not visible after the cache expired")
+	}
+
+	// A failed refresh keeps the last values
+	srv.set(func() { srv.failing = true })
+	time.Sleep(60 * time.Millisecond)
+	if !IsEnabled(FlagStreaming) || !IsEnabled("beta-prompt") {
+		t.Error("a failed refresh dropped the cached flags")
+	}
+}
+
+func TestIsEnabledWithoutRedis(t *testing.T) {
+	useConfig(t, func(c *Config) { c.RedisURL = "" })
+	flagCache.fetchedAt = time.Time{}
+	t.Cleanup(func() { flagCache.values, flagCache.fetchedAt = nil, time.Time{} })
+	for flag, want := range flagDefaults {
+		if got := IsEnabled(flag); got != want {
+			t.Errorf("IsEnabled(%q) = %v, want its default %v", flag, got, want)
+		}
+	}
+}
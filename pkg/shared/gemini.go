@@ -0,0 +1,129 @@
+package shared
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// =============================================================================
+// Gemini Army Client
+// =============================================================================
+
+// ErrMissingAccessKey is returned when neither ARMY_ACCESS_KEYS nor
+// ARMY_ACCESS_KEY is configured
+var ErrMissingAccessKey = errors.New("ARMY_ACCESS_KEY not set")
+
+// ErrProviderRequest wraps transport failures calling Gemini Army
+var ErrProviderRequest = errors.New("failed to call Gemini Army API")
+
+// ErrProviderResponseTooLarge is returned when a Gemini Army response body
+// exceeds MaxResponseSize
+var ErrProviderResponseTooLarge = errors.New("Gemini Army response exceeded size limit")
+
+// GenerateWithGemini sends a request to the Gemini Army generate endpoint and
+// returns the upstream status code and raw response body. When several access
+// keys are configured, a 401/403 response retries with the next key so
+// credentials can be rotated without downtime.
+func GenerateWithGemini(ctx context.Context, geminiReq GeminiArmyRequest) (int, []byte, error) {
+	keys := GetConfig().AccessKeys
+	if len(keys) == 0 {
+		return 0, nil, ErrMissingAccessKey
+	}
+
+	body, err := json.Marshal(geminiReq)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	var status int
+	var respBody []byte
+	for i, key := range keys {
+		status, respBody, err = postGenerate(ctx, key, body)
+		if err != nil {
+			return status, nil, err
+		}
+		if status != http.StatusUnauthorized && status != http.StatusForbidden {
+			if len(keys) > 1 {
+				log.Printf("Gemini Army request used access key index %d", i)
+			}
+			return status, respBody, nil
+		}
+		log.Printf("Gemini Army rejected access key index %d with status %d", i, status)
+	}
+	return status, respBody, nil
+}
+
+// postGenerate performs a single generate call with the given access key
+func postGenerate(ctx context.Context, accessKey string, body []byte) (status int, respBody []byte, err error) {
+	ctx, span := startSpan(ctx, "gemini.generate", spanKindClient)
+	defer func() {
+		span.SetAttribute("http.response.status_code", status)
+		span.SetAttribute("http.response.body.size", len(respBody))
+		span.RecordError(err)
+		span.End()
+	}()
+	span.SetAttribute("http.request.body.size", len(body))
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", GetConfig().GeminiGenerateURL(), bytes.NewBuffer(body))
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", accessKey)
+	httpReq.Header.Set("User-Agent", GetConfig().GeminiUserAgent)
+	InjectTraceparent(ctx, httpReq.Header)
+
+	resp, err := outboundClient(60 * time.Second).Do(httpReq)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: %w", ErrProviderRequest, err)
+	}
+	defer resp.Body.Close()
+
+	// Read one byte past the limit to detect oversized bodies without
+	// buffering them
+	limit := GetConfig().MaxResponseSize
+	respBody, err = io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return resp.StatusCode, nil, fmt.Errorf("%w: failed to read response: %w", ErrProviderRequest, err)
+	}
+	if int64(len(respBody)) > limit {
+		return resp.StatusCode, nil, fmt.Errorf("%w: more than %d bytes", ErrProviderResponseTooLarge, limit)
+	}
+
+	return resp.StatusCode, respBody, nil
+}
+
+// stripCodeFence removes a surrounding markdown code fence (```json ... ```)
+// from model output so the remaining text can be decoded as JSON
+func stripCodeFence(text string) string {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, "```") {
+		return text
+	}
+	text = strings.TrimPrefix(text, "```")
+	if newline := strings.Index(text, "\n"); newline != -1 {
+		text = text[newline+1:]
+	}
+	text = strings.TrimSuffix(strings.TrimSpace(text), "```")
+	return strings.TrimSpace(text)
+}
+
+// ParseTagSuggestions decodes the tag list produced by TagSuggestionPrompt
+func ParseTagSuggestions(text string) ([]string, error) {
+	var parsed struct {
+		Tags []string `json:"tags"`
+	}
+	if err := json.Unmarshal([]byte(stripCodeFence(text)), &parsed); err != nil {
+		return nil, fmt.Errorf("failed to parse tag suggestions: %w", err)
+	}
+	return parsed.Tags, nil
+}
@@ -0,0 +1,48 @@
+package shared
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestGenerateWithGeminiCapsResponseSize(t *testing.T) {
+	const limit = 1024
+	tests := []struct {
+		name    string
+		size    int
+		wantErr bool
+	}{
+		{"under the limit", limit - 1, false},
+		{"at the limit", limit, false},
+		{"one byte over", limit + 1, true},
+		{"far over", 64 * limit, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := useConfig(t, func(c *Config) { c.MaxResponseSize = limit })
+			fakeProvider(t, cfg, func(w http.ResponseWriter, r *http.Request) {
+				w.Write(bytes.Repeat([]byte("x"), tt.size))
+			})
+
+			status, body, err := GenerateWithGemini(context.Background(), GeminiArmyRequest{})
+			if tt.wantErr {
+				if !errors.Is(err, ErrProviderResponseTooLarge) {
+					t.Fatalf("err = %v, want ErrProviderResponseTooLarge", err)
+				}
+				if body != nil {
+					t.Errorf("returned %d bytes of an oversized body", len(body))
+				}
+				if got := ToAPIError(err).Code; got != ErrCodeUpstream {
+					t.Errorf("error code = %q, want %q", got, ErrCodeUpstream)
+				}
+				return
+			}
+			if err != nil || status != http.StatusOK || len(body) != tt.size {
+				t.Errorf("got %d, %d bytes, %v; want 200 with %d bytes", status, len(body), err, tt.size)
+			}
+		})
+	}
+}
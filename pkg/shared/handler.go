@@ -0,0 +1,387 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// =============================================================================
+// Extraction Handlers
+// =============================================================================
+
+// ExtractionContext carries a request through the steps every extraction
+// handler shares: admission, the rate-limit check and the charge. Its
+// methods write the error response themselves and report false when the
+// handler should stop.
+//
+//	ec, ok := shared.BeginExtraction(w, r)
+//	defer ec.End()
+//	if !ok {
+//		return
+//	}
+type ExtractionContext struct {
+	W        http.ResponseWriter
+	R        *http.Request
+	Ctx      context.Context
+	Config   *Config
+	Store    RateLimitStore
+	ClientIP string
+
+	// Cost is what Admit checked the rate limit for. The counts are the
+	// client's and global counts for today, including Cost once Charge has
+	// consumed it.
+	Cost        int64
+	ClientCount int64
+	GlobalCount int64
+
+	// checked is set once the rate limit has been consulted, and countsKnown
+	// when that produced counts worth reporting
+	checked     bool
+	countsKnown bool
+
+	cleanup []func()
+}
+
+// BeginExtraction starts the access log and request span, then admits a POST
+// to an extraction endpoint: the server configuration, the request deadline,
+// the rate-limit store and maintenance mode. The returned context is never
+// nil and must be ended, whether or not the request was admitted.
+func BeginExtraction(w http.ResponseWriter, r *http.Request) (*ExtractionContext, bool) {
+	w, done := StartAccessLog(w, r)
+	w, r, endSpan := StartRequestSpan(w, r)
+	ec := &ExtractionContext{W: w, R: r, Ctx: r.Context(), cleanup: []func(){done, endSpan}}
+
+	if !RequireMethod(w, r, http.MethodPost) {
+		return ec, false
+	}
+	if err := CheckServerConfig(); err != nil {
+		WriteError(w, r, NewAPIError(ErrCodeServerConfig, "Server configuration error", err))
+		return ec, false
+	}
+	ec.Config = GetConfig()
+	ec.ClientIP = GetClientIP(r)
+
+	ctx, cancel := context.WithTimeout(r.Context(), ec.Config.RequestTimeout)
+	ec.Ctx = ctx
+	ec.onEnd(cancel)
+
+	store, err := GetRateLimitStore()
+	if err != nil {
+		WriteError(w, r, fmt.Errorf("rate limit store initialization: %w", err))
+		return ec, false
+	}
+	ec.Store = store
+	if err := CheckMaintenance(ctx, store); err != nil {
+		WriteError(w, r, err)
+		return ec, false
+	}
+	return ec, true
+}
+
+// End releases the request slot, cancels the deadline and closes the span and
+// access log, in that order
+func (ec *ExtractionContext) End() {
+	for i := len(ec.cleanup) - 1; i >= 0; i-- {
+		ec.cleanup[i]()
+	}
+	ec.cleanup = nil
+}
+
+// onEnd registers fn to run when the request ends
+func (ec *ExtractionContext) onEnd(fn func()) {
+	ec.cleanup = append(ec.cleanup, fn)
+}
+
+// Fail writes err with headers showing the client's unchanged quota. Before
+// the rate-limit check the counts are looked up for the purpose.
+func (ec *ExtractionContext) Fail(err error) {
+	if !ec.checked && ec.Store != nil {
+		if clientCount, globalCount, lookupErr := GetRateLimitCounts(ec.Ctx, ec.Store, ec.ClientIP); lookupErr != nil {
+			log.Printf("Rate limit lookup error: %v", lookupErr)
+		} else {
+			ec.ClientCount, ec.GlobalCount, ec.countsKnown = clientCount, globalCount, true
+		}
+		ec.checked = true
+	}
+	if ec.countsKnown {
+		SetRateLimitHeaders(ec.W, ec.ClientCount, ec.GlobalCount)
+	}
+	WriteError(ec.W, ec.R, err)
+}
+
+// Decode decodes the JSON request body into v
+func (ec *ExtractionContext) Decode(v any) bool {
+	if err := DecodeRequestBody(ec.R, v); err != nil {
+		ec.Fail(err)
+		return false
+	}
+	return true
+}
+
+// Prepare normalizes and validates req, rejecting it as a bad request
+func (ec *ExtractionContext) Prepare(req interface{ Prepare() error }) bool {
+	if err := req.Prepare(); err != nil {
+		ec.Fail(NewAPIError(ErrCodeBadRequest, err.Error(), nil))
+		return false
+	}
+	return true
+}
+
+// CheckContent applies the content policy to each piece of prepared content
+// that reaches the prompt
+func (ec *ExtractionContext) CheckContent(contents ...string) bool {
+	for _, content := range contents {
+		if err := CheckContentPolicy(content); err != nil {
+			ec.Fail(err)
+			return false
+		}
+	}
+	return true
+}
+
+// Admit checks the rate limit for a request of the given cost, then takes a
+// slot with AcquireSlot. From here on the quota headers carry the pre-charge
+// counts.
+func (ec *ExtractionContext) Admit(cost int64) bool {
+	ec.Cost = cost
+	allowed, err := ec.checkRateLimit(cost)
+	if err != nil {
+		ec.Fail(fmt.Errorf("rate limit check: %w", err))
+		return false
+	}
+	if !allowed {
+		ec.Fail(RateLimitExceededError(ec.ClientCount, cost))
+		return false
+	}
+	SetRateLimitHeaders(ec.W, ec.ClientCount, ec.GlobalCount)
+	return ec.AcquireSlot()
+}
+
+// checkRateLimit runs CheckRateLimit, keeping the counts it reports. A failed
+// check carries no counts, except for a burst rejection.
+func (ec *ExtractionContext) checkRateLimit(cost int64) (bool, error) {
+	allowed, clientCount, globalCount, err := CheckRateLimit(ec.Ctx, ec.Store, ec.ClientIP, cost)
+	ec.checked = true
+	var apiErr *APIError
+	if err == nil || errors.As(err, &apiErr) {
+		ec.ClientCount, ec.GlobalCount, ec.countsKnown = clientCount, globalCount, true
+	}
+	return allowed, err
+}
+
+// AcquireSlot enforces MinRequestInterval and takes one of the client's
+// concurrent request slots, which End releases
+func (ec *ExtractionContext) AcquireSlot() bool {
+	if err := CheckCooldown(ec.Ctx, ec.Store, ec.ClientIP); err != nil {
+		ec.Fail(err)
+		return false
+	}
+	release, err := AcquireRequestSlot(ec.Ctx, ec.Store, ec.ClientIP)
+	if err != nil {
+		ec.Fail(err)
+		return false
+	}
+	ec.onEnd(release)
+	return true
+}
+
+// Finished fails a request whose operation returned err, or that ran out of
+// budget before it could be charged, reporting whether the handler can go on
+// to charge and write the result
+func (ec *ExtractionContext) Finished(err error) bool {
+	if err == nil {
+		err = ec.Ctx.Err()
+	}
+	if err != nil {
+		ec.Fail(err)
+		return false
+	}
+	return true
+}
+
+// Charge consumes Cost for a result that should be charged, adding it to the
+// counts. The increment is detached from the deadline so a successful
+// response is never left uncharged or half-counted. It reports whether
+// anything was consumed, which is not the case when the increment fails.
+func (ec *ExtractionContext) Charge(result interface{ ConsumesQuota() bool }) bool {
+	if !result.ConsumesQuota() {
+		return false
+	}
+	if err := IncrementRateLimit(context.WithoutCancel(ec.Ctx), ec.Store, ec.ClientIP, ec.Cost); err != nil {
+		log.Printf("Failed to increment rate limit: %v", err)
+		return false
+	}
+	ec.ClientCount += ec.Cost
+	ec.GlobalCount += ec.Cost
+	return true
+}
+
+// WriteResult writes v as the JSON response with the current quota headers,
+// recording its card count. The headers are left out when no rate-limit check
+// produced counts, as when every note of a batch was rejected before one.
+func (ec *ExtractionContext) WriteResult(v any, cards int) {
+	if ec.countsKnown {
+		SetRateLimitHeaders(ec.W, ec.ClientCount, ec.GlobalCount)
+	}
+	RecordCardCount(ec.W, cards)
+	WriteJSON(ec.W, ec.R, http.StatusOK, v)
+}
+
+// ExtractWithCache extracts a prepared single-note request and writes the
+// result in the negotiated format. Cached results are served without calling
+// the provider or consuming quota, including to clients that are otherwise
+// rate limited. A nil client disables the cache.
+func (ec *ExtractionContext) ExtractWithCache(client *redis.Client, req AIExtractionRequest, minimal bool) {
+	cacheKey := ExtractionCacheKey(&req)
+	etag := ETagForKey(cacheKey, ResponseRepresentation(ec.R, minimal))
+	ec.W.Header().Set("ETag", etag)
+	if ec.serveCached(client, cacheKey, etag, minimal) {
+		return
+	}
+
+	if !ec.Admit(RequestCost(&req)) {
+		return
+	}
+	extraction, err := ExtractCards(ec.Ctx, req)
+	// Nothing has been charged yet, so a request that ran out of budget fails
+	// cleanly without consuming a slot
+	if !ec.Finished(err) {
+		return
+	}
+
+	// Only charge once the extraction has been validated as usable
+	if err := StoreCachedExtraction(context.WithoutCancel(ec.Ctx), client, cacheKey, extraction); err != nil {
+		log.Printf("Failed to cache extraction: %v", err)
+	}
+	ec.Charge(extraction)
+	ec.writeExtraction(extraction, minimal, ec.ClientCount, ec.GlobalCount)
+}
+
+// serveCached writes a cached extraction, or a 304 when the client already
+// has its representation (see NotModified). It reports whether a response was
+// written.
+func (ec *ExtractionContext) serveCached(client *redis.Client, cacheKey, etag string, minimal bool) bool {
+	cached, ok, err := GetCachedExtraction(ec.Ctx, client, cacheKey)
+	if err != nil {
+		log.Printf("Cache lookup error: %v", err)
+		return false
+	}
+	if !ok {
+		return false
+	}
+
+	if NotModified(ec.R, etag) {
+		ec.W.WriteHeader(http.StatusNotModified)
+		return true
+	}
+
+	clientCount, globalCount, err := GetRateLimitCounts(ec.Ctx, ec.Store, ec.ClientIP)
+	if err != nil {
+		log.Printf("Rate limit lookup error: %v", err)
+	}
+	ec.W.Header().Set("X-Cache", "HIT")
+	ec.writeExtraction(cached, minimal, clientCount, globalCount)
+	return true
+}
+
+// writeExtraction writes the extraction with quota headers. The counts must
+// already include this request if it was charged.
+func (ec *ExtractionContext) writeExtraction(extraction *AIExtractionResponse, minimal bool, clientCount, globalCount int64) {
+	w, r := ec.W, ec.R
+	SetRateLimitHeaders(w, clientCount, globalCount)
+	clientRemaining := ClientRemaining(clientCount)
+
+	if extraction.CardsTruncated {
+		w.Header().Set("X-Cards-Truncated", "true")
+	}
+
+	if clientRemaining <= ec.Config.RateLimitWarningThreshold {
+		extraction.Warning = fmt.Sprintf("Only %d request(s) remaining today.", clientRemaining)
+		SetRateLimitWarningHeader(w)
+	}
+
+	RecordCardCount(w, len(extraction.Cards))
+	w.Header().Add("Vary", "Accept")
+	switch NegotiateResponseFormat(r) {
+	case ResponseFormatCSV:
+		WriteCardsCSV(w, http.StatusOK, extraction.Cards)
+		return
+	case ResponseFormatAnki:
+		WriteCardsAnki(w, http.StatusOK, extraction.Cards)
+		return
+	}
+	if minimal {
+		WriteJSON(w, r, http.StatusOK, extraction.Minimal())
+		return
+	}
+	WriteJSON(w, r, http.StatusOK, extraction)
+}
+
+// ExtractBatch extracts each note in order, gating each one by the rate limit
+// on its own so a client with fewer remaining slots than notes gets the first
+// notes extracted and the rest reported as rate_limited. Each successfully
+// extracted note is charged on its own. The caller holds the request slot.
+func (ec *ExtractionContext) ExtractBatch(notes []AIExtractionRequest) (BatchExtractionResponse, int) {
+	resp := BatchExtractionResponse{Items: make([]BatchItemResult, len(notes))}
+	var cards int
+
+	for i, note := range notes {
+		item := BatchItemResult{Index: i}
+		fail := func(status string, apiErr *APIError) {
+			item.Status, item.Error, item.Code = status, Localize(ec.R, apiErr.Message), apiErr.Code
+		}
+
+		// Policy and cost apply to the normalized content, as for a single
+		// note
+		err := note.Prepare()
+		if err != nil {
+			err = NewAPIError(ErrCodeBadRequest, err.Error(), nil)
+		} else {
+			err = CheckContentPolicy(note.Content)
+		}
+		if err != nil {
+			fail(BatchItemError, ToAPIError(err))
+			resp.Failed++
+			resp.Items[i] = item
+			continue
+		}
+
+		ec.Cost = RequestCost(&note)
+		allowed, err := ec.checkRateLimit(ec.Cost)
+		switch {
+		case err != nil:
+			apiErr := ToAPIError(fmt.Errorf("rate limit check: %w", err))
+			status := BatchItemError
+			if apiErr.Code == ErrCodeBurstLimited {
+				status = BatchItemRateLimited
+			}
+			fail(status, apiErr)
+		case !allowed:
+			fail(BatchItemRateLimited, RateLimitExceededError(ec.ClientCount, ec.Cost))
+		default:
+			result, err := ExtractCards(ec.Ctx, note)
+			if err != nil {
+				apiErr := ToAPIError(err)
+				log.Printf("Batch item %d failed: %v", i, apiErr)
+				fail(BatchItemError, apiErr)
+				break
+			}
+			ec.Charge(result)
+			item.Status, item.Result = BatchItemOK, result
+			cards += len(result.Cards)
+		}
+
+		if item.Status == BatchItemOK {
+			resp.Succeeded++
+		} else {
+			resp.Failed++
+		}
+		resp.Items[i] = item
+	}
+	return resp, cards
+}
@@ -0,0 +1,572 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// failingIncrementStore is an InMemoryStore whose counters can't be
+// incremented
+type failingIncrementStore struct {
+	*InMemoryStore
+}
+
+func (s failingIncrementStore) Increment(ctx context.Context, ttl time.Duration, by int64, keys ...string) error {
+	return errors.New("increment failed")
+}
+
+// beginExtraction admits a POST to /api/ai-extraction carrying body
+func beginExtraction(t *testing.T, body string) (*ExtractionContext, *httptest.ResponseRecorder) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/api/ai-extraction", strings.NewReader(body))
+	r.RemoteAddr = "203.0.113.50:1234"
+	ec, ok := BeginExtraction(rec, r)
+	t.Cleanup(ec.End)
+	if !ok {
+		t.Fatalf("BeginExtraction rejected the request: %d %s", rec.Code, rec.Body)
+	}
+	return ec, rec
+}
+
+func TestBeginExtractionRequiresPost(t *testing.T) {
+	useConfig(t, nil)
+	useMemoryStore(t)
+	rec := httptest.NewRecorder()
+	ec, ok := BeginExtraction(rec, httptest.NewRequest(http.MethodGet, "/api/ai-extraction", nil))
+	defer ec.End()
+	if ok {
+		t.Fatal("BeginExtraction admitted a GET")
+	}
+	if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != http.MethodPost {
+		t.Errorf("got %d with Allow %q, want 405 allowing POST", rec.Code, rec.Header().Get("Allow"))
+	}
+}
+
+func TestExtractionChargesOnlyOnSuccess(t *testing.T) {
+	tests := []struct {
+		name       string
+		handler    http.HandlerFunc
+		wantStatus int
+		wantCount  int64
+	}{
+		{"extracted", serveCards("Interfaces are satisfied implicitly."), http.StatusOK, 2},
+		{"provider error", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusBadGateway) }, http.StatusBadGateway, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := useConfig(t, func(c *Config) { c.ClientRateLimitPerDay = 5 })
+			store := useMemoryStore(t)
+			fakeProvider(t, cfg, tt.handler)
+
+			ec, rec := beginExtraction(t, `{"content": "Charging note for `+tt.name+`"}`)
+			var req AIExtractionRequest
+			if !ec.Decode(&req) || !ec.Prepare(&req) || !ec.CheckContent(req.Content) || !ec.Admit(2) {
+				t.Fatalf("request rejected: %d %s", rec.Code, rec.Body)
+			}
+			result, err := ExtractCards(ec.Ctx, req)
+			if ec.Finished(err) {
+				ec.Charge(result)
+				ec.WriteResult(result, len(result.Cards))
+			}
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			counts, _ := store.Get(context.Background(), clientRateLimitKey(ec.ClientIP, getTodayKey()))
+			if counts[0] != tt.wantCount {
+				t.Errorf("client count = %d, want %d", counts[0], tt.wantCount)
+			}
+			want := "5"
+			if tt.wantCount > 0 {
+				want = "3"
+			}
+			if got := rec.Header().Get("X-RateLimit-Client-Remaining"); got != want {
+				t.Errorf("X-RateLimit-Client-Remaining = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestChargeReportsFailedIncrement(t *testing.T) {
+	useConfig(t, nil)
+	store := useMemoryStore(t)
+	rateLimitStore = failingIncrementStore{store}
+
+	ec, _ := beginExtraction(t, `{}`)
+	if !ec.Admit(1) {
+		t.Fatal("Admit rejected the request")
+	}
+	if ec.Charge(&AIExtractionResponse{Cards: []Card{{Content: "A card"}}}) {
+		t.Error("Charge reported a charge when the increment failed")
+	}
+	if ec.ClientCount != 0 || ec.GlobalCount != 0 {
+		t.Errorf("counts = %d/%d, want them unchanged", ec.ClientCount, ec.GlobalCount)
+	}
+}
+
+func TestChargeSkipsUnchargedResults(t *testing.T) {
+	useConfig(t, nil)
+	useMemoryStore(t)
+
+	ec, _ := beginExtraction(t, `{}`)
+	if !ec.Admit(1) {
+		t.Fatal("Admit rejected the request")
+	}
+	card := []Card{{Content: "A card"}}
+	for name, result := range map[string]*AIExtractionResponse{
+		"no cards":  {},
+		"coalesced": {Cards: card, Coalesced: true},
+		"degraded":  {Cards: card, Degraded: true},
+	} {
+		if ec.Charge(result) {
+			t.Errorf("%s: charged", name)
+		}
+	}
+}
+
+func TestFailReportsUnchangedQuota(t *testing.T) {
+	useConfig(t, func(c *Config) { c.ClientRateLimitPerDay = 10 })
+	store := useMemoryStore(t)
+
+	ec, rec := beginExtraction(t, `not json`)
+	store.Increment(context.Background(), RateLimitTTL, 4, clientRateLimitKey(ec.ClientIP, getTodayKey()))
+	var req AIExtractionRequest
+	if ec.Decode(&req) {
+		t.Fatal("Decode accepted an invalid body")
+	}
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", rec.Code)
+	}
+	if got := rec.Header().Get("X-RateLimit-Client-Remaining"); got != "6" {
+		t.Errorf("X-RateLimit-Client-Remaining = %q, want 6", got)
+	}
+}
+
+func TestExtractBatch(t *testing.T) {
+	cfg := useConfig(t, func(c *Config) { c.ClientRateLimitPerDay = 2 })
+	store := useMemoryStore(t)
+	fakeProvider(t, cfg, serveCards("Slices share their backing array."))
+
+	ec, rec := beginExtraction(t, `{}`)
+	notes := []AIExtractionRequest{
+		{Content: "First batch note"},
+		{Content: "   "},
+		{Content: "Second batch note"},
+		{Content: "Third batch note"},
+	}
+	if !ec.AcquireSlot() {
+		t.Fatal("AcquireSlot rejected the batch")
+	}
+	resp, cards := ec.ExtractBatch(notes)
+	ec.WriteResult(resp, cards)
+
+	want := []string{BatchItemOK, BatchItemError, BatchItemOK, BatchItemRateLimited}
+	for i, item := range resp.Items {
+		if item.Status != want[i] {
+			t.Errorf("item %d status = %q, want %q", i, item.Status, want[i])
+		}
+	}
+	if resp.Succeeded != 2 || resp.Failed != 2 || cards != 2 {
+		t.Errorf("succeeded %d, failed %d, cards %d; want 2, 2, 2", resp.Succeeded, resp.Failed, cards)
+	}
+	counts, _ := store.Get(context.Background(), clientRateLimitKey(ec.ClientIP, getTodayKey()))
+	if counts[0] != 2 {
+		t.Errorf("client count = %d, want 2", counts[0])
+	}
+
+	var body BatchExtractionResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || len(body.Items) != 4 {
+		t.Errorf("response body = %s (%v)", rec.Body, err)
+	}
+	if got := rec.Header().Get("X-RateLimit-Client-Remaining"); got != "0" {
+		t.Errorf("X-RateLimit-Client-Remaining = %q, want 0", got)
+	}
+}
+
+func TestExtractBatchWithoutCountsSendsNoQuotaHeaders(t *testing.T) {
+	useConfig(t, nil)
+	useMemoryStore(t)
+
+	ec, rec := beginExtraction(t, `{}`)
+	resp, cards := ec.ExtractBatch([]AIExtractionRequest{{Content: ""}})
+	ec.WriteResult(resp, cards)
+	if resp.Failed != 1 {
+		t.Errorf("failed = %d, want 1", resp.Failed)
+	}
+	if got := rec.Header().Get("X-RateLimit-Client-Remaining"); got != "" {
+		t.Errorf("X-RateLimit-Client-Remaining = %q, want none without a rate-limit check", got)
+	}
+}
+
+func TestUnusableExtractionIsNotCharged(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     []byte
+		wantErr  error
+		wantCode string
+	}{
+		{"empty body", nil, ErrEmptyExtraction, ErrCodeEmptyExtraction},
+		{"empty text", providerResponse(""), ErrEmptyExtraction, ErrCodeEmptyExtraction},
+		{"no cards", providerResponse(`{"cards": []}`), ErrEmptyExtraction, ErrCodeEmptyExtraction},
+		{"unparseable", providerResponse("Sorry, I can't help with that."), ErrInvalidExtraction, ErrCodeInvalidExtraction},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := useConfig(t, nil)
+			store := useMemoryStore(t)
+			fakeProvider(t, cfg, func(w http.ResponseWriter, r *http.Request) { w.Write(tt.body) })
+
+			ec, rec := beginExtraction(t, `{}`)
+			if !ec.Admit(1) {
+				t.Fatal("Admit rejected the request")
+			}
+			result, err := ExtractCards(ec.Ctx, AIExtractionRequest{Content: "Unusable note " + tt.name})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if ec.Finished(err) {
+				ec.Charge(result)
+			}
+			if ToAPIError(err).Code != tt.wantCode {
+				t.Errorf("code = %q, want %q", ToAPIError(err).Code, tt.wantCode)
+			}
+			counts, _ := store.Get(context.Background(), clientRateLimitKey(ec.ClientIP, getTodayKey()), globalRateLimitKey(getTodayKey()))
+			if counts[0] != 0 || counts[1] != 0 {
+				t.Errorf("counts = %v, want nothing charged", counts)
+			}
+			if rec.Code < 400 {
+				t.Errorf("status = %d, want an error", rec.Code)
+			}
+		})
+	}
+}
+
+func TestExtractBatchQuotaRunsOutMidBatch(t *testing.T) {
+	cfg := useConfig(t, func(c *Config) {
+		c.ClientRateLimitPerDay = 2
+		c.LongContentChars = 40
+		c.LongContentCost = 2
+	})
+	store := useMemoryStore(t)
+	fakeProvider(t, cfg, serveCards("Contexts carry deadlines."))
+
+	ec, _ := beginExtraction(t, `{}`)
+	resp, _ := ec.ExtractBatch([]AIExtractionRequest{
+		{Content: "Short note one"},
+		{Content: "A long note that costs two slots because of its length"},
+		{Content: "Short note two"},
+		{Content: "Short note three"},
+	})
+
+	// The long note can't fit in the single remaining slot, but the next
+	// short one still can
+	want := []string{BatchItemOK, BatchItemRateLimited, BatchItemOK, BatchItemRateLimited}
+	for i, item := range resp.Items {
+		if item.Status != want[i] {
+			t.Errorf("item %d status = %q, want %q", i, item.Status, want[i])
+		}
+	}
+	if resp.Items[1].Code != ErrCodeRateLimited {
+		t.Errorf("item 1 code = %q, want %q", resp.Items[1].Code, ErrCodeRateLimited)
+	}
+	counts, _ := store.Get(context.Background(), clientRateLimitKey(ec.ClientIP, getTodayKey()))
+	if counts[0] != 2 || ec.ClientCount != 2 {
+		t.Errorf("client count = %d (context %d), want 2", counts[0], ec.ClientCount)
+	}
+}
+
+func TestTimedOutExtractionIsNotCharged(t *testing.T) {
+	cfg := useConfig(t, func(c *Config) {
+		c.ClientRateLimitPerDay = 5
+		c.RequestTimeout = 100 * time.Millisecond
+	})
+	store := useMemoryStore(t)
+	stall := make(chan struct{})
+	fakeProvider(t, cfg, func(w http.ResponseWriter, r *http.Request) {
+		<-stall
+	})
+	t.Cleanup(func() { close(stall) })
+
+	ec, rec := beginExtraction(t, `{"content": "Timed out note"}`)
+	var req AIExtractionRequest
+	if !ec.Decode(&req) || !ec.Prepare(&req) || !ec.Admit(1) {
+		t.Fatalf("request rejected: %d %s", rec.Code, rec.Body)
+	}
+	result, err := ExtractCards(ec.Ctx, req)
+	if ec.Finished(err) {
+		ec.Charge(result)
+		ec.WriteResult(result, len(result.Cards))
+	}
+
+	var body ErrorResponse
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	if rec.Code != http.StatusGatewayTimeout || body.Code != ErrCodeTimeout {
+		t.Errorf("got %d %q, want 504 %q", rec.Code, body.Code, ErrCodeTimeout)
+	}
+	if counts, _ := store.Get(context.Background(), clientRateLimitKey(ec.ClientIP, getTodayKey())); counts[0] != 0 {
+		t.Errorf("client count = %d, want a timed-out request uncharged", counts[0])
+	}
+	if got := rec.Header().Get("X-RateLimit-Client-Remaining"); got != "5" {
+		t.Errorf("X-RateLimit-Client-Remaining = %q, want 5", got)
+	}
+}
+
+func TestModelCostEnforcesQuota(t *testing.T) {
+	tests := []struct {
+		name       string
+		model      string
+		used       int64
+		wantStatus int
+		wantCount  int64
+	}{
+		{"default model", "", 3, http.StatusOK, 4},
+		{"premium model fits", "gemini-2.5-pro", 2, http.StatusOK, 5},
+		{"premium model over the remaining quota", "gemini-2.5-pro", 3, http.StatusTooManyRequests, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := useConfig(t, func(c *Config) {
+				c.ClientRateLimitPerDay = 5
+				c.ModelCosts = map[string]int64{"gemini-2.5-pro": 3}
+			})
+			store := useMemoryStore(t)
+			fakeProvider(t, cfg, serveCards("Premium models cost more."))
+			if err := IncrementRateLimit(context.Background(), store, "203.0.113.50", tt.used); err != nil {
+				t.Fatalf("IncrementRateLimit: %v", err)
+			}
+
+			ec, rec := beginExtraction(t, `{"content": "Model cost note", "model": "`+tt.model+`"}`)
+			var req AIExtractionRequest
+			if ec.Decode(&req) && ec.Prepare(&req) && ec.Admit(RequestCost(&req)) {
+				result, err := ExtractCards(ec.Ctx, req)
+				if ec.Finished(err) {
+					ec.Charge(result)
+					ec.WriteResult(result, len(result.Cards))
+				}
+			}
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if clientCount, _, _ := GetRateLimitCounts(context.Background(), store, "203.0.113.50"); clientCount != tt.wantCount {
+				t.Errorf("client count = %d, want %d", clientCount, tt.wantCount)
+			}
+		})
+	}
+}
+
+func TestExposeRateLimitHeaders(t *testing.T) {
+	headers := []string{
+		"X-RateLimit-Client-Limit", "X-RateLimit-Client-Remaining",
+		"X-RateLimit-Global-Limit", "X-RateLimit-Global-Remaining",
+		"X-RateLimit-Warning", "X-Global-Quota-Low",
+	}
+	tests := []struct {
+		name       string
+		expose     bool
+		used       int64
+		wantStatus int
+	}{
+		{"exposed", true, 4, http.StatusOK},
+		{"exposed when rejected", true, 5, http.StatusTooManyRequests},
+		{"hidden", false, 4, http.StatusOK},
+		{"hidden but still enforced", false, 5, http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := useConfig(t, func(c *Config) {
+				c.ExposeRateLimitHeaders = tt.expose
+				c.ClientRateLimitPerDay, c.GlobalRateLimitPerDay = 5, 5
+			})
+			store := useMemoryStore(t)
+			fakeProvider(t, cfg, serveCards("Headers follow the flag."))
+			if err := IncrementRateLimit(context.Background(), store, "203.0.113.50", tt.used); err != nil {
+				t.Fatalf("IncrementRateLimit: %v", err)
+			}
+
+			ec, rec := beginExtraction(t, `{"content": "Header note"}`)
+			var req AIExtractionRequest
+			if ec.Decode(&req) && ec.Prepare(&req) && ec.Admit(1) {
+				result, err := ExtractCards(ec.Ctx, req)
+				if ec.Finished(err) {
+					ec.Charge(result)
+					if ClientRemaining(ec.ClientCount) <= cfg.RateLimitWarningThreshold {
+						SetRateLimitWarningHeader(ec.W)
+					}
+					ec.WriteResult(result, len(result.Cards))
+				}
+			}
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			for _, header := range headers {
+				// The warning only accompanies a successful response
+				want := tt.expose && (header != "X-RateLimit-Warning" || tt.wantStatus == http.StatusOK)
+				if got := rec.Header().Get(header) != ""; got != want {
+					t.Errorf("%s present = %v, want %v", header, got, want)
+				}
+			}
+		})
+	}
+}
+
+// serveExtraction runs a POST to /api/ai-extraction carrying body through the
+// extraction handler's steps, with cache as its cache client
+func serveExtraction(t *testing.T, cache *redis.Client, body string, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/api/ai-extraction", strings.NewReader(body))
+	r.RemoteAddr = "203.0.113.50:1234"
+	maps.Copy(r.Header, header)
+	ec, ok := BeginExtraction(rec, r)
+	defer ec.End()
+	if !ok {
+		return rec
+	}
+	var req AIExtractionRequest
+	if ec.Decode(&req) && ec.Prepare(&req) && ec.CheckContent(req.Content) {
+		ec.ExtractWithCache(cache, req, req.Minimal)
+	}
+	return rec
+}
+
+func TestCachedExtractionNotModified(t *testing.T) {
+	cfg := useConfig(t, nil)
+	store := useMemoryStore(t)
+	_, cache := newFakeRedis(t, nil)
+	var calls atomic.Int32
+	serve := serveCards("Goroutines are cheap to start.")
+	fakeProvider(t, cfg, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		serve(w, r)
+	})
+	const body = `{"content": "Conditional note"}`
+
+	first := serveExtraction(t, cache, body, nil)
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" {
+		t.Fatalf("first request = %d with ETag %q, want 200 with an ETag", first.Code, etag)
+	}
+
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		wantStatus  int
+	}{
+		{"matching ETag", etag, http.StatusNotModified},
+		{"stale ETag", `"stale.json"`, http.StatusOK},
+		{"no ETag", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.ifNoneMatch != "" {
+				header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			rec := serveExtraction(t, cache, body, header)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusNotModified && rec.Body.Len() != 0 {
+				t.Errorf("304 carried a body: %s", rec.Body)
+			}
+			if tt.wantStatus == http.StatusOK && rec.Header().Get("X-Cache") != "HIT" {
+				t.Error("repeat request was not served from the cache")
+			}
+			if got := calls.Load(); got != 1 {
+				t.Errorf("provider calls = %d, want 1", got)
+			}
+			if clientCount, _, _ := GetRateLimitCounts(context.Background(), store, "203.0.113.50"); clientCount != 1 {
+				t.Errorf("client count = %d, want only the first request charged", clientCount)
+			}
+		})
+	}
+}
+
+func TestCachedExtractionKeepsCardsTruncated(t *testing.T) {
+	tests := []struct {
+		name  string
+		cards int
+		want  string
+	}{
+		{"truncated", 3, "true"},
+		{"within the cap", 2, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := useConfig(t, func(c *Config) { c.MaxCards = 2 })
+			useMemoryStore(t)
+			_, cache := newFakeRedis(t, nil)
+			contents := []string{"Goroutines are cheap.", "Channels synchronize.", "Defer runs last."}
+			fakeProvider(t, cfg, serveCards(contents[:tt.cards]...))
+			body := `{"content": "Truncation note ` + tt.name + `"}`
+
+			for _, want := range []string{"", "HIT"} {
+				rec := serveExtraction(t, cache, body, nil)
+				if rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != want {
+					t.Fatalf("got %d with X-Cache %q, want 200 with %q", rec.Code, rec.Header().Get("X-Cache"), want)
+				}
+				if got := rec.Header().Get("X-Cards-Truncated"); got != tt.want {
+					t.Errorf("X-Cache %q: X-Cards-Truncated = %q, want %q", want, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRegenerateChecksCardContentPolicy(t *testing.T) {
+	t.Setenv("CONTENT_DENYLIST", "forbidden-term")
+	tests := []struct {
+		name       string
+		card       string
+		wantStatus int
+	}{
+		{"allowed card", "Goroutines are cheap.", http.StatusOK},
+		{"denied card", "A card quoting a forbidden-term", http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := useConfig(t, nil)
+			store := useMemoryStore(t)
+			var calls atomic.Int32
+			serve := serveCards("An alternative card.")
+			fakeProvider(t, cfg, func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				serve(w, r)
+			})
+
+			body, _ := json.Marshal(map[string]string{"content": "An allowed note", "card_content": tt.card})
+			ec, rec := beginExtraction(t, string(body))
+			var req RegenerateCardRequest
+			if ec.Decode(&req) && ec.Prepare(&req) && ec.CheckContent(req.Content, req.CardContent) && ec.Admit(ModelCost(req.Model)) {
+				result, err := RegenerateCard(ec.Ctx, req)
+				if ec.Finished(err) {
+					ec.Charge(result)
+					ec.WriteResult(result, 1)
+				}
+			}
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if denied := tt.wantStatus != http.StatusOK; denied && (calls.Load() != 0 || !strings.Contains(rec.Body.String(), ErrCodePolicyViolation)) {
+				t.Errorf("denied card reached the provider (%d calls) or was not a policy violation: %s", calls.Load(), rec.Body)
+			}
+			if clientCount, _, _ := GetRateLimitCounts(context.Background(), store, "203.0.113.50"); clientCount != int64(calls.Load()) {
+				t.Errorf("client count = %d, want %d", clientCount, calls.Load())
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package shared
+
+import (
+	"embed"
+	"encoding/json"
+	"log"
+	"maps"
+	"net/http"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/text/language"
+)
+
+// =============================================================================
+// Localized Messages
+// =============================================================================
+
+// messageCatalogs holds one JSON file per language mapping each English
+// message, exactly as formatted in code (with its %s/%d/%q/%v verbs), to a
+// translation where {1}, {2}, ... stand for the formatted arguments in order
+//
+//go:embed messages/*.json
+var messageCatalogs embed.FS
+
+// supportedLanguages lists the message languages, English (the source
+// language) first so it is the fallback
+var supportedLanguages = []language.Tag{language.English, language.Spanish, language.French}
+
+var languageMatcher = language.NewMatcher(supportedLanguages)
+
+// catalogEntry matches one English message and renders its translation
+type catalogEntry struct {
+	pattern     *regexp.Regexp
+	translation string
+}
+
+var (
+	catalogs     map[string][]catalogEntry
+	catalogsOnce sync.Once
+)
+
+// formatVerbPattern matches the fmt verbs used in catalog keys once the key
+// has been regexp-quoted
+var formatVerbPattern = regexp.MustCompile(`%[sdqv]`)
+
+// loadCatalogs compiles every embedded catalog once. A malformed catalog is
+// logged and skipped so messages fall back to English.
+func loadCatalogs() map[string][]catalogEntry {
+	catalogsOnce.Do(func() {
+		catalogs = make(map[string][]catalogEntry)
+		files, _ := messageCatalogs.ReadDir("messages")
+		for _, file := range files {
+			data, err := messageCatalogs.ReadFile(path.Join("messages", file.Name()))
+			if err != nil {
+				log.Printf("Failed to read message catalog %s: %v", file.Name(), err)
+				continue
+			}
+			var messages map[string]string
+			if err := json.Unmarshal(data, &messages); err != nil {
+				log.Printf("Failed to parse message catalog %s: %v", file.Name(), err)
+				continue
+			}
+
+			// Longest keys first, so the most specific pattern wins
+			keys := slices.Collect(maps.Keys(messages))
+			slices.SortFunc(keys, func(a, b string) int { return len(b) - len(a) })
+
+			entries := make([]catalogEntry, 0, len(messages))
+			for _, english := range keys {
+				translation := messages[english]
+				pattern := formatVerbPattern.ReplaceAllString(regexp.QuoteMeta(english), "(.+?)")
+				entries = append(entries, catalogEntry{
+					pattern:     regexp.MustCompile("(?s)^" + pattern + "$"),
+					translation: translation,
+				})
+			}
+			catalogs[strings.TrimSuffix(file.Name(), ".json")] = entries
+		}
+	})
+	return catalogs
+}
+
+// RequestLanguage returns the best supported message language for r's
+// Accept-Language header, defaulting to English
+func RequestLanguage(r *http.Request) string {
+	tags, _, _ := language.ParseAcceptLanguage(r.Header.Get("Accept-Language"))
+	_, index, _ := languageMatcher.Match(tags...)
+	base, _ := supportedLanguages[index].Base()
+	return base.String()
+}
+
+// Localize translates a client-facing message into r's preferred language.
+// Messages without a translation are returned unchanged.
+func Localize(r *http.Request, message string) string {
+	return Translate(RequestLanguage(r), message)
+}
+
+// Translate translates message into lang, copying the values substituted
+// into the English message into the translation's placeholders
+func Translate(lang, message string) string {
+	for _, entry := range loadCatalogs()[lang] {
+		args := entry.pattern.FindStringSubmatch(message)
+		if args == nil {
+			continue
+		}
+		pairs := make([]string, 0, 2*(len(args)-1))
+		for i, arg := range args[1:] {
+			pairs = append(pairs, "{"+strconv.Itoa(i+1)+"}", arg)
+		}
+		return strings.NewReplacer(pairs...).Replace(entry.translation)
+	}
+	return message
+}
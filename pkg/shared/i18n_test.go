@@ -0,0 +1,89 @@
+package shared
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRequestLanguage(t *testing.T) {
+	tests := []struct {
+		acceptLanguage, want string
+	}{
+		{"", "en"},
+		{"es", "es"},
+		{"fr-CA", "fr"},
+		{"de-DE, fr;q=0.8, en;q=0.5", "fr"},
+		{"en-GB, es;q=0.9", "en"},
+		{"de", "en"},
+		{"ja, zh;q=0.9", "en"},
+		{"not a language", "en"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/api/ai-extraction", nil)
+		r.Header.Set("Accept-Language", tt.acceptLanguage)
+		if got := RequestLanguage(r); got != tt.want {
+			t.Errorf("RequestLanguage(%q) = %q, want %q", tt.acceptLanguage, got, tt.want)
+		}
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	tests := []struct {
+		lang, message, want string
+	}{
+		{"es", "Content is required", "El contenido es obligatorio"},
+		{"fr", "Content is required", "Le contenu est obligatoire"},
+		{"en", "Content is required", "Content is required"},
+		{"de", "Content is required", "Content is required"},
+		{"es", "custom_instructions is too long (612 characters). Maximum is 500", "custom_instructions es demasiado largo (612 caracteres). El máximo es 500"},
+		{"fr", "A message nobody translated", "A message nobody translated"},
+	}
+	for _, tt := range tests {
+		if got := Translate(tt.lang, tt.message); got != tt.want {
+			t.Errorf("Translate(%q, %q) = %q, want %q", tt.lang, tt.message, got, tt.want)
+		}
+	}
+}
+
+func TestWriteErrorLocalizes(t *testing.T) {
+	useConfig(t, nil)
+	for acceptLanguage, want := range map[string]string{"es-MX": "El contenido es obligatorio", "pt-BR": "Content is required"} {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/api/ai-extraction", nil)
+		r.Header.Set("Accept-Language", acceptLanguage)
+		WriteError(rec, r, NewAPIError(ErrCodeBadRequest, "Content is required", nil))
+
+		var body ErrorResponse
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		if body.Error != want || body.Code != ErrCodeBadRequest {
+			t.Errorf("%s: body = %+v, want %q with a stable code", acceptLanguage, body, want)
+		}
+	}
+}
+
+func TestMessageCatalogs(t *testing.T) {
+	files, _ := messageCatalogs.ReadDir("messages")
+	if len(files) != len(supportedLanguages)-1 {
+		t.Errorf("%d catalogs for %d translated languages", len(files), len(supportedLanguages)-1)
+	}
+	for _, file := range files {
+		data, _ := messageCatalogs.ReadFile("messages/" + file.Name())
+		var messages map[string]string
+		if err := json.Unmarshal(data, &messages); err != nil {
+			t.Errorf("%s: %v", file.Name(), err)
+			continue
+		}
+		// Every formatted argument must land somewhere in the translation
+		for english, translation := range messages {
+			for i := range len(formatVerbPattern.FindAllString(english, -1)) {
+				if placeholder := "{" + strconv.Itoa(i+1) + "}"; !strings.Contains(translation, placeholder) {
+					t.Errorf("%s: %q drops %s", file.Name(), english, placeholder)
+				}
+			}
+		}
+	}
+}
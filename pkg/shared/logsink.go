@@ -0,0 +1,270 @@
+package shared
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// =============================================================================
+// Log Collector Sink
+// =============================================================================
+
+// Log sink tuning
+const (
+	logSinkBufferSize    = 1024             // Records queued before new ones are dropped
+	logSinkBatchSize     = 100              // Records per POST
+	logSinkFlushInterval = 2 * time.Second  // Longest a record waits for a full batch
+	logSinkAttempts      = 3                // Deliveries per batch, with backoff
+	logSinkTimeout       = 5 * time.Second  // Per-delivery deadline
+	logSinkCloseTimeout  = 10 * time.Second // Flush budget on shutdown
+	maxLogMessageRunes   = 2048             // Longer messages are cut so stray content can't ship in bulk
+)
+
+// LogRecord is one log line as POSTed to LOG_COLLECTOR_URL, in batches of a
+// JSON array
+type LogRecord struct {
+	Time    string `json:"time"`
+	Service string `json:"service"`
+	Version string `json:"version"`
+	Message string `json:"message"`
+}
+
+// logSink receives every line written through the standard logger and ships
+// them from a background goroutine, so logging never waits on the network
+type logSink struct {
+	url     string
+	token   string
+	secrets []string
+	client  *http.Client
+
+	records chan LogRecord
+	closing chan struct{}
+	stopped chan struct{}
+	dropped int
+	mu      sync.Mutex
+}
+
+var (
+	activeLogSink *logSink
+	logSinkOnce   sync.Once
+	logSinkClose  sync.Once
+)
+
+// StartLogSink tees the standard logger to LOG_COLLECTOR_URL when it is set.
+// Lines still go to stderr. Pending records are flushed by CloseLogSink and
+// on SIGTERM (see flushOnShutdown).
+func StartLogSink() {
+	logSinkOnce.Do(func() {
+		cfg := GetConfig()
+		if cfg.LogCollectorURL == "" {
+			return
+		}
+		sink := &logSink{
+			url:     cfg.LogCollectorURL,
+			token:   cfg.LogCollectorToken,
+			secrets: logSecrets(cfg),
+			client:  outboundClient(logSinkTimeout),
+			records: make(chan LogRecord, logSinkBufferSize),
+			closing: make(chan struct{}),
+			stopped: make(chan struct{}),
+		}
+		activeLogSink = sink
+		go sink.run()
+		log.SetOutput(io.MultiWriter(os.Stderr, sink))
+		flushOnShutdown()
+	})
+}
+
+var shutdownOnce sync.Once
+
+// flushOnShutdown flushes pending spans and log records on SIGTERM, which is
+// how serverless runtimes signal shutdown, then exits. Spans go first so
+// problems exporting them still reach the log collector.
+func flushOnShutdown() {
+	shutdownOnce.Do(func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM)
+		go func() {
+			<-signals
+			CloseTracing()
+			CloseLogSink()
+			os.Exit(0)
+		}()
+	})
+}
+
+// CloseLogSink flushes pending records and detaches the sink from the
+// standard logger. It waits at most logSinkCloseTimeout and is safe to call
+// when no sink was started.
+func CloseLogSink() {
+	sink := activeLogSink
+	if sink == nil {
+		return
+	}
+	logSinkClose.Do(func() {
+		log.SetOutput(os.Stderr)
+		close(sink.closing)
+		select {
+		case <-sink.stopped:
+		case <-time.After(logSinkCloseTimeout):
+			fmt.Fprintln(os.Stderr, "Log sink: timed out flushing records on shutdown")
+		}
+	})
+}
+
+// Write queues one log line. It never blocks: when the buffer is full the
+// line is dropped and counted.
+func (s *logSink) Write(p []byte) (int, error) {
+	record := LogRecord{
+		Time:    time.Now().UTC().Format(time.RFC3339Nano),
+		Service: ServiceName,
+		Version: Version,
+		Message: s.redact(strings.TrimSuffix(string(p), "\n")),
+	}
+	select {
+	case s.records <- record:
+	default:
+		s.mu.Lock()
+		s.dropped++
+		s.mu.Unlock()
+	}
+	return len(p), nil
+}
+
+// redact masks configured secrets and caps the message length
+func (s *logSink) redact(message string) string {
+	for _, secret := range s.secrets {
+		message = strings.ReplaceAll(message, secret, "[REDACTED]")
+	}
+	return truncateRunes(message, maxLogMessageRunes)
+}
+
+// run batches records until CloseLogSink, then drains what is left
+func (s *logSink) run() {
+	defer close(s.stopped)
+
+	ticker := time.NewTicker(logSinkFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]LogRecord, 0, logSinkBatchSize)
+	flush := func() {
+		if len(batch) > 0 {
+			s.send(batch)
+			batch = batch[:0]
+		}
+	}
+	for {
+		select {
+		case record := <-s.records:
+			if batch = append(batch, record); len(batch) >= logSinkBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-s.closing:
+			for {
+				select {
+				case record := <-s.records:
+					if batch = append(batch, record); len(batch) >= logSinkBatchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// send POSTs a batch, retrying failures with exponential backoff. Problems
+// go straight to stderr, since logging them would feed back into the sink.
+func (s *logSink) send(batch []LogRecord) {
+	s.mu.Lock()
+	dropped := s.dropped
+	s.dropped = 0
+	s.mu.Unlock()
+	if dropped > 0 {
+		fmt.Fprintf(os.Stderr, "Log sink: dropped %d records while the buffer was full\n", dropped)
+	}
+
+	body, err := json.Marshal(batch)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Log sink: failed to encode batch: %v\n", err)
+		return
+	}
+
+	backoff := 200 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err = s.post(body)
+		if err == nil {
+			return
+		}
+		if attempt == logSinkAttempts {
+			fmt.Fprintf(os.Stderr, "Log sink: dropping %d records after %d attempts: %v\n", len(batch), attempt, err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (s *logSink) post(body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), logSinkTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", GetConfig().GeminiUserAgent)
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// logSecrets lists the configured secret values to mask in shipped logs
+func logSecrets(cfg *Config) []string {
+	candidates := append([]string{cfg.AdminToken, cfg.IPHashSecret, cfg.LogCollectorToken}, cfg.AccessKeys...)
+	for _, value := range cfg.OTLPHeaders {
+		candidates = append(candidates, value)
+	}
+	for _, raw := range []string{cfg.RedisURL, cfg.RedisReplicaURL} {
+		if u, err := url.Parse(raw); err == nil && u.User != nil {
+			if password, ok := u.User.Password(); ok {
+				candidates = append(candidates, password)
+			}
+		}
+	}
+
+	var secrets []string
+	for _, secret := range candidates {
+		if secret != "" {
+			secrets = append(secrets, secret)
+		}
+	}
+	return secrets
+}
@@ -0,0 +1,220 @@
+package shared
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// logCollector is an HTTP log collector that records each batch it accepts,
+// rejecting the first failures POSTs
+type logCollector struct {
+	mu       sync.Mutex
+	batches  [][]LogRecord
+	failures int
+}
+
+func (c *logCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failures > 0 {
+		c.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	var batch []LogRecord
+	json.NewDecoder(r.Body).Decode(&batch)
+	c.batches = append(c.batches, batch)
+}
+
+// received returns the accepted batches
+func (c *logCollector) received() [][]LogRecord {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.batches
+}
+
+// startTestLogSink runs a sink shipping to collector as the active one, so
+// CloseLogSink flushes it
+func startTestLogSink(t *testing.T, collector *logCollector, secrets ...string) *logSink {
+	t.Helper()
+	useConfig(t, nil)
+	srv := httptest.NewServer(collector)
+	t.Cleanup(srv.Close)
+
+	sink := &logSink{
+		url:     srv.URL,
+		secrets: secrets,
+		client:  srv.Client(),
+		records: make(chan LogRecord, logSinkBufferSize),
+		closing: make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go sink.run()
+	prev := activeLogSink
+	activeLogSink, logSinkClose = sink, sync.Once{}
+	t.Cleanup(func() {
+		CloseLogSink()
+		activeLogSink, logSinkClose = prev, sync.Once{}
+	})
+	return sink
+}
+
+func TestLogSinkBatching(t *testing.T) {
+	tests := []struct {
+		name    string
+		records int
+		want    []int
+	}{
+		{"partial batch", 3, []int{3}},
+		{"full batch", logSinkBatchSize, []int{logSinkBatchSize}},
+		{"several batches", 2*logSinkBatchSize + 50, []int{logSinkBatchSize, logSinkBatchSize, 50}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collector := &logCollector{}
+			sink := startTestLogSink(t, collector)
+			for i := range tt.records {
+				sink.Write([]byte("line " + strings.Repeat("x", i%3) + "\n"))
+			}
+			// Closing well within the flush interval ships the partial batch
+			CloseLogSink()
+
+			batches := collector.received()
+			if len(batches) != len(tt.want) {
+				t.Fatalf("got %d batches, want %d", len(batches), len(tt.want))
+			}
+			for i, batch := range batches {
+				if len(batch) != tt.want[i] {
+					t.Errorf("batch %d has %d records, want %d", i, len(batch), tt.want[i])
+				}
+			}
+			if first := batches[0][0]; first.Message != "line " || first.Service != ServiceName {
+				t.Errorf("first record = %+v", first)
+			}
+		})
+	}
+}
+
+func TestLogSinkFlushesOnClose(t *testing.T) {
+	collector := &logCollector{}
+	sink := startTestLogSink(t, collector)
+	sink.Write([]byte("pending\n"))
+
+	start := time.Now()
+	CloseLogSink()
+	if elapsed := time.Since(start); elapsed >= logSinkFlushInterval {
+		t.Errorf("close took %s, want it to flush without waiting for the interval", elapsed)
+	}
+	if batches := collector.received(); len(batches) != 1 || batches[0][0].Message != "pending" {
+		t.Errorf("batches = %+v, want the pending record delivered before close returned", batches)
+	}
+	// Closing again is a no-op
+	CloseLogSink()
+}
+
+func TestLogSinkRetries(t *testing.T) {
+	tests := []struct {
+		name      string
+		failures  int
+		delivered bool
+	}{
+		{"first attempt", 0, true},
+		{"after failures", logSinkAttempts - 1, true},
+		{"every attempt fails", logSinkAttempts, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collector := &logCollector{failures: tt.failures}
+			sink := startTestLogSink(t, collector)
+			sink.Write([]byte("retried\n"))
+			CloseLogSink()
+
+			if got := len(collector.received()) == 1; got != tt.delivered {
+				t.Errorf("delivered = %v, want %v", got, tt.delivered)
+			}
+		})
+	}
+}
+
+func TestLogSinkRedaction(t *testing.T) {
+	sink := &logSink{secrets: []string{"hunter2", "s3cret-token"}}
+	tests := []struct {
+		name, message, want string
+	}{
+		{"no secret", "Request served", "Request served"},
+		{"secret", "auth failed for hunter2", "auth failed for [REDACTED]"},
+		{"several secrets", "hunter2 s3cret-token hunter2", "[REDACTED] [REDACTED] [REDACTED]"},
+		{"long message", strings.Repeat("n", maxLogMessageRunes+10), strings.Repeat("n", maxLogMessageRunes) + "…"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sink.redact(tt.message); got != tt.want {
+				t.Errorf("redact = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestAccessLogStartsLogSink runs the sample handler's flow, which never
+// reaches CheckServerConfig, and checks its logs still reach the collector
+func TestAccessLogStartsLogSink(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		wantStatus int
+	}{
+		{"served", http.MethodGet, http.StatusOK},
+		{"rejected method", http.MethodPost, http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collector := &logCollector{}
+			srv := httptest.NewServer(collector)
+			t.Cleanup(srv.Close)
+			useConfig(t, func(c *Config) {
+				c.LogCollectorURL = srv.URL
+				c.LogSampleRate = 1
+			})
+			prev := activeLogSink
+			activeLogSink, logSinkOnce, logSinkClose = nil, sync.Once{}, sync.Once{}
+			t.Cleanup(func() {
+				CloseLogSink()
+				activeLogSink, logSinkOnce, logSinkClose = prev, sync.Once{}, sync.Once{}
+			})
+
+			rec := httptest.NewRecorder()
+			r := httptest.NewRequest(tt.method, "/api/ai-extraction/sample", nil)
+			w, done := StartAccessLog(rec, r)
+			if RequireMethod(w, r, http.MethodGet) {
+				sample, err := SampleExtraction()
+				if err != nil {
+					t.Fatalf("SampleExtraction: %v", err)
+				}
+				WriteJSON(w, r, http.StatusOK, sample)
+			}
+			done()
+			CloseLogSink()
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			var shipped []string
+			for _, batch := range collector.received() {
+				for _, record := range batch {
+					shipped = append(shipped, record.Message)
+				}
+			}
+			want := `"path":"/api/ai-extraction/sample","status":` + strconv.Itoa(tt.wantStatus)
+			if !slices.ContainsFunc(shipped, func(m string) bool { return strings.Contains(m, want) }) {
+				t.Errorf("shipped %q, want an access log line containing %s", shipped, want)
+			}
+		})
+	}
+}
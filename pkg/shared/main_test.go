@@ -0,0 +1,97 @@
+package shared
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestMain(m *testing.M) {
+	// The defaults need an access key, and tests never reach Redis
+	os.Setenv("ARMY_ACCESS_KEY", "test-key")
+	os.Setenv("STORE_BACKEND", StoreBackendMemory)
+	os.Exit(m.Run())
+}
+
+// useConfig installs a freshly loaded configuration, adjusted by mutate, for
+// the rest of the test
+func useConfig(t *testing.T, mutate func(*Config)) *Config {
+	t.Helper()
+	GetConfig()
+	c, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if mutate != nil {
+		mutate(c)
+	}
+	prev := config
+	config = c
+	t.Cleanup(func() { config = prev })
+	return c
+}
+
+// useMemoryStore replaces the process-wide rate-limit store with an empty
+// InMemoryStore for the rest of the test
+func useMemoryStore(t *testing.T) *InMemoryStore {
+	t.Helper()
+	GetRateLimitStore()
+	store := NewInMemoryStore()
+	prev := rateLimitStore
+	rateLimitStore = store
+	t.Cleanup(func() {
+		rateLimitStore = prev
+		store.Close()
+	})
+	return store
+}
+
+// useRedisClient makes client the process-wide Redis client, and REDIS_URL
+// point at it, for the rest of the test
+func useRedisClient(t *testing.T, cfg *Config, client *redis.Client) {
+	t.Helper()
+	GetRedisClient()
+	prevClient, prevErr := redisClient, redisErr
+	redisClient, redisErr = client, nil
+	cfg.RedisURL = "redis://" + client.Options().Addr
+	t.Cleanup(func() { redisClient, redisErr = prevClient, prevErr })
+}
+
+// fakeProvider serves Gemini Army requests with handler and points cfg at it
+func fakeProvider(t *testing.T, cfg *Config, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	cfg.GeminiBaseURL = srv.URL
+	return srv
+}
+
+// providerResponse encodes a successful Gemini Army response carrying the
+// model output text
+func providerResponse(text string) []byte {
+	body, _ := json.Marshal(map[string]any{"text": text, "model": "gemini-2.5-flash"})
+	return body
+}
+
+// cardsOutput renders model output with one card per content, each tagged
+// "go"
+func cardsOutput(contents ...string) string {
+	cards := make([]map[string]any, len(contents))
+	for i, content := range contents {
+		cards[i] = map[string]any{"content": content, "suggested_tags": []string{"go"}, "suggested_project": nil}
+	}
+	text, _ := json.Marshal(map[string]any{"cards": cards})
+	return string(text)
+}
+
+// serveCards returns a provider handler that answers every call with cards
+func serveCards(contents ...string) http.HandlerFunc {
+	body := providerResponse(cardsOutput(contents...))
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}
+}
@@ -0,0 +1,96 @@
+package shared
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// =============================================================================
+// Maintenance Mode
+// =============================================================================
+
+// Sources that can enable maintenance mode
+const (
+	MaintenanceSourceEnv    = "env"    // MAINTENANCE_MODE is set; needs a redeploy to clear
+	MaintenanceSourceToggle = "toggle" // Flipped at runtime via /api/admin/maintenance
+)
+
+// DefaultMaintenanceToggleTTL bounds a runtime toggle that doesn't specify a
+// duration, so a forgotten toggle lapses on its own
+const DefaultMaintenanceToggleTTL = time.Hour
+
+// MaintenanceStatus reports whether extraction is currently disabled
+type MaintenanceStatus struct {
+	Enabled bool   `json:"enabled"`
+	Source  string `json:"source,omitempty"`
+}
+
+func maintenanceKey() string {
+	return redisKey("maintenance")
+}
+
+// GetMaintenanceStatus checks MAINTENANCE_MODE, then the runtime toggle in
+// store. A failed lookup is logged and treated as disabled so a store outage
+// never takes extraction down on its own. A nil store checks only the env
+// flag.
+func GetMaintenanceStatus(ctx context.Context, store RateLimitStore) MaintenanceStatus {
+	if GetConfig().MaintenanceMode {
+		return MaintenanceStatus{Enabled: true, Source: MaintenanceSourceEnv}
+	}
+	if store == nil {
+		return MaintenanceStatus{}
+	}
+	values, err := store.Get(ctx, maintenanceKey())
+	if err != nil {
+		log.Printf("Maintenance toggle lookup error: %v", err)
+		return MaintenanceStatus{}
+	}
+	if values[0] > 0 {
+		return MaintenanceStatus{Enabled: true, Source: MaintenanceSourceToggle}
+	}
+	return MaintenanceStatus{}
+}
+
+// CheckMaintenance returns a maintenance error when extraction is disabled
+func CheckMaintenance(ctx context.Context, store RateLimitStore) error {
+	if !GetMaintenanceStatus(ctx, store).Enabled {
+		return nil
+	}
+	apiErr := NewAPIError(ErrCodeMaintenance, "The service is temporarily down for maintenance. You have not been charged; please try again later.", nil)
+	apiErr.RetryAfter = GetConfig().MaintenanceRetryAfter
+	return apiErr
+}
+
+// SetMaintenance turns the runtime toggle on for ttl, or off. It can't clear
+// maintenance enabled by MAINTENANCE_MODE.
+func SetMaintenance(ctx context.Context, store RateLimitStore, enabled bool, ttl time.Duration) error {
+	if err := store.Delete(ctx, maintenanceKey()); err != nil {
+		return err
+	}
+	if !enabled {
+		return nil
+	}
+	_, err := store.SetIfAbsent(ctx, maintenanceKey(), ttl)
+	return err
+}
+
+// MaintenanceRequest is the body of POST /api/admin/maintenance
+type MaintenanceRequest struct {
+	Enabled bool `json:"enabled"`
+
+	// DurationSeconds bounds how long the toggle stays on (default
+	// DefaultMaintenanceToggleTTL)
+	DurationSeconds int `json:"duration_seconds,omitempty"`
+}
+
+// TTL returns the requested toggle lifetime
+func (r *MaintenanceRequest) TTL() (time.Duration, error) {
+	switch {
+	case r.DurationSeconds < 0:
+		return 0, NewAPIError(ErrCodeBadRequest, "duration_seconds must be positive", nil)
+	case r.DurationSeconds == 0:
+		return DefaultMaintenanceToggleTTL, nil
+	}
+	return time.Duration(r.DurationSeconds) * time.Second, nil
+}
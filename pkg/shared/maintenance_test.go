@@ -0,0 +1,74 @@
+package shared
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	tests := []struct {
+		name       string
+		env        bool
+		toggle     bool
+		wantSource string
+	}{
+		{"disabled", false, false, ""},
+		{"env flag", true, false, MaintenanceSourceEnv},
+		{"runtime toggle", false, true, MaintenanceSourceToggle},
+		{"env flag wins", true, true, MaintenanceSourceEnv},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, func(c *Config) {
+				c.MaintenanceMode = tt.env
+				c.MaintenanceRetryAfter = 2 * time.Minute
+			})
+			store := useMemoryStore(t)
+			ctx := context.Background()
+			if err := SetMaintenance(ctx, store, tt.toggle, time.Hour); err != nil {
+				t.Fatalf("SetMaintenance: %v", err)
+			}
+
+			enabled := tt.wantSource != ""
+			if status := GetMaintenanceStatus(ctx, store); status != (MaintenanceStatus{Enabled: enabled, Source: tt.wantSource}) {
+				t.Errorf("status = %+v, want enabled %v from %q", status, enabled, tt.wantSource)
+			}
+
+			rec := httptest.NewRecorder()
+			ec, ok := BeginExtraction(rec, httptest.NewRequest(http.MethodPost, "/api/ai-extraction", strings.NewReader(`{}`)))
+			ec.End()
+			if ok == enabled {
+				t.Fatalf("BeginExtraction admitted = %v with maintenance %v", ok, enabled)
+			}
+			if enabled && (rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "120") {
+				t.Errorf("got %d with Retry-After %q, want 503 after 120s", rec.Code, rec.Header().Get("Retry-After"))
+			}
+		})
+	}
+}
+
+func TestMaintenanceToggle(t *testing.T) {
+	useConfig(t, nil)
+	store := useMemoryStore(t)
+	ctx := context.Background()
+
+	SetMaintenance(ctx, store, true, time.Hour)
+	SetMaintenance(ctx, store, false, 0)
+	if GetMaintenanceStatus(ctx, store).Enabled {
+		t.Error("toggle still on after being turned off")
+	}
+
+	SetMaintenance(ctx, store, true, 20*time.Millisecond)
+	time.Sleep(40 * time.Millisecond)
+	if GetMaintenanceStatus(ctx, store).Enabled {
+		t.Error("toggle outlived its TTL")
+	}
+
+	if GetMaintenanceStatus(ctx, nil).Enabled {
+		t.Error("a nil store reported maintenance")
+	}
+}
@@ -0,0 +1,92 @@
+package shared
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// =============================================================================
+// Metrics
+// =============================================================================
+
+// DefaultMetricsTTL is how long daily metric counters are retained unless
+// METRICS_TTL overrides it
+const DefaultMetricsTTL = 30 * 24 * time.Hour
+
+// Caches tracked by the hit/miss counters
+const (
+	MetricsStoreExtractionCache = "extraction_cache"
+)
+
+// CacheMetrics reports a cache's lookups for one day
+type CacheMetrics struct {
+	Hits    int64   `json:"hits"`
+	Misses  int64   `json:"misses"`
+	HitRate float64 `json:"hit_rate"`
+}
+
+// MetricsResponse is the body returned by the metrics endpoint
+type MetricsResponse struct {
+	Date  string                  `json:"date"`
+	Cache map[string]CacheMetrics `json:"cache"`
+}
+
+// cacheMetricKey returns the counter key for a cache's hits or misses on day
+func cacheMetricKey(cache, outcome, day string) string {
+	return redisKey("metrics", "cache", cache, outcome, day)
+}
+
+// RecordCacheResult counts a lookup against cache as a hit or miss for today.
+// Failures are logged rather than returned so metrics never fail a request.
+func RecordCacheResult(ctx context.Context, store RateLimitStore, cache string, hit bool) {
+	outcome := "miss"
+	if hit {
+		outcome = "hit"
+	}
+	if err := store.Increment(ctx, GetConfig().MetricsTTL, 1, cacheMetricKey(cache, outcome, getTodayKey())); err != nil {
+		log.Printf("Failed to record %s cache %s: %v", cache, outcome, err)
+	}
+}
+
+// recordCacheResult records a cache lookup against the process-wide store
+func recordCacheResult(ctx context.Context, cache string, hit bool) {
+	store, err := GetRateLimitStore()
+	if err != nil {
+		log.Printf("Failed to record %s cache lookup: %v", cache, err)
+		return
+	}
+	RecordCacheResult(ctx, store, cache, hit)
+}
+
+// GetCacheMetrics returns the hit/miss counters for cache on day
+func GetCacheMetrics(ctx context.Context, store RateLimitStore, cache, day string) (CacheMetrics, error) {
+	counts, err := store.Get(ctx, cacheMetricKey(cache, "hit", day), cacheMetricKey(cache, "miss", day))
+	if err != nil {
+		return CacheMetrics{}, err
+	}
+
+	m := CacheMetrics{Hits: counts[0], Misses: counts[1]}
+	if total := m.Hits + m.Misses; total > 0 {
+		m.HitRate = float64(m.Hits) / float64(total)
+	}
+	return m, nil
+}
+
+// GetMetrics returns the cache metrics for every tracked cache on day, or
+// today when day is empty
+func GetMetrics(ctx context.Context, store RateLimitStore, day string) (*MetricsResponse, error) {
+	if day == "" {
+		day = getTodayKey()
+	}
+
+	resp := &MetricsResponse{Date: day, Cache: make(map[string]CacheMetrics)}
+	for _, cache := range []string{MetricsStoreExtractionCache} {
+		m, err := GetCacheMetrics(ctx, store, cache, day)
+		if err != nil {
+			return nil, err
+		}
+		resp.Cache[cache] = m
+	}
+	return resp, nil
+}
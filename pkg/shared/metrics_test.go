@@ -0,0 +1,57 @@
+package shared
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCacheMetrics(t *testing.T) {
+	tests := []struct {
+		name        string
+		hits, miss  int
+		wantHitRate float64
+	}{
+		{"no lookups", 0, 0, 0},
+		{"all misses", 0, 4, 0},
+		{"mixed", 3, 1, 0.75},
+		{"all hits", 2, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, nil)
+			store := useMemoryStore(t)
+			ctx := context.Background()
+			for range tt.hits {
+				RecordCacheResult(ctx, store, MetricsStoreExtractionCache, true)
+			}
+			for range tt.miss {
+				RecordCacheResult(ctx, store, MetricsStoreExtractionCache, false)
+			}
+
+			resp, err := GetMetrics(ctx, store, "")
+			if err != nil {
+				t.Fatalf("GetMetrics: %v", err)
+			}
+			want := CacheMetrics{Hits: int64(tt.hits), Misses: int64(tt.miss), HitRate: tt.wantHitRate}
+			if got := resp.Cache[MetricsStoreExtractionCache]; got != want {
+				t.Errorf("metrics = %+v, want %+v", got, want)
+			}
+			if resp.Date != getTodayKey() {
+				t.Errorf("date = %q, want today", resp.Date)
+			}
+		})
+	}
+}
+
+func TestCacheMetricsExpireWithMetricsTTL(t *testing.T) {
+	useConfig(t, func(c *Config) { c.MetricsTTL = time.Hour })
+	store := useMemoryStore(t)
+	ctx := context.Background()
+	RecordCacheResult(ctx, store, MetricsStoreExtractionCache, true)
+
+	ttl, err := store.TTL(ctx, cacheMetricKey(MetricsStoreExtractionCache, "hit", getTodayKey()))
+	if err != nil || ttl <= 0 || ttl > time.Hour {
+		t.Errorf("TTL = %s (%v), want at most METRICS_TTL", ttl, err)
+	}
+}
@@ -0,0 +1,84 @@
+package shared
+
+import (
+	"regexp"
+	"strings"
+)
+
+// =============================================================================
+// PII Redaction
+// =============================================================================
+
+// piiDetector replaces matches of pattern with placeholder. When valid is set,
+// only matches it accepts are redacted.
+type piiDetector struct {
+	pattern     *regexp.Regexp
+	placeholder string
+	valid       func(match string) bool
+}
+
+// piiDetectors run in order so broader patterns (phone numbers) never claim
+// digits belonging to a more specific one (card numbers, SSNs)
+var piiDetectors = []piiDetector{
+	{
+		pattern:     regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`),
+		placeholder: "[EMAIL]",
+	},
+	{
+		pattern:     regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`),
+		placeholder: "[CARD_NUMBER]",
+		valid:       luhnValid,
+	},
+	{
+		pattern:     regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`),
+		placeholder: "[SSN]",
+	},
+	{
+		pattern:     regexp.MustCompile(`(?:\+\d{1,3}[\s.-]?)?(?:\(\d{3}\)|\b\d{3})[\s.-]?\d{3}[\s.-]?\d{4}\b`),
+		placeholder: "[PHONE]",
+	},
+}
+
+// RedactPII replaces emails, card numbers, SSNs and phone numbers in content
+// with placeholders such as "[EMAIL]", reporting whether anything was
+// replaced. Detection is regex-based and best-effort: unusual formats may be
+// missed and some non-PII numbers may be redacted.
+func RedactPII(content string) (string, bool) {
+	redacted := false
+	for _, d := range piiDetectors {
+		content = d.pattern.ReplaceAllStringFunc(content, func(match string) string {
+			if d.valid != nil && !d.valid(match) {
+				return match
+			}
+			redacted = true
+			return d.placeholder
+		})
+	}
+	return content, redacted
+}
+
+// luhnValid reports whether the digits in s pass the Luhn checksum used by
+// payment card numbers
+func luhnValid(s string) bool {
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, s)
+
+	sum := 0
+	double := false
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
@@ -0,0 +1,54 @@
+package shared
+
+import "testing"
+
+func TestRedactPII(t *testing.T) {
+	tests := []struct {
+		name, content, want string
+		redacted            bool
+	}{
+		{"email", "Mail jane.doe+notes@example.co.uk today", "Mail [EMAIL] today", true},
+		{"phone", "Call (555) 123-4567 or +1 555.123.4567", "Call [PHONE] or [PHONE]", true},
+		{"ssn", "SSN 123-45-6789 on file", "SSN [SSN] on file", true},
+		{"card number", "Card 4111 1111 1111 1111 expires soon", "Card [CARD_NUMBER] expires soon", true},
+		{"failed checksum", "Order 4111 1111 1111 1112 shipped", "Order 4111 1111 1111 1112 shipped", false},
+		{"several", "jane@example.com, 555-123-4567", "[EMAIL], [PHONE]", true},
+		{"nothing to redact", "Goroutines are cheap; 42 of them ran in 2024.", "Goroutines are cheap; 42 of them ran in 2024.", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, redacted := RedactPII(tt.content)
+			if got != tt.want || redacted != tt.redacted {
+				t.Errorf("RedactPII(%q) = %q, %v; want %q, %v", tt.content, got, redacted, tt.want, tt.redacted)
+			}
+		})
+	}
+}
+
+func TestRedactPIIFlagsResponse(t *testing.T) {
+	useConfig(t, nil)
+	tests := []struct {
+		name    string
+		req     AIExtractionRequest
+		want    string
+		flagged bool
+	}{
+		{"redacted", AIExtractionRequest{Content: "Ask jane@example.com about it", RedactPII: true}, "Ask [EMAIL] about it", true},
+		{"no pii", AIExtractionRequest{Content: "Nothing personal here", RedactPII: true}, "Nothing personal here", false},
+		{"not requested", AIExtractionRequest{Content: "Ask jane@example.com about it"}, "Ask jane@example.com about it", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := buildResponse(t, &tt.req, card("A card"))
+			if err != nil {
+				t.Fatalf("BuildExtractionResponse: %v", err)
+			}
+			if tt.req.Content != tt.want {
+				t.Errorf("prompted content = %q, want %q", tt.req.Content, tt.want)
+			}
+			if resp.PIIRedacted != tt.flagged {
+				t.Errorf("pii_redacted = %v, want %v", resp.PIIRedacted, tt.flagged)
+			}
+		})
+	}
+}
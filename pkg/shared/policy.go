@@ -0,0 +1,21 @@
+package shared
+
+import "log"
+
+// =============================================================================
+// Content Policy
+// =============================================================================
+
+// CheckContentPolicy rejects content matching any CONTENT_DENYLIST pattern
+// with a policy_violation error. It runs before the provider is called or any
+// quota is charged. The matched pattern is logged but never returned, so
+// clients can't probe the list.
+func CheckContentPolicy(content string) error {
+	for i, pattern := range GetConfig().ContentDenylist {
+		if pattern.MatchString(content) {
+			log.Printf("Content policy: note matched denylist pattern %d", i)
+			return NewAPIError(ErrCodePolicyViolation, "This note contains content that isn't allowed by our content policy", nil)
+		}
+	}
+	return nil
+}
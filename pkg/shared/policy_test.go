@@ -0,0 +1,75 @@
+package shared
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestContentDenylist(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "denylist.txt")
+	os.WriteFile(file, []byte("# Spam\n(?i)buy now\n\n(?i)free\\s+crypto\n"), 0o600)
+	t.Setenv("CONTENT_DENYLIST", "forbidden-term\n")
+	t.Setenv("CONTENT_DENYLIST_FILE", file)
+	useConfig(t, nil)
+
+	tests := []struct {
+		content string
+		blocked bool
+	}{
+		{"A note about goroutines", false},
+		{"This mentions a forbidden-term inline", true},
+		{"BUY NOW while stocks last", true},
+		{"Get free   crypto today", true},
+		{"Free time and crypto-graphy notes", false},
+	}
+	for _, tt := range tests {
+		err := CheckContentPolicy(tt.content)
+		if !tt.blocked {
+			if err != nil {
+				t.Errorf("%q: blocked by %v", tt.content, err)
+			}
+			continue
+		}
+		if apiErr := ToAPIError(err); err == nil || apiErr.Code != ErrCodePolicyViolation || HTTPStatusForCode(apiErr.Code) != http.StatusUnprocessableEntity {
+			t.Errorf("%q: err = %v, want a 422 policy violation", tt.content, err)
+		}
+	}
+}
+
+func TestContentDenylistInvalidPattern(t *testing.T) {
+	t.Setenv("CONTENT_DENYLIST", "valid\n(unclosed")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("LoadConfig accepted an invalid denylist pattern")
+	}
+	t.Setenv("CONTENT_DENYLIST", "")
+	t.Setenv("CONTENT_DENYLIST_FILE", filepath.Join(t.TempDir(), "missing.txt"))
+	if _, err := LoadConfig(); err == nil {
+		t.Error("LoadConfig accepted a missing denylist file")
+	}
+}
+
+func TestPolicyViolationIsNotCharged(t *testing.T) {
+	useConfig(t, func(c *Config) {
+		c.ClientRateLimitPerDay = 5
+		c.ContentDenylist = []*regexp.Regexp{regexp.MustCompile(`forbidden`)}
+	})
+	useMemoryStore(t)
+
+	ec, rec := beginExtraction(t, `{"content":"a forbidden note"}`)
+	var req AIExtractionRequest
+	if !ec.Decode(&req) || !ec.Prepare(&req) {
+		t.Fatalf("request rejected before the policy check: %s", rec.Body)
+	}
+	if ec.CheckContent(req.Content) {
+		t.Fatal("CheckContent accepted denylisted content")
+	}
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("status = %d, want 422", rec.Code)
+	}
+	if got := rec.Header().Get("X-RateLimit-Client-Remaining"); got != "5" {
+		t.Errorf("X-RateLimit-Client-Remaining = %q, want 5", got)
+	}
+}
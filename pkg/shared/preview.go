@@ -0,0 +1,125 @@
+package shared
+
+import (
+	"math"
+	"strings"
+)
+
+// =============================================================================
+// Extraction Preview
+// =============================================================================
+
+// Heuristics used to estimate an extraction without calling the model
+const (
+	previewWordsPerCard      = 120 // Typical source words condensed into one card
+	previewTokensPerWord     = 1.35
+	previewCardOverhead      = 40 // Output tokens per card spent on JSON, tags and project
+	previewCharsPerToken     = 4
+	previewMinMultiCardWords = 30 // Notes below this rarely yield more than one card
+)
+
+// ExtractionEstimate is a heuristic forecast of an extraction's size and cost
+type ExtractionEstimate struct {
+	WordCount             int `json:"word_count"`
+	ParagraphCount        int `json:"paragraph_count"`
+	HeadingCount          int `json:"heading_count"`
+	EstimatedCards        int `json:"estimated_cards"`
+	EstimatedPromptTokens int `json:"estimated_prompt_tokens"`
+	EstimatedOutputTokens int `json:"estimated_output_tokens"`
+	EstimatedTotalTokens  int `json:"estimated_total_tokens"`
+
+	// QuotaCost is how many rate-limit slots the extraction will consume
+	QuotaCost int64 `json:"quota_cost"`
+
+	// EstimatedCostUSD prices the token estimates at the configured
+	// PRICE_PER_MILLION_* rates; zero when no prices are set
+	EstimatedCostUSD float64 `json:"estimated_cost_usd"`
+}
+
+// TokenPricing reports the per-token prices an estimate was computed with
+type TokenPricing struct {
+	Currency               string  `json:"currency"`
+	InputPerMillionTokens  float64 `json:"input_per_million_tokens"`
+	OutputPerMillionTokens float64 `json:"output_per_million_tokens"`
+}
+
+// CostEstimateResponse is the body returned by the estimate endpoint
+type CostEstimateResponse struct {
+	Estimate ExtractionEstimate `json:"estimate"`
+	Pricing  TokenPricing       `json:"pricing"`
+}
+
+// CurrentTokenPricing returns the configured token prices
+func CurrentTokenPricing() TokenPricing {
+	cfg := GetConfig()
+	return TokenPricing{Currency: "USD", InputPerMillionTokens: cfg.InputTokenPrice, OutputPerMillionTokens: cfg.OutputTokenPrice}
+}
+
+// EstimateCostUSD prices promptTokens and outputTokens at the configured
+// rates, rounded to a millionth of a dollar
+func EstimateCostUSD(promptTokens, outputTokens int) float64 {
+	cfg := GetConfig()
+	cost := (float64(promptTokens)*cfg.InputTokenPrice + float64(outputTokens)*cfg.OutputTokenPrice) / 1e6
+	return math.Round(cost*1e6) / 1e6
+}
+
+// RateLimitStatus reports a client's remaining quota without consuming any
+type RateLimitStatus struct {
+	Allowed         bool  `json:"allowed"`
+	ClientLimit     int64 `json:"client_limit"`
+	ClientRemaining int64 `json:"client_remaining"`
+	GlobalLimit     int64 `json:"global_limit"`
+	GlobalRemaining int64 `json:"global_remaining"`
+}
+
+// PreviewResponse is the body returned by the preview endpoint
+type PreviewResponse struct {
+	Estimate  ExtractionEstimate `json:"estimate"`
+	RateLimit RateLimitStatus    `json:"rate_limit"`
+}
+
+// NewRateLimitStatus builds a RateLimitStatus from the client's counts and
+// whether the request would be allowed
+func NewRateLimitStatus(allowed bool, clientCount, globalCount int64) RateLimitStatus {
+	cfg := GetConfig()
+	return RateLimitStatus{
+		Allowed:         allowed,
+		ClientLimit:     cfg.ClientRateLimitPerDay,
+		ClientRemaining: max(cfg.ClientRateLimitPerDay-clientCount, 0),
+		GlobalLimit:     cfg.GlobalRateLimitPerDay,
+		GlobalRemaining: max(cfg.GlobalRateLimitPerDay-globalCount, 0),
+	}
+}
+
+// EstimateExtraction forecasts how many cards a prepared request will yield
+// and roughly how many tokens it will cost, based on the note's length and
+// structure. Each heading usually introduces a separate idea, so structured
+// notes are estimated from whichever of headings or length suggests more.
+func EstimateExtraction(req *AIExtractionRequest) ExtractionEstimate {
+	est := ExtractionEstimate{WordCount: countWords(req.Content), QuotaCost: RequestCost(req)}
+
+	for _, block := range strings.Split(req.Content, "\n\n") {
+		if strings.TrimSpace(block) != "" {
+			est.ParagraphCount++
+		}
+	}
+	for _, line := range strings.Split(req.Content, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			est.HeadingCount++
+		}
+	}
+
+	cards := max((est.WordCount+previewWordsPerCard/2)/previewWordsPerCard, est.HeadingCount)
+	if est.WordCount >= previewMinMultiCardWords {
+		// The prompt asks for at least three insights
+		cards = max(cards, 3)
+	}
+	est.EstimatedCards = min(max(cards, 1), GetConfig().MaxCards)
+
+	est.EstimatedPromptTokens = len(AIExtractionPrompt(req)) / previewCharsPerToken
+	wordsPerCard := (GetConfig().CardMinWords + GetConfig().CardMaxWords) / 2
+	est.EstimatedOutputTokens = est.EstimatedCards * (int(float64(wordsPerCard)*previewTokensPerWord) + previewCardOverhead)
+	est.EstimatedTotalTokens = est.EstimatedPromptTokens + est.EstimatedOutputTokens
+	est.EstimatedCostUSD = EstimateCostUSD(est.EstimatedPromptTokens, est.EstimatedOutputTokens)
+	return est
+}
@@ -0,0 +1,133 @@
+package shared
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEstimateExtraction(t *testing.T) {
+	words := func(n int) string { return strings.TrimSpace(strings.Repeat("word ", n)) }
+	tests := []struct {
+		name      string
+		content   string
+		wantCards int
+		wantCost  int64
+	}{
+		{"short", words(10), 1, 1},
+		{"medium", words(200), 3, 1},
+		{"headed", "# One\n" + words(40) + "\n\n# Two\n" + words(40) + "\n\n# Three\n\n# Four\n" + words(40), 4, 1},
+		{"long", words(5000), 7, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, func(c *Config) { c.LongContentChars = 20000 })
+			req := &AIExtractionRequest{Content: tt.content}
+			if err := req.Prepare(); err != nil {
+				t.Fatalf("Prepare: %v", err)
+			}
+			est := EstimateExtraction(req)
+			if est.EstimatedCards != tt.wantCards {
+				t.Errorf("estimated cards = %d, want %d", est.EstimatedCards, tt.wantCards)
+			}
+			if est.QuotaCost != tt.wantCost {
+				t.Errorf("quota cost = %d, want %d", est.QuotaCost, tt.wantCost)
+			}
+			if est.EstimatedPromptTokens <= 0 || est.EstimatedTotalTokens != est.EstimatedPromptTokens+est.EstimatedOutputTokens {
+				t.Errorf("token estimates %d + %d != %d", est.EstimatedPromptTokens, est.EstimatedOutputTokens, est.EstimatedTotalTokens)
+			}
+		})
+	}
+}
+
+func TestNewRateLimitStatus(t *testing.T) {
+	useConfig(t, func(c *Config) { c.ClientRateLimitPerDay, c.GlobalRateLimitPerDay = 5, 50 })
+	got := NewRateLimitStatus(false, 7, 20)
+	want := RateLimitStatus{Allowed: false, ClientLimit: 5, ClientRemaining: 0, GlobalLimit: 50, GlobalRemaining: 30}
+	if got != want {
+		t.Errorf("NewRateLimitStatus = %+v, want %+v", got, want)
+	}
+}
+
+func TestEstimateCostUSD(t *testing.T) {
+	tests := []struct {
+		name                  string
+		inputPrice, outPrice  float64
+		promptTokens, outputs int
+		want                  float64
+	}{
+		{"no prices", 0, 0, 1000, 1000, 0},
+		{"input only", 0.3, 0, 1_000_000, 500, 0.3},
+		{"both prices", 0.3, 2.5, 2000, 800, 0.0026},
+		{"rounded to a millionth", 0.3, 0, 1, 0, 0},
+		{"large note", 1.25, 10, 250_000, 5_000, 0.3625},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, func(c *Config) { c.InputTokenPrice, c.OutputTokenPrice = tt.inputPrice, tt.outPrice })
+			if got := EstimateCostUSD(tt.promptTokens, tt.outputs); got != tt.want {
+				t.Errorf("EstimateCostUSD = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEstimateTokensAcrossSizes(t *testing.T) {
+	useConfig(t, func(c *Config) {
+		c.InputTokenPrice, c.OutputTokenPrice = 0.3, 2.5
+		c.CardMinWords, c.CardMaxWords = 50, 200
+	})
+	// Cards average 125 words
+	wordsPerCard := 125.0
+	perCard := int(wordsPerCard*previewTokensPerWord) + previewCardOverhead
+
+	var prev ExtractionEstimate
+	for _, n := range []int{10, 200, 1000, 5000} {
+		req := &AIExtractionRequest{Content: strings.TrimSpace(strings.Repeat("word ", n))}
+		if err := req.Prepare(); err != nil {
+			t.Fatalf("Prepare: %v", err)
+		}
+		est := EstimateExtraction(req)
+		if want := len(AIExtractionPrompt(req)) / previewCharsPerToken; est.EstimatedPromptTokens != want {
+			t.Errorf("%d words: prompt tokens = %d, want %d", n, est.EstimatedPromptTokens, want)
+		}
+		if want := est.EstimatedCards * perCard; est.EstimatedOutputTokens != want {
+			t.Errorf("%d words: output tokens = %d, want %d", n, est.EstimatedOutputTokens, want)
+		}
+		if want := EstimateCostUSD(est.EstimatedPromptTokens, est.EstimatedOutputTokens); est.EstimatedCostUSD != want {
+			t.Errorf("%d words: cost = %v, want %v", n, est.EstimatedCostUSD, want)
+		}
+		if est.EstimatedPromptTokens <= prev.EstimatedPromptTokens || est.EstimatedCostUSD < prev.EstimatedCostUSD {
+			t.Errorf("%d words: estimate %+v did not grow from %+v", n, est, prev)
+		}
+		prev = est
+	}
+}
+
+func TestTokenPriceConfig(t *testing.T) {
+	tests := []struct {
+		name, input, output string
+		want                TokenPricing
+		wantErr             bool
+	}{
+		{"unset", "", "", TokenPricing{Currency: "USD"}, false},
+		{"set", "0.30", "2.5", TokenPricing{Currency: "USD", InputPerMillionTokens: 0.3, OutputPerMillionTokens: 2.5}, false},
+		{"negative", "-1", "", TokenPricing{}, true},
+		{"not a number", "", "cheap", TokenPricing{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PRICE_PER_MILLION_INPUT_TOKENS", tt.input)
+			t.Setenv("PRICE_PER_MILLION_OUTPUT_TOKENS", tt.output)
+			if tt.wantErr {
+				if _, err := LoadConfig(); err == nil {
+					t.Error("LoadConfig accepted an invalid price")
+				}
+				return
+			}
+			useConfig(t, nil)
+			if got := CurrentTokenPricing(); got != tt.want {
+				t.Errorf("pricing = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,13 +2,19 @@ package shared
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
-	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/redis/go-redis/v9"
 )
@@ -21,118 +27,534 @@ var (
 	redisClient *redis.Client
 	redisOnce   sync.Once
 	redisErr    error
-	ctx         = context.Background()
+
+	redisReplicaClient *redis.Client
+	redisReplicaOnce   sync.Once
 )
 
+// redisOpContext bounds a single Redis operation by RedisOpTimeout so a hung
+// Redis can't stall the request beyond that budget
+func redisOpContext(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, GetConfig().RedisOpTimeout)
+}
+
 // GetRedisClient returns the singleton Redis client, initializing it if needed
 func GetRedisClient() (*redis.Client, error) {
 	redisOnce.Do(func() {
-		redisURL := os.Getenv("REDIS_URL")
+		redisURL := GetConfig().RedisURL
 		if redisURL == "" {
 			redisErr = fmt.Errorf("REDIS_URL environment variable is not set")
 			return
 		}
+		redisClient, redisErr = connectRedis("REDIS_URL", redisURL)
+	})
 
-		opt, err := redis.ParseURL(redisURL)
-		if err != nil {
-			redisErr = fmt.Errorf("failed to parse REDIS_URL: %w", err)
+	return redisClient, redisErr
+}
+
+// GetRedisReplicaClient returns the singleton read-replica client, or nil when
+// REDIS_REPLICA_URL is unset or the replica can't be reached, in which case
+// reads go to the primary
+func GetRedisReplicaClient() *redis.Client {
+	redisReplicaOnce.Do(func() {
+		replicaURL := GetConfig().RedisReplicaURL
+		if replicaURL == "" {
 			return
 		}
-
-		redisClient = redis.NewClient(opt)
-
-		// Test connection
-		_, err = redisClient.Ping(ctx).Result()
+		client, err := connectRedis("REDIS_REPLICA_URL", replicaURL)
 		if err != nil {
-			redisErr = fmt.Errorf("failed to connect to Redis: %w", err)
+			log.Printf("Redis replica unavailable, reading from primary: %v", err)
 			return
 		}
-
-		log.Println("Connected to Redis successfully")
+		redisReplicaClient = client
 	})
+	return redisReplicaClient
+}
 
-	return redisClient, redisErr
+// connectRedis creates a client for redisURL, read from the variable name,
+// and verifies the connection
+func connectRedis(name, redisURL string) (*redis.Client, error) {
+	opt, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", name, err)
+	}
+
+	client := redis.NewClient(opt)
+
+	// Test connection
+	ctx, cancel := redisOpContext(context.Background())
+	defer cancel()
+	if _, err := client.Ping(ctx).Result(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to Redis (%s): %w", name, err)
+	}
+
+	log.Printf("Connected to Redis (%s) successfully", name)
+	return client, nil
+}
+
+// GetCacheClient returns the Redis client backing the extraction cache, or nil
+// when Redis isn't configured or reachable, in which case caching is skipped
+func GetCacheClient() *redis.Client {
+	if GetConfig().RedisURL == "" {
+		return nil
+	}
+	client, err := GetRedisClient()
+	if err != nil {
+		log.Printf("Extraction cache unavailable: %v", err)
+		return nil
+	}
+	return client
 }
 
 // =============================================================================
 // Rate Limiting
 // =============================================================================
 
-// GetClientIP extracts the client IP from the request
+// GetClientIP extracts the client IP from the request. The platform headers
+// (x-vercel-forwarded-for, X-Real-IP) are set by the edge and preferred;
+// otherwise the right-most X-Forwarded-For hop outside TrustedProxies is used,
+// since every entry to its left can be supplied by the client.
 func GetClientIP(r *http.Request) string {
-	// Check X-Forwarded-For header first (for proxies)
-	xff := r.Header.Get("X-Forwarded-For")
-	if xff != "" {
-		// Take the first IP in the list
-		parts := strings.Split(xff, ",")
-		return strings.TrimSpace(parts[0])
+	if ip := parseHeaderIP(r.Header.Get("X-Vercel-Forwarded-For")); ip != "" {
+		return ip
+	}
+	if ip := parseHeaderIP(r.Header.Get("X-Real-IP")); ip != "" {
+		return ip
 	}
 
-	// Check X-Real-IP header
-	xri := r.Header.Get("X-Real-IP")
-	if xri != "" {
-		return xri
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := parseHeaderIP(hops[i])
+			if ip == "" {
+				break
+			}
+			if !isTrustedProxy(ip) {
+				return ip
+			}
+		}
 	}
 
 	// Fall back to RemoteAddr
 	ip := r.RemoteAddr
-	// Remove port if present
-	if colonIdx := strings.LastIndex(ip, ":"); colonIdx != -1 {
-		ip = ip[:colonIdx]
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
 	}
 	return ip
 }
 
-// getTodayKey returns the date string for today (UTC)
+// parseHeaderIP returns the first entry of a forwarding header value in
+// canonical form, or "" when it is not an IP
+func parseHeaderIP(value string) string {
+	first, _, _ := strings.Cut(value, ",")
+	ip := net.ParseIP(strings.TrimSpace(first))
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// isTrustedProxy reports whether ip falls within TrustedProxies
+func isTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	for _, network := range GetConfig().TrustedProxies {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsExemptIP reports whether clientIP falls within ExemptNetworks
+func IsExemptIP(clientIP string) bool {
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return false
+	}
+	for _, network := range GetConfig().ExemptNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// redisKey builds a Redis key from its parts, prepending RedisKeyPrefix so
+// multiple environments can share one Redis instance without colliding
+func redisKey(parts ...string) string {
+	key := strings.Join(parts, ":")
+	prefix := GetConfig().RedisKeyPrefix
+	if prefix == "" {
+		return key
+	}
+	if !strings.HasSuffix(prefix, ":") {
+		prefix += ":"
+	}
+	return prefix + key
+}
+
+// clientKeyID returns the identifier used for clientIP in Redis keys. With
+// HashClientIP set it is an HMAC-SHA256 of the IP, so raw addresses are never
+// stored.
+func clientKeyID(clientIP string) string {
+	cfg := GetConfig()
+	if !cfg.HashClientIP {
+		return clientIP
+	}
+	mac := hmac.New(sha256.New, []byte(cfg.IPHashSecret))
+	mac.Write([]byte(clientIP))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// clientRateLimitKey returns the per-client counter key for the given day
+func clientRateLimitKey(clientIP, day string) string {
+	return redisKey("ratelimit", "client", clientKeyID(clientIP), day)
+}
+
+// globalRateLimitKey returns the global counter key for the given day
+func globalRateLimitKey(day string) string {
+	return redisKey("ratelimit", "global", day)
+}
+
+// burstRateLimitKey returns the per-client counter key for the burst window
+// starting at windowStart
+func burstRateLimitKey(clientIP string, windowStart time.Time) string {
+	return redisKey("ratelimit", "burst", clientKeyID(clientIP), strconv.FormatInt(windowStart.Unix(), 10))
+}
+
+// cooldownKey returns the per-client key that marks MinRequestInterval as
+// running
+func cooldownKey(clientIP string) string {
+	return redisKey("ratelimit", "cooldown", clientKeyID(clientIP))
+}
+
+// inFlightKey returns the per-client counter of requests in progress
+func inFlightKey(clientIP string) string {
+	return redisKey("ratelimit", "inflight", clientKeyID(clientIP))
+}
+
+// currentBurstWindow returns the start of the burst window containing now
+func currentBurstWindow(now time.Time) time.Time {
+	return now.Truncate(GetConfig().BurstWindow)
+}
+
+// getTodayKey returns the date string for today in the rate-limit time zone
 func getTodayKey() string {
-	return time.Now().UTC().Format("2006-01-02")
+	return time.Now().In(GetConfig().RateLimitLocation).Format("2006-01-02")
+}
+
+// NextRateLimitReset returns the next midnight after now in the rate-limit
+// time zone, when the daily counters roll over
+func NextRateLimitReset(now time.Time) time.Time {
+	local := now.In(GetConfig().RateLimitLocation)
+	return time.Date(local.Year(), local.Month(), local.Day()+1, 0, 0, 0, 0, local.Location())
+}
+
+// RequestCost returns how many rate-limit slots an extraction of req
+// consumes: its model's cost, multiplied by LongContentCost when the content
+// reaches LongContentChars
+func RequestCost(req *AIExtractionRequest) int64 {
+	cfg := GetConfig()
+	cost := ModelCost(req.Model)
+	if cfg.LongContentChars > 0 && utf8.RuneCountInString(req.Content) >= cfg.LongContentChars {
+		cost *= cfg.LongContentCost
+	}
+	return cost
+}
+
+// ModelCost returns the rate-limit slots a call to model consumes, from
+// MODEL_COSTS. Unlisted models, including the provider default, cost 1.
+func ModelCost(model string) int64 {
+	if cost, ok := GetConfig().ModelCosts[model]; ok {
+		return cost
+	}
+	return 1
+}
+
+// RateLimitExceededError builds the 429 error for a request of the given
+// cost that was rejected, reflecting the configured limits and when they
+// reset
+func RateLimitExceededError(clientCount, cost int64) *APIError {
+	cfg := GetConfig()
+	resetAt := NextRateLimitReset(time.Now())
+	resetStr := resetAt.Format("Jan 2, 2006 15:04 MST")
+
+	var apiErr *APIError
+	if clientCount >= cfg.ClientRateLimitPerDay {
+		apiErr = NewAPIError(ErrCodeRateLimited, fmt.Sprintf("Client rate limit exceeded. Maximum %d requests per day. Resets at %s.", cfg.ClientRateLimitPerDay, resetStr), nil)
+	} else if clientCount+cost > cfg.ClientRateLimitPerDay {
+		apiErr = NewAPIError(ErrCodeRateLimited, fmt.Sprintf("This request costs %d requests but only %d remain today. Resets at %s.", cost, ClientRemaining(clientCount), resetStr), nil)
+	} else {
+		apiErr = NewAPIError(ErrCodeRateLimited, fmt.Sprintf("Global rate limit exceeded. Please try again after %s.", resetStr), nil)
+	}
+	apiErr.ResetAt = resetAt
+	return apiErr
+}
+
+// BurstLimitExceededError builds the 429 error for a client that exceeded
+// the short-window burst allowance
+func BurstLimitExceededError() *APIError {
+	cfg := GetConfig()
+	apiErr := NewAPIError(ErrCodeBurstLimited, fmt.Sprintf("Too many requests in a short period. Maximum %d requests per %s.", cfg.BurstLimit, cfg.BurstWindow), nil)
+	apiErr.ResetAt = currentBurstWindow(time.Now()).Add(cfg.BurstWindow)
+	return apiErr
+}
+
+// CooldownError builds the 429 error for a client that sent a request before
+// MinRequestInterval had passed since its previous one
+func CooldownError(remaining time.Duration) *APIError {
+	// Round up so a client that waits Retry-After seconds is never early
+	remaining = (remaining + time.Second - 1).Truncate(time.Second)
+	apiErr := NewAPIError(ErrCodeCooldown, fmt.Sprintf("Please wait %s between requests.", GetConfig().MinRequestInterval), nil)
+	apiErr.ResetAt = time.Now().Add(remaining)
+	apiErr.RetryAfter = remaining
+	return apiErr
 }
 
-// CheckRateLimit checks both client and global rate limits
+// CheckCooldown enforces MinRequestInterval between a client's requests. The
+// first request starts the interval whether or not it later succeeds;
+// requests arriving before it ends are rejected with a CooldownError and do
+// not extend it. Handlers call it once per request, so a batch counts as one.
+//
+// Exempt clients are never held back, and store timeouts follow the same
+// RedisFailOpen policy as CheckRateLimit.
+func CheckCooldown(ctx context.Context, store RateLimitStore, clientIP string) error {
+	interval := GetConfig().MinRequestInterval
+	if interval <= 0 || IsExemptIP(clientIP) {
+		return nil
+	}
+
+	key := cooldownKey(clientIP)
+	started, err := store.SetIfAbsent(ctx, key, interval)
+	if err != nil {
+		_, _, _, err = failRateLimitCheck(err)
+		return err
+	}
+	if started {
+		return nil
+	}
+
+	remaining, err := store.TTL(ctx, key)
+	if err != nil {
+		_, _, _, err = failRateLimitCheck(err)
+		return err
+	}
+	return CooldownError(remaining)
+}
+
+// ConcurrencyLimitExceededError builds the 429 error for a client that
+// already has MaxConcurrentRequests extractions in progress
+func ConcurrencyLimitExceededError() *APIError {
+	return NewAPIError(ErrCodeConcurrencyLimited, fmt.Sprintf("Too many requests in progress. Maximum %d at a time.", GetConfig().MaxConcurrentRequests), nil)
+}
+
+// AcquireRequestSlot reserves one of the client's MaxConcurrentRequests
+// in-flight slots. Callers must defer the returned release, which also runs
+// when the handler panics; a process that dies before releasing leaks the
+// slot only until the counter expires, twice RequestTimeout after the
+// client's last request started.
+//
+// Exempt clients are never capped, and store timeouts follow the same
+// RedisFailOpen policy as CheckRateLimit.
+func AcquireRequestSlot(ctx context.Context, store RateLimitStore, clientIP string) (func(), error) {
+	cfg := GetConfig()
+	if cfg.MaxConcurrentRequests <= 0 || IsExemptIP(clientIP) {
+		return func() {}, nil
+	}
+
+	key := inFlightKey(clientIP)
+	ttl := 2 * cfg.RequestTimeout
+	inFlight, err := store.Add(ctx, key, 1, ttl)
+	if err != nil {
+		_, _, _, err = failRateLimitCheck(err)
+		return func() {}, err
+	}
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			// Detached so a request that hit its deadline still frees its
+			// slot
+			ctx := context.WithoutCancel(ctx)
+			remaining, err := store.Add(ctx, key, -1, ttl)
+			if err != nil {
+				log.Printf("Failed to release request slot: %v", err)
+				return
+			}
+			// An expired counter restarts at zero, so a late release can
+			// take it negative
+			if remaining < 0 {
+				store.Delete(ctx, key)
+			}
+		})
+	}
+
+	if inFlight > cfg.MaxConcurrentRequests {
+		release()
+		return func() {}, ConcurrencyLimitExceededError()
+	}
+	return release, nil
+}
+
+// CheckRateLimit checks both client and global rate limits for a request
+// consuming cost slots (see RequestCost), rejecting it when either remaining
+// quota is smaller than its cost.
 // Returns (allowed bool, clientCount int64, globalCount int64, error)
-func CheckRateLimit(client *redis.Client, clientIP string) (bool, int64, int64, error) {
-	today := getTodayKey()
-	clientKey := fmt.Sprintf("ratelimit:client:%s:%s", clientIP, today)
-	globalKey := fmt.Sprintf("ratelimit:global:%s", today)
+//
+// When BurstLimit is set the client's short-window counter is checked too. A
+// rejection by the burst limiter returns allowed=false together with a
+// BurstLimitExceededError, so callers surface its distinct code.
+//
+// Clients in ExemptNetworks are always allowed and report zero counts.
+//
+// If the store does not answer within RedisOpTimeout the request is allowed when
+// RedisFailOpen is set, and fails with the timeout error otherwise.
+func CheckRateLimit(ctx context.Context, store RateLimitStore, clientIP string, cost int64) (bool, int64, int64, error) {
+	ctx, span := StartSpan(ctx, "ratelimit.check")
+	defer span.End()
+	span.SetAttribute("ratelimit.cost", cost)
 
-	// Get current counts
-	clientCount, err := client.Get(ctx, clientKey).Int64()
-	if err != nil && err != redis.Nil {
-		return false, 0, 0, err
+	allowed, clientCount, globalCount, err := checkRateLimit(ctx, store, clientIP, cost)
+	span.SetAttribute("ratelimit.allowed", allowed)
+	span.SetAttribute("ratelimit.client_count", clientCount)
+	span.RecordError(err)
+	return allowed, clientCount, globalCount, err
+}
+
+func checkRateLimit(ctx context.Context, store RateLimitStore, clientIP string, cost int64) (bool, int64, int64, error) {
+	if IsExemptIP(clientIP) {
+		return true, 0, 0, nil
+	}
+
+	cfg := GetConfig()
+	today := getTodayKey()
+	keys := []string{clientRateLimitKey(clientIP, today), globalRateLimitKey(today)}
+	if cfg.BurstLimit > 0 {
+		keys = append(keys, burstRateLimitKey(clientIP, currentBurstWindow(time.Now())))
 	}
 
-	globalCount, err := client.Get(ctx, globalKey).Int64()
-	if err != nil && err != redis.Nil {
-		return false, 0, 0, err
+	// Get current counts
+	counts, err := store.Get(ctx, keys...)
+	if err != nil {
+		return failRateLimitCheck(err)
 	}
+	clientCount, globalCount := counts[0], counts[1]
 
 	// Check limits
-	if clientCount >= ClientRateLimitPerDay {
+	if clientCount+cost > cfg.ClientRateLimitPerDay {
 		return false, clientCount, globalCount, nil
 	}
-	if globalCount >= GlobalRateLimitPerDay {
+	if globalCount+cost > cfg.GlobalRateLimitPerDay {
+		// Alert on the first rejection, since with costs above 1 the count
+		// can stop short of the limit while larger requests are turned away
+		notifyGlobalLimitExhausted(ctx, store, today, globalCount)
 		return false, clientCount, globalCount, nil
 	}
+	if cfg.BurstLimit > 0 && counts[2] >= cfg.BurstLimit {
+		return false, clientCount, globalCount, BurstLimitExceededError()
+	}
 
 	return true, clientCount, globalCount, nil
 }
 
-// IncrementRateLimit increments both client and global counters
-func IncrementRateLimit(client *redis.Client, clientIP string) error {
+// GetRateLimitCounts returns the client's and global request counts for
+// today without checking or alerting on the limits. Exempt clients report
+// zero counts.
+func GetRateLimitCounts(ctx context.Context, store RateLimitStore, clientIP string) (int64, int64, error) {
+	if IsExemptIP(clientIP) {
+		return 0, 0, nil
+	}
 	today := getTodayKey()
-	clientKey := fmt.Sprintf("ratelimit:client:%s:%s", clientIP, today)
-	globalKey := fmt.Sprintf("ratelimit:global:%s", today)
+	counts, err := store.Get(ctx, clientRateLimitKey(clientIP, today), globalRateLimitKey(today))
+	if err != nil {
+		return 0, 0, err
+	}
+	return counts[0], counts[1], nil
+}
+
+// RateLimitAllows reports whether a request consuming cost slots fits the
+// client's and global daily limits given GetRateLimitCounts' results. Unlike
+// CheckRateLimit it only compares, so advisory callers never trigger the
+// global-limit alert. The burst limit is not considered.
+func RateLimitAllows(clientIP string, clientCount, globalCount, cost int64) bool {
+	if IsExemptIP(clientIP) {
+		return true
+	}
+	cfg := GetConfig()
+	return clientCount+cost <= cfg.ClientRateLimitPerDay && globalCount+cost <= cfg.GlobalRateLimitPerDay
+}
 
-	pipe := client.Pipeline()
+// SetRateLimitHeaders sets the X-RateLimit-* quota headers, and
+// X-Global-Quota-Low when the shared quota is nearly spent. The counts must
+// already include this request if it was charged, so error responses given
+// the pre-request counts show that nothing was consumed.
+//
+// Nothing is set when EXPOSE_RATE_LIMIT_HEADERS is off; limits are still
+// enforced.
+func SetRateLimitHeaders(w http.ResponseWriter, clientCount, globalCount int64) {
+	cfg := GetConfig()
+	if !cfg.ExposeRateLimitHeaders {
+		return
+	}
+	globalRemaining := max(cfg.GlobalRateLimitPerDay-globalCount, 0)
 
-	// Increment client counter
-	pipe.Incr(ctx, clientKey)
-	pipe.Expire(ctx, clientKey, RateLimitTTL)
+	w.Header().Set("X-RateLimit-Client-Limit", strconv.FormatInt(cfg.ClientRateLimitPerDay, 10))
+	w.Header().Set("X-RateLimit-Client-Remaining", strconv.FormatInt(ClientRemaining(clientCount), 10))
+	w.Header().Set("X-RateLimit-Global-Limit", strconv.FormatInt(cfg.GlobalRateLimitPerDay, 10))
+	w.Header().Set("X-RateLimit-Global-Remaining", strconv.FormatInt(globalRemaining, 10))
 
-	// Increment global counter
-	pipe.Incr(ctx, globalKey)
-	pipe.Expire(ctx, globalKey, RateLimitTTL)
+	// Warn all clients before the shared quota runs out so they can back off
+	if cfg.GlobalQuotaLowMargin > 0 && globalRemaining <= cfg.GlobalQuotaLowMargin {
+		w.Header().Set("X-Global-Quota-Low", "true")
+	}
+}
 
-	_, err := pipe.Exec(ctx)
-	return err
+// SetRateLimitWarningHeader sets X-RateLimit-Warning for a client nearing its
+// daily limit, unless EXPOSE_RATE_LIMIT_HEADERS is off
+func SetRateLimitWarningHeader(w http.ResponseWriter) {
+	if GetConfig().ExposeRateLimitHeaders {
+		w.Header().Set("X-RateLimit-Warning", "true")
+	}
+}
+
+// ClientRemaining returns the client's remaining requests today given its
+// count, never below zero
+func ClientRemaining(clientCount int64) int64 {
+	return max(GetConfig().ClientRateLimitPerDay-clientCount, 0)
+}
+
+// failRateLimitCheck applies the fail-open/fail-closed policy to a store error
+func failRateLimitCheck(err error) (bool, int64, int64, error) {
+	if errors.Is(err, context.DeadlineExceeded) && GetConfig().RedisFailOpen {
+		log.Printf("Rate limit check timed out, failing open: %v", err)
+		return true, 0, 0, nil
+	}
+	return false, 0, 0, err
+}
+
+// IncrementRateLimit adds cost to both client and global counters. The burst
+// counter always counts a single request. Exempt clients are never counted.
+// Only a failure to move the daily counters is returned: once they have been
+// charged, a failed burst increment is logged rather than reported as an
+// uncharged request.
+func IncrementRateLimit(ctx context.Context, store RateLimitStore, clientIP string, cost int64) error {
+	if IsExemptIP(clientIP) {
+		return nil
+	}
+
+	today := getTodayKey()
+
+	// Increment client and global counters
+	if err := store.Increment(ctx, RateLimitTTL, cost, clientRateLimitKey(clientIP, today), globalRateLimitKey(today)); err != nil {
+		return err
+	}
+
+	// Increment burst counter
+	if cfg := GetConfig(); cfg.BurstLimit > 0 {
+		if err := store.Increment(ctx, cfg.BurstWindow, 1, burstRateLimitKey(clientIP, currentBurstWindow(time.Now()))); err != nil {
+			log.Printf("Failed to increment burst counter: %v", err)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,511 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGetClientIP(t *testing.T) {
+	_, proxy, _ := net.ParseCIDR("10.0.0.0/8")
+	useConfig(t, func(c *Config) { c.TrustedProxies = []*net.IPNet{proxy} })
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		remote  string
+		want    string
+	}{
+		{"remote addr", nil, "198.51.100.7:4000", "198.51.100.7"},
+		{"ipv6 remote addr", nil, "[2001:db8::1]:4000", "2001:db8::1"},
+		{"vercel header wins", map[string]string{"X-Vercel-Forwarded-For": "203.0.113.9", "X-Forwarded-For": "1.2.3.4"}, "10.0.0.1:80", "203.0.113.9"},
+		{"real ip", map[string]string{"X-Real-IP": "203.0.113.10", "X-Forwarded-For": "1.2.3.4"}, "10.0.0.1:80", "203.0.113.10"},
+		{"right-most hop", map[string]string{"X-Forwarded-For": "1.2.3.4, 203.0.113.11"}, "10.0.0.1:80", "203.0.113.11"},
+		{"skips trusted proxies", map[string]string{"X-Forwarded-For": "1.2.3.4, 203.0.113.12, 10.1.2.3"}, "10.0.0.1:80", "203.0.113.12"},
+		{"spoofed first hop ignored", map[string]string{"X-Forwarded-For": "127.0.0.1, 203.0.113.13"}, "10.0.0.1:80", "203.0.113.13"},
+		{"garbage hop falls back", map[string]string{"X-Forwarded-For": "1.2.3.4, not-an-ip"}, "198.51.100.8:80", "198.51.100.8"},
+		{"invalid real ip ignored", map[string]string{"X-Real-IP": "bogus"}, "198.51.100.9:80", "198.51.100.9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/api/ai-extraction", nil)
+			r.RemoteAddr = tt.remote
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			if got := GetClientIP(r); got != tt.want {
+				t.Errorf("GetClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextRateLimitReset(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skipf("time zone data unavailable: %v", err)
+	}
+	useConfig(t, func(c *Config) { c.RateLimitLocation = tokyo })
+
+	// 20:00 UTC is already 05:00 the next day in Tokyo
+	now := time.Date(2026, 3, 10, 20, 0, 0, 0, time.UTC)
+	want := time.Date(2026, 3, 12, 0, 0, 0, 0, tokyo)
+	if got := NextRateLimitReset(now); !got.Equal(want) {
+		t.Errorf("NextRateLimitReset = %s, want %s", got, want)
+	}
+}
+
+func TestRateLimitExceededErrorMessage(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skipf("time zone data unavailable: %v", err)
+	}
+	useConfig(t, func(c *Config) {
+		c.ClientRateLimitPerDay = 12
+		c.RateLimitLocation = tokyo
+	})
+
+	tests := []struct {
+		name        string
+		clientCount int64
+		cost        int64
+		want        string
+	}{
+		{"client exhausted", 12, 1, "Maximum 12 requests per day"},
+		{"cost exceeds remaining", 10, 3, "This request costs 3 requests but only 2 remain today"},
+		{"global exhausted", 3, 1, "Global rate limit exceeded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			apiErr := RateLimitExceededError(tt.clientCount, tt.cost)
+			if !strings.Contains(apiErr.Message, tt.want) {
+				t.Errorf("message %q does not contain %q", apiErr.Message, tt.want)
+			}
+			if !strings.Contains(apiErr.Message, "JST") {
+				t.Errorf("message %q does not give the reset in the configured zone", apiErr.Message)
+			}
+			if apiErr.Code != ErrCodeRateLimited || apiErr.ResetAt.Location() != tokyo {
+				t.Errorf("code %q reset %s, want rate_limited in Asia/Tokyo", apiErr.Code, apiErr.ResetAt)
+			}
+		})
+	}
+}
+
+func TestClientKeyIDHashing(t *testing.T) {
+	ips := []string{"203.0.113.1", "203.0.113.2", "2001:db8::1", "198.51.100.1"}
+
+	useConfig(t, func(c *Config) {
+		c.HashClientIP = true
+		c.IPHashSecret = "first-secret"
+	})
+	seen := make(map[string]string)
+	for _, ip := range ips {
+		id := clientKeyID(ip)
+		if id == ip || strings.Contains(clientRateLimitKey(ip, "2026-01-01"), ip) {
+			t.Errorf("key for %s contains the raw IP", ip)
+		}
+		if again := clientKeyID(ip); again != id {
+			t.Errorf("%s hashed to %s then %s", ip, id, again)
+		}
+		if other, ok := seen[id]; ok {
+			t.Errorf("%s and %s map to the same key", ip, other)
+		}
+		seen[id] = ip
+	}
+	first := clientKeyID(ips[0])
+
+	useConfig(t, func(c *Config) {
+		c.HashClientIP = true
+		c.IPHashSecret = "second-secret"
+	})
+	if clientKeyID(ips[0]) == first {
+		t.Error("changing IP_HASH_SECRET did not change the key")
+	}
+
+	useConfig(t, nil)
+	if got := clientKeyID(ips[0]); got != ips[0] {
+		t.Errorf("unhashed key ID = %q, want the IP", got)
+	}
+}
+
+func TestGlobalQuotaLowHeader(t *testing.T) {
+	tests := []struct {
+		globalCount int64
+		margin      int64
+		want        string
+	}{
+		{0, 5, ""},
+		{44, 5, ""},
+		{45, 5, "true"},
+		{50, 5, "true"},
+		{60, 5, "true"},
+		{49, 0, ""},
+	}
+	for _, tt := range tests {
+		useConfig(t, func(c *Config) {
+			c.GlobalRateLimitPerDay = 50
+			c.GlobalQuotaLowMargin = tt.margin
+		})
+		rec := httptest.NewRecorder()
+		SetRateLimitHeaders(rec, 0, tt.globalCount)
+		if got := rec.Header().Get("X-Global-Quota-Low"); got != tt.want {
+			t.Errorf("global count %d, margin %d: X-Global-Quota-Low = %q, want %q", tt.globalCount, tt.margin, got, tt.want)
+		}
+	}
+}
+
+func TestExemptIPsBypassRateLimits(t *testing.T) {
+	t.Setenv("EXEMPT_IPS", "192.0.2.0/24, 198.51.100.7")
+	useConfig(t, func(c *Config) { c.ClientRateLimitPerDay, c.GlobalRateLimitPerDay = 1, 1 })
+	store := NewInMemoryStore()
+	defer store.Close()
+	ctx := context.Background()
+
+	// Exhaust the global quota so only an exemption can let a request through
+	if err := IncrementRateLimit(ctx, store, "203.0.113.1", 1); err != nil {
+		t.Fatalf("IncrementRateLimit: %v", err)
+	}
+
+	tests := []struct {
+		ip     string
+		exempt bool
+	}{
+		{"192.0.2.44", true},
+		{"198.51.100.7", true},
+		{"198.51.100.8", false},
+		{"203.0.113.1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := IsExemptIP(tt.ip); got != tt.exempt {
+				t.Fatalf("IsExemptIP = %v, want %v", got, tt.exempt)
+			}
+			keys, _ := store.Keys(ctx, "*")
+			for range 3 {
+				allowed, clientCount, globalCount, err := CheckRateLimit(ctx, store, tt.ip, 1)
+				if err != nil {
+					t.Fatalf("CheckRateLimit: %v", err)
+				}
+				if allowed != tt.exempt {
+					t.Fatalf("allowed = %v, want %v", allowed, tt.exempt)
+				}
+				if tt.exempt && (clientCount != 0 || globalCount != 0) {
+					t.Errorf("exempt client reported counts %d, %d", clientCount, globalCount)
+				}
+				if tt.exempt {
+					if err := IncrementRateLimit(ctx, store, tt.ip, 1); err != nil {
+						t.Fatalf("IncrementRateLimit: %v", err)
+					}
+				}
+			}
+			if after, _ := store.Keys(ctx, "*"); len(after) != len(keys) {
+				t.Errorf("store keys went from %d to %d", len(keys), len(after))
+			}
+			counts, _ := store.Get(ctx, globalRateLimitKey(getTodayKey()))
+			if counts[0] != 1 {
+				t.Errorf("global count = %d, want 1", counts[0])
+			}
+		})
+	}
+}
+
+// keyFailingStore is an InMemoryStore whose increments fail for keys
+// containing failing
+type keyFailingStore struct {
+	*InMemoryStore
+	failing string
+}
+
+func (s keyFailingStore) Increment(ctx context.Context, ttl time.Duration, by int64, keys ...string) error {
+	for _, key := range keys {
+		if strings.Contains(key, s.failing) {
+			return errors.New("increment failed")
+		}
+	}
+	return s.InMemoryStore.Increment(ctx, ttl, by, keys...)
+}
+
+func TestIncrementRateLimitPartialFailure(t *testing.T) {
+	tests := []struct {
+		name                  string
+		failing               string
+		wantErr               bool
+		wantClient, wantBurst int64
+	}{
+		{"all succeed", "nothing", false, 2, 1},
+		{"burst counter fails", ":burst:", false, 2, 0},
+		{"daily counters fail", ":client:", true, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, func(c *Config) { c.BurstLimit, c.BurstWindow = 3, time.Minute })
+			mem := NewInMemoryStore()
+			defer mem.Close()
+			store := keyFailingStore{mem, tt.failing}
+			ctx := context.Background()
+
+			err := IncrementRateLimit(ctx, store, "203.0.113.1", 2)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			today := getTodayKey()
+			counts, _ := mem.Get(ctx,
+				clientRateLimitKey("203.0.113.1", today),
+				globalRateLimitKey(today),
+				burstRateLimitKey("203.0.113.1", currentBurstWindow(time.Now())),
+			)
+			if counts[0] != tt.wantClient || counts[1] != tt.wantClient || counts[2] != tt.wantBurst {
+				t.Errorf("client, global, burst = %v; want %d, %d, %d", counts, tt.wantClient, tt.wantClient, tt.wantBurst)
+			}
+		})
+	}
+}
+
+func TestRequestCost(t *testing.T) {
+	useConfig(t, func(c *Config) {
+		c.LongContentChars, c.LongContentCost = 100, 2
+		c.ModelCosts = map[string]int64{"gemini-2.5-pro": 3}
+	})
+	tests := []struct {
+		name    string
+		content string
+		model   string
+		want    int64
+	}{
+		{"short note", "Short note", "", 1},
+		{"just under long", strings.Repeat("a", 99), "", 1},
+		{"long note", strings.Repeat("a", 100), "", 2},
+		{"long note counts runes", strings.Repeat("é", 99), "", 1},
+		{"costly model", "Short note", "gemini-2.5-pro", 3},
+		{"costly model, long note", strings.Repeat("a", 100), "gemini-2.5-pro", 6},
+	}
+	for _, tt := range tests {
+		if got := RequestCost(&AIExtractionRequest{Content: tt.content, Model: tt.model}); got != tt.want {
+			t.Errorf("%s: RequestCost = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCheckRateLimitCost(t *testing.T) {
+	tests := []struct {
+		name        string
+		used        int64
+		cost        int64
+		wantAllowed bool
+		wantClient  int64
+	}{
+		{"fits", 2, 3, true, 5},
+		{"exactly fills the quota", 3, 2, true, 5},
+		{"partly over the quota", 4, 2, false, 4},
+		{"quota spent", 5, 1, false, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, func(c *Config) { c.ClientRateLimitPerDay, c.GlobalRateLimitPerDay = 5, 50 })
+			store := NewInMemoryStore()
+			defer store.Close()
+			ctx := context.Background()
+			if err := IncrementRateLimit(ctx, store, "203.0.113.1", tt.used); err != nil {
+				t.Fatalf("IncrementRateLimit: %v", err)
+			}
+
+			allowed, _, _, err := CheckRateLimit(ctx, store, "203.0.113.1", tt.cost)
+			if err != nil {
+				t.Fatalf("CheckRateLimit: %v", err)
+			}
+			if allowed != tt.wantAllowed {
+				t.Fatalf("allowed = %v, want %v", allowed, tt.wantAllowed)
+			}
+			if allowed {
+				if err := IncrementRateLimit(ctx, store, "203.0.113.1", tt.cost); err != nil {
+					t.Fatalf("IncrementRateLimit: %v", err)
+				}
+			}
+			if clientCount, _, _ := GetRateLimitCounts(ctx, store, "203.0.113.1"); clientCount != tt.wantClient {
+				t.Errorf("client count = %d, want %d", clientCount, tt.wantClient)
+			}
+		})
+	}
+}
+
+func TestRateLimitAllows(t *testing.T) {
+	t.Setenv("EXEMPT_IPS", "192.0.2.0/24")
+	useConfig(t, func(c *Config) { c.ClientRateLimitPerDay, c.GlobalRateLimitPerDay = 5, 8 })
+	tests := []struct {
+		name                 string
+		ip                   string
+		client, global, cost int64
+		want                 bool
+	}{
+		{"fits both", "203.0.113.1", 2, 4, 3, true},
+		{"exactly fills both", "203.0.113.1", 3, 6, 2, true},
+		{"over the client limit", "203.0.113.1", 4, 4, 2, false},
+		{"over the global limit", "203.0.113.1", 0, 7, 2, false},
+		{"exempt", "192.0.2.9", 5, 8, 2, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := RateLimitAllows(tt.ip, tt.client, tt.global, tt.cost); got != tt.want {
+				t.Errorf("RateLimitAllows(%d, %d, %d) = %v, want %v", tt.client, tt.global, tt.cost, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckCooldown(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+		exempt   bool
+		otherIP  bool
+		gap      time.Duration
+		wantErr  bool
+	}{
+		{"back to back", time.Second, false, false, 0, true},
+		{"after the interval", time.Second, false, false, 1100 * time.Millisecond, false},
+		{"disabled", 0, false, false, 0, false},
+		{"exempt client", time.Second, true, false, 0, false},
+		{"another client", time.Second, false, true, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.exempt {
+				t.Setenv("EXEMPT_IPS", "203.0.113.1")
+			}
+			useConfig(t, func(c *Config) { c.MinRequestInterval = tt.interval })
+			store := NewInMemoryStore()
+			defer store.Close()
+			ctx := context.Background()
+
+			if err := CheckCooldown(ctx, store, "203.0.113.1"); err != nil {
+				t.Fatalf("first request: %v", err)
+			}
+			time.Sleep(tt.gap)
+			second := "203.0.113.1"
+			if tt.otherIP {
+				second = "203.0.113.2"
+			}
+			err := CheckCooldown(ctx, store, second)
+			if !tt.wantErr {
+				if err != nil {
+					t.Errorf("second request: %v", err)
+				}
+				return
+			}
+			apiErr := ToAPIError(err)
+			if apiErr.Code != ErrCodeCooldown || apiErr.RetryAfter != tt.interval {
+				t.Errorf("second request = %v (Retry-After %s), want a cooldown of %s", err, apiErr.RetryAfter, tt.interval)
+			}
+		})
+	}
+}
+
+func TestCooldownResponse(t *testing.T) {
+	useConfig(t, func(c *Config) { c.MinRequestInterval = 10 * time.Second })
+	useMemoryStore(t)
+
+	first, _ := beginExtraction(t, `{}`)
+	if !first.AcquireSlot() {
+		t.Fatal("first request rejected")
+	}
+	second, rec := beginExtraction(t, `{}`)
+	if second.AcquireSlot() {
+		t.Fatal("back-to-back request admitted")
+	}
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "10" {
+		t.Errorf("got %d with Retry-After %q, want 429 after 10s", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	var body ErrorResponse
+	if json.NewDecoder(rec.Body).Decode(&body); body.Code != ErrCodeCooldown {
+		t.Errorf("code = %q, want %q rather than the daily limit's", body.Code, ErrCodeCooldown)
+	}
+}
+
+func TestAcquireRequestSlotCap(t *testing.T) {
+	tests := []struct {
+		name         string
+		max          int64
+		concurrent   int
+		wantAdmitted int
+	}{
+		{"under the cap", 2, 1, 1},
+		{"at the cap", 2, 2, 2},
+		{"over the cap", 2, 8, 2},
+		{"uncapped", 0, 8, 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, func(c *Config) { c.MaxConcurrentRequests = tt.max })
+			store := NewInMemoryStore()
+			defer store.Close()
+			ctx := context.Background()
+
+			var mu sync.Mutex
+			var releases []func()
+			var wg sync.WaitGroup
+			for range tt.concurrent {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					release, err := AcquireRequestSlot(ctx, store, "203.0.113.1")
+					if err != nil {
+						if code := ToAPIError(err).Code; code != ErrCodeConcurrencyLimited {
+							t.Errorf("rejected with %q, want %q", code, ErrCodeConcurrencyLimited)
+						}
+						return
+					}
+					mu.Lock()
+					releases = append(releases, release)
+					mu.Unlock()
+				}()
+			}
+			wg.Wait()
+			if len(releases) != tt.wantAdmitted {
+				t.Fatalf("admitted %d, want %d", len(releases), tt.wantAdmitted)
+			}
+
+			// Releasing a slot, even twice, frees exactly one, so a full cap
+			// stays full
+			releases[0]()
+			releases[0]()
+			release, err := AcquireRequestSlot(ctx, store, "203.0.113.1")
+			if err != nil {
+				t.Fatalf("slot not freed by release: %v", err)
+			}
+			if _, err := AcquireRequestSlot(ctx, store, "203.0.113.1"); int64(tt.wantAdmitted) == tt.max && err == nil {
+				t.Error("a double release freed a second slot")
+			}
+			release()
+		})
+	}
+}
+
+func TestRequestSlotReleasedOnPanic(t *testing.T) {
+	useConfig(t, func(c *Config) { c.MaxConcurrentRequests = 1 })
+	store := useMemoryStore(t)
+
+	func() {
+		defer func() { recover() }()
+		ec, _ := beginExtraction(t, `{}`)
+		defer ec.End()
+		if !ec.AcquireSlot() {
+			t.Fatal("first request rejected")
+		}
+		panic("handler bug")
+	}()
+
+	if counts, _ := store.Get(context.Background(), inFlightKey("203.0.113.50")); counts[0] != 0 {
+		t.Errorf("in-flight count = %d after a panic, want 0", counts[0])
+	}
+	ec, rec := beginExtraction(t, `{}`)
+	if !ec.AcquireSlot() {
+		t.Errorf("next request rejected with %d: %s", rec.Code, rec.Body)
+	}
+}
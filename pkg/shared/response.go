@@ -0,0 +1,71 @@
+package shared
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// =============================================================================
+// JSON Responses
+// =============================================================================
+
+// WantsPretty reports whether the client asked for indented JSON via
+// ?pretty=true
+func WantsPretty(r *http.Request) bool {
+	return r != nil && r.URL.Query().Get("pretty") == "true"
+}
+
+// WriteJSON encodes v as the response body with the given status. Output is
+// compact unless the request asked for ?pretty=true, which indents with two
+// spaces.
+func WriteJSON(w http.ResponseWriter, r *http.Request, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	enc := json.NewEncoder(w)
+	if WantsPretty(r) {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(v)
+}
+
+// =============================================================================
+// Request Bodies
+// =============================================================================
+
+// DecodeRequestBody decodes the JSON request body into v. The raw body must
+// be valid UTF-8: encoding/json would otherwise silently replace invalid bytes
+// with U+FFFD. Failures are returned as bad-request APIErrors.
+func DecodeRequestBody(r *http.Request, v any) error {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return NewAPIError(ErrCodeBadRequest, "Invalid request body", err)
+	}
+	if !utf8.Valid(body) {
+		return NewAPIError(ErrCodeBadRequest, "Request body must be valid UTF-8", nil)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return NewAPIError(ErrCodeBadRequest, "Invalid request body", err)
+	}
+	return nil
+}
+
+// =============================================================================
+// Method Validation
+// =============================================================================
+
+// RequireMethod reports whether r uses one of the allowed methods. Otherwise
+// it writes a 405 JSON error with an Allow header listing them and returns
+// false.
+func RequireMethod(w http.ResponseWriter, r *http.Request, allowed ...string) bool {
+	if slices.Contains(allowed, r.Method) {
+		return true
+	}
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	WriteError(w, r, NewAPIError(ErrCodeMethodNotAllowed, "Method not allowed", nil))
+	return false
+}
@@ -0,0 +1,46 @@
+package shared
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireMethod(t *testing.T) {
+	useConfig(t, nil)
+	tests := []struct {
+		name      string
+		method    string
+		allowed   []string
+		wantOK    bool
+		wantAllow string
+	}{
+		{"single allowed", http.MethodPost, []string{http.MethodPost}, true, ""},
+		{"single rejected", http.MethodGet, []string{http.MethodPost}, false, "POST"},
+		{"multi allowed", http.MethodDelete, []string{http.MethodGet, http.MethodDelete}, true, ""},
+		{"multi rejected", http.MethodPut, []string{http.MethodGet, http.MethodPost}, false, "GET, POST"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			ok := RequireMethod(rec, httptest.NewRequest(tt.method, "/api/ai-extraction", nil), tt.allowed...)
+			if ok != tt.wantOK {
+				t.Fatalf("RequireMethod = %v, want %v", ok, tt.wantOK)
+			}
+			if got := rec.Header().Get("Allow"); got != tt.wantAllow {
+				t.Errorf("Allow = %q, want %q", got, tt.wantAllow)
+			}
+			if ok {
+				if rec.Body.Len() != 0 {
+					t.Errorf("allowed request got a response body %q", rec.Body)
+				}
+				return
+			}
+			var body ErrorResponse
+			if rec.Code != http.StatusMethodNotAllowed || json.Unmarshal(rec.Body.Bytes(), &body) != nil || body.Code != ErrCodeMethodNotAllowed {
+				t.Errorf("got %d %s, want a 405 %s error", rec.Code, rec.Body, ErrCodeMethodNotAllowed)
+			}
+		})
+	}
+}
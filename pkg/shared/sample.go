@@ -0,0 +1,61 @@
+package shared
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// =============================================================================
+// Sample Extraction
+// =============================================================================
+
+// SampleModel is the model reported by the onboarding sample extraction
+const SampleModel = "sample"
+
+// sampleExtractionJSON holds hand-written example cards in the model's output
+// format. Edit the file to change what new users see.
+//
+//go:embed samples/extraction.json
+var sampleExtractionJSON []byte
+
+var (
+	sampleExtraction     *AIExtractionResponse
+	sampleExtractionOnce sync.Once
+	sampleExtractionErr  error
+)
+
+// SampleExtraction returns the embedded example cards in the same shape as a
+// real extraction, for onboarding UIs. Word counts and IDs are filled in as
+// for AI output and the result is checked against the response schema once.
+func SampleExtraction() (*AIExtractionResponse, error) {
+	sampleExtractionOnce.Do(func() {
+		var output ExtractionOutput
+		if err := json.Unmarshal(sampleExtractionJSON, &output); err != nil {
+			sampleExtractionErr = fmt.Errorf("failed to decode sample extraction: %w", err)
+			return
+		}
+
+		resp := &AIExtractionResponse{Title: output.Title, Summary: output.Summary, Model: SampleModel}
+		cards := output.Cards
+		for i := range cards {
+			cards[i].WordCount = countWords(cards[i].Content)
+		}
+		AssignCardIDs(cards)
+		resp.SetCards(cards)
+		if err := ValidateExtractionResponse(resp); err != nil {
+			sampleExtractionErr = fmt.Errorf("sample extraction does not match the response schema: %w", err)
+			return
+		}
+		sampleExtraction = resp
+	})
+	if sampleExtractionErr != nil {
+		return nil, sampleExtractionErr
+	}
+
+	result := *sampleExtraction
+	result.Cards = slices.Clone(result.Cards)
+	return &result, nil
+}
@@ -0,0 +1,37 @@
+package shared
+
+import "testing"
+
+func TestSampleExtraction(t *testing.T) {
+	sample, err := SampleExtraction()
+	if err != nil {
+		t.Fatalf("SampleExtraction: %v", err)
+	}
+	if err := ValidateExtractionResponse(sample); err != nil {
+		t.Errorf("sample does not match the response schema: %v", err)
+	}
+	if sample.Model != SampleModel || len(sample.Cards) == 0 {
+		t.Fatalf("sample = %d cards from %q, want cards from %q", len(sample.Cards), sample.Model, SampleModel)
+	}
+
+	ids := make(map[string]bool)
+	for _, card := range sample.Cards {
+		if card.ID == "" || ids[card.ID] {
+			t.Errorf("card %q has a missing or duplicate ID", card.ID)
+		}
+		ids[card.ID] = true
+		if want := countWords(card.Content); card.WordCount != want {
+			t.Errorf("card %s word count = %d, want %d", card.ID, card.WordCount, want)
+		}
+	}
+
+	// Each call hands out its own cards
+	sample.Cards[0].Content = "changed"
+	again, err := SampleExtraction()
+	if err != nil {
+		t.Fatalf("SampleExtraction: %v", err)
+	}
+	if again.Cards[0].Content == "changed" {
+		t.Error("changing a returned sample changed the cached one")
+	}
+}
@@ -0,0 +1,65 @@
+package shared
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// =============================================================================
+// Response Schema Validation
+// =============================================================================
+
+// extractionResponseSchemaJSON is the documented AIExtractionResponse contract
+//
+//go:embed schemas/extraction_response.schema.json
+var extractionResponseSchemaJSON []byte
+
+const extractionResponseSchemaURL = "extraction_response.schema.json"
+
+var (
+	extractionResponseSchema     *jsonschema.Schema
+	extractionResponseSchemaOnce sync.Once
+	extractionResponseSchemaErr  error
+)
+
+// getExtractionResponseSchema compiles the embedded schema once
+func getExtractionResponseSchema() (*jsonschema.Schema, error) {
+	extractionResponseSchemaOnce.Do(func() {
+		compiler := jsonschema.NewCompiler()
+		if err := compiler.AddResource(extractionResponseSchemaURL, bytes.NewReader(extractionResponseSchemaJSON)); err != nil {
+			extractionResponseSchemaErr = fmt.Errorf("failed to load response schema: %w", err)
+			return
+		}
+		extractionResponseSchema, extractionResponseSchemaErr = compiler.Compile(extractionResponseSchemaURL)
+	})
+	return extractionResponseSchema, extractionResponseSchemaErr
+}
+
+// ValidateExtractionResponse checks the assembled response against the
+// embedded schema. A mismatch wraps ErrInvalidExtraction so the client gets a
+// 502 instead of a malformed 200.
+func ValidateExtractionResponse(resp *AIExtractionResponse) error {
+	schema, err := getExtractionResponseSchema()
+	if err != nil {
+		return err
+	}
+
+	encoded, err := json.Marshal(resp)
+	if err != nil {
+		return fmt.Errorf("failed to encode response for validation: %w", err)
+	}
+	var doc any
+	if err := json.Unmarshal(encoded, &doc); err != nil {
+		return fmt.Errorf("failed to decode response for validation: %w", err)
+	}
+
+	if err := schema.Validate(doc); err != nil {
+		return fmt.Errorf("%w: response does not match schema: %v", ErrInvalidExtraction, err)
+	}
+	return nil
+}
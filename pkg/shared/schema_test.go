@@ -0,0 +1,46 @@
+package shared
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateExtractionResponse(t *testing.T) {
+	valid := func() *AIExtractionResponse {
+		resp := &AIExtractionResponse{Model: "gemini-2.5-flash"}
+		resp.SetCards([]Card{{ID: "a1", Content: "A card", SuggestedTags: []string{"go"}, WordCount: 2}})
+		return resp
+	}
+	confidence := 1.5
+
+	tests := []struct {
+		name   string
+		mutate func(*AIExtractionResponse)
+		valid  bool
+	}{
+		{"well formed", func(r *AIExtractionResponse) {}, true},
+		{"no cards", func(r *AIExtractionResponse) { r.Cards = nil }, false},
+		{"empty text", func(r *AIExtractionResponse) { r.Text = "" }, false},
+		{"card without id", func(r *AIExtractionResponse) { r.Cards[0].ID = "" }, false},
+		{"card without content", func(r *AIExtractionResponse) { r.Cards[0].Content = "" }, false},
+		{"empty tag", func(r *AIExtractionResponse) { r.Cards[0].SuggestedTags = []string{""} }, false},
+		{"unknown difficulty", func(r *AIExtractionResponse) { r.Cards[0].Difficulty = "extreme" }, false},
+		{"confidence out of range", func(r *AIExtractionResponse) { r.Cards[0].Confidence = &confidence }, false},
+		{"title too long", func(r *AIExtractionResponse) { r.Title = strings.Repeat("t", MaxTitleChars+1) }, false},
+		{"bad language code", func(r *AIExtractionResponse) { r.Languages = []string{"English"} }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := valid()
+			tt.mutate(resp)
+			err := ValidateExtractionResponse(resp)
+			if tt.valid && err != nil {
+				t.Errorf("rejected a valid response: %v", err)
+			}
+			if !tt.valid && !errors.Is(err, ErrInvalidExtraction) {
+				t.Errorf("err = %v, want ErrInvalidExtraction", err)
+			}
+		})
+	}
+}
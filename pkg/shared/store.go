@@ -0,0 +1,470 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// =============================================================================
+// Rate Limit Store
+// =============================================================================
+
+// Store backends selectable via STORE_BACKEND
+const (
+	StoreBackendRedis  = "redis"  // Shared counters in Redis (default)
+	StoreBackendMemory = "memory" // Process-local counters for single-instance deployments and local dev
+)
+
+// RateLimitStore holds the expiring counters behind rate limiting and
+// metrics. Implementations must be safe for concurrent use.
+type RateLimitStore interface {
+	// Get returns the current value of each key, treating missing or expired
+	// keys as zero
+	Get(ctx context.Context, keys ...string) ([]int64, error)
+
+	// Increment adds by to each key and sets its expiry to ttl. A key is
+	// never left incremented without an expiry.
+	Increment(ctx context.Context, ttl time.Duration, by int64, keys ...string) error
+
+	// Add adds by to key, sets its expiry to ttl and returns the new value,
+	// all in one atomic step
+	Add(ctx context.Context, key string, by int64, ttl time.Duration) (int64, error)
+
+	// EnsureExpiry sets ttl on each of keys that exists without an expiry,
+	// reporting how many were fixed
+	EnsureExpiry(ctx context.Context, ttl time.Duration, keys ...string) (int, error)
+
+	// Expire sets the remaining lifetime of an existing key to ttl
+	Expire(ctx context.Context, key string, ttl time.Duration) error
+
+	// SetIfAbsent creates key with a ttl expiry unless it already exists,
+	// reporting whether it was created
+	SetIfAbsent(ctx context.Context, key string, ttl time.Duration) (bool, error)
+
+	// TTL returns the remaining lifetime of key, or zero when it is missing or
+	// never expires
+	TTL(ctx context.Context, key string) (time.Duration, error)
+
+	// Keys returns the live keys matching a glob pattern where "*" matches
+	// any run of characters
+	Keys(ctx context.Context, pattern string) ([]string, error)
+
+	// Delete removes keys, ignoring any that don't exist
+	Delete(ctx context.Context, keys ...string) error
+}
+
+var (
+	rateLimitStore     RateLimitStore
+	rateLimitStoreOnce sync.Once
+	rateLimitStoreErr  error
+)
+
+// GetRateLimitStore returns the process-wide store for the configured
+// StoreBackend, initializing it if needed
+func GetRateLimitStore() (RateLimitStore, error) {
+	rateLimitStoreOnce.Do(func() {
+		switch GetConfig().StoreBackend {
+		case StoreBackendMemory:
+			rateLimitStore = NewInMemoryStore()
+		default:
+			client, err := GetRedisClient()
+			if err != nil {
+				rateLimitStoreErr = err
+				return
+			}
+			rateLimitStore = NewRedisStore(client, GetRedisReplicaClient())
+		}
+	})
+	return rateLimitStore, rateLimitStoreErr
+}
+
+// -----------------------------------------------------------------------------
+// Redis
+// -----------------------------------------------------------------------------
+
+// RedisStore implements RateLimitStore on Redis. Each call is bounded by
+// RedisOpTimeout.
+//
+// With a replica, Get reads from it while every write goes to the primary.
+// Replication lag means a read can miss the most recent increments, so under
+// bursts of concurrent requests a client may briefly exceed its limit by the
+// number of writes still in flight. Limits that must be exact should not use
+// a replica.
+type RedisStore struct {
+	client *redis.Client
+	reader *redis.Client
+}
+
+// NewRedisStore wraps client as a RateLimitStore. replica may be nil, in
+// which case reads also go to client.
+func NewRedisStore(client, replica *redis.Client) *RedisStore {
+	reader := replica
+	if reader == nil {
+		reader = client
+	}
+	return &RedisStore{client: client, reader: reader}
+}
+
+// Get reads from the replica when configured, retrying on the primary if the
+// replica fails
+func (s *RedisStore) Get(ctx context.Context, keys ...string) ([]int64, error) {
+	ctx, cancel := redisOpContext(ctx)
+	defer cancel()
+
+	values, err := s.reader.MGet(ctx, keys...).Result()
+	if err != nil && s.reader != s.client && ctx.Err() == nil {
+		log.Printf("Redis replica read failed, retrying on primary: %v", err)
+		values, err = s.client.MGet(ctx, keys...).Result()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make([]int64, len(values))
+	for i, v := range values {
+		if v == nil {
+			continue
+		}
+		str, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected value type %T for key %s", v, keys[i])
+		}
+		n, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid counter value for key %s: %w", keys[i], err)
+		}
+		counts[i] = n
+	}
+	return counts, nil
+}
+
+// incrementScript increments every key and sets its expiry inside one
+// script, which Redis runs atomically: either every counter moves with its
+// TTL or none does, even if this process dies mid-request. Redis does not roll
+// back a script that errors halfway, so every key is checked to hold a
+// counter before any is written.
+var incrementScript = redis.NewScript(`
+for _, key in ipairs(KEYS) do
+  local ok, value = pcall(redis.call, 'GET', key)
+  if not ok or (value and not tonumber(value)) then
+    return redis.error_reply('ERR ' .. key .. ' does not hold a counter')
+  end
+end
+for _, key in ipairs(KEYS) do
+  redis.call('INCRBY', key, ARGV[1])
+  redis.call('PEXPIRE', key, ARGV[2])
+end
+return #KEYS
+`)
+
+// addScript is incrementScript for a single key, returning its new value
+var addScript = redis.NewScript(`
+local value = redis.call('INCRBY', KEYS[1], ARGV[1])
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+return value
+`)
+
+// ensureExpiryScript sets the TTL of keys that exist but have none
+var ensureExpiryScript = redis.NewScript(`
+local fixed = 0
+for _, key in ipairs(KEYS) do
+  if redis.call('PTTL', key) == -1 then
+    redis.call('PEXPIRE', key, ARGV[1])
+    fixed = fixed + 1
+  end
+end
+return fixed
+`)
+
+func (s *RedisStore) Increment(ctx context.Context, ttl time.Duration, by int64, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	ctx, cancel := redisOpContext(ctx)
+	defer cancel()
+	if err := incrementScript.Run(ctx, s.client, keys, by, ttl.Milliseconds()).Err(); err != nil {
+		return fmt.Errorf("failed to increment %s: %w", strings.Join(keys, ", "), err)
+	}
+	return nil
+}
+
+func (s *RedisStore) Add(ctx context.Context, key string, by int64, ttl time.Duration) (int64, error) {
+	ctx, cancel := redisOpContext(ctx)
+	defer cancel()
+	value, err := addScript.Run(ctx, s.client, []string{key}, by, ttl.Milliseconds()).Int64()
+	if err != nil {
+		return 0, fmt.Errorf("failed to add to %s: %w", key, err)
+	}
+	return value, nil
+}
+
+func (s *RedisStore) EnsureExpiry(ctx context.Context, ttl time.Duration, keys ...string) (int, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	ctx, cancel := redisOpContext(ctx)
+	defer cancel()
+	fixed, err := ensureExpiryScript.Run(ctx, s.client, keys, ttl.Milliseconds()).Int()
+	return fixed, err
+}
+
+func (s *RedisStore) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	ctx, cancel := redisOpContext(ctx)
+	defer cancel()
+	return s.client.Expire(ctx, key, ttl).Err()
+}
+
+func (s *RedisStore) SetIfAbsent(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	ctx, cancel := redisOpContext(ctx)
+	defer cancel()
+	return s.client.SetNX(ctx, key, 1, ttl).Result()
+}
+
+func (s *RedisStore) TTL(ctx context.Context, key string) (time.Duration, error) {
+	ctx, cancel := redisOpContext(ctx)
+	defer cancel()
+	ttl, err := s.client.PTTL(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	// PTTL reports -2 for a missing key and -1 for one without an expiry
+	return max(ttl, 0), nil
+}
+
+// Keys walks the keyspace with SCAN, so it never blocks Redis the way KEYS
+// would. The whole walk shares one RedisOpTimeout budget.
+func (s *RedisStore) Keys(ctx context.Context, pattern string) ([]string, error) {
+	ctx, cancel := redisOpContext(ctx)
+	defer cancel()
+
+	var keys []string
+	iter := s.client.Scan(ctx, 0, pattern, 100).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	return keys, iter.Err()
+}
+
+func (s *RedisStore) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	ctx, cancel := redisOpContext(ctx)
+	defer cancel()
+	return s.client.Del(ctx, keys...).Err()
+}
+
+// -----------------------------------------------------------------------------
+// In-Memory
+// -----------------------------------------------------------------------------
+
+// memoryJanitorInterval is how often InMemoryStore sweeps expired counters
+const memoryJanitorInterval = time.Minute
+
+// InMemoryStore implements RateLimitStore with process-local counters. Limits
+// are only enforced per instance, so it suits single-instance deployments,
+// local development and tests.
+//
+// Expired counters read as zero immediately and are removed by a background
+// janitor, so memory stays bounded by the keys active within their TTL.
+type InMemoryStore struct {
+	mu      sync.Mutex
+	entries map[string]*memoryEntry
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+type memoryEntry struct {
+	value     int64
+	expiresAt time.Time
+}
+
+// NewInMemoryStore creates an empty InMemoryStore and starts its janitor.
+// Call Close to stop the janitor once the store is no longer used.
+func NewInMemoryStore() *InMemoryStore {
+	s := &InMemoryStore{
+		entries: make(map[string]*memoryEntry),
+		stop:    make(chan struct{}),
+	}
+	go s.janitor(memoryJanitorInterval)
+	return s
+}
+
+// Close stops the background janitor. It is safe to call more than once.
+func (s *InMemoryStore) Close() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+// janitor periodically removes expired counters until Close is called
+func (s *InMemoryStore) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.sweep(time.Now())
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// sweep deletes every counter that has expired by now
+func (s *InMemoryStore) sweep(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.entries {
+		s.live(key, now)
+	}
+}
+
+// live returns the unexpired entry for key, dropping it if it has expired.
+// The caller must hold s.mu.
+func (s *InMemoryStore) live(key string, now time.Time) *memoryEntry {
+	e, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+	if !e.expiresAt.IsZero() && !now.Before(e.expiresAt) {
+		delete(s.entries, key)
+		return nil
+	}
+	return e
+}
+
+func (s *InMemoryStore) Get(ctx context.Context, keys ...string) ([]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	counts := make([]int64, len(keys))
+	for i, key := range keys {
+		if e := s.live(key, now); e != nil {
+			counts[i] = e.value
+		}
+	}
+	return counts, nil
+}
+
+func (s *InMemoryStore) Increment(ctx context.Context, ttl time.Duration, by int64, keys ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, key := range keys {
+		e := s.live(key, now)
+		if e == nil {
+			e = &memoryEntry{}
+			s.entries[key] = e
+		}
+		e.value += by
+		e.expiresAt = now.Add(ttl)
+	}
+	return nil
+}
+
+func (s *InMemoryStore) Add(ctx context.Context, key string, by int64, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	e := s.live(key, now)
+	if e == nil {
+		e = &memoryEntry{}
+		s.entries[key] = e
+	}
+	e.value += by
+	e.expiresAt = now.Add(ttl)
+	return e.value, nil
+}
+
+func (s *InMemoryStore) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if e := s.live(key, now); e != nil {
+		e.expiresAt = now.Add(ttl)
+	}
+	return nil
+}
+
+// EnsureExpiry is a no-op: in-memory counters always carry an expiry
+func (s *InMemoryStore) EnsureExpiry(ctx context.Context, ttl time.Duration, keys ...string) (int, error) {
+	return 0, nil
+}
+
+func (s *InMemoryStore) SetIfAbsent(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if s.live(key, now) != nil {
+		return false, nil
+	}
+	s.entries[key] = &memoryEntry{value: 1, expiresAt: now.Add(ttl)}
+	return true, nil
+}
+
+func (s *InMemoryStore) TTL(ctx context.Context, key string) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if e := s.live(key, now); e != nil && !e.expiresAt.IsZero() {
+		return e.expiresAt.Sub(now), nil
+	}
+	return 0, nil
+}
+
+func (s *InMemoryStore) Keys(ctx context.Context, pattern string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var keys []string
+	for key := range s.entries {
+		if s.live(key, now) != nil && globMatch(pattern, key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (s *InMemoryStore) Delete(ctx context.Context, keys ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		delete(s.entries, key)
+	}
+	return nil
+}
+
+// globMatch reports whether s matches pattern, where "*" matches any run of
+// characters (including none) and every other character matches itself
+func globMatch(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i == -1 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
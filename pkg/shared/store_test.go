@@ -0,0 +1,402 @@
+package shared
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestInMemoryStoreConcurrentIncrements(t *testing.T) {
+	store := NewInMemoryStore()
+	defer store.Close()
+	ctx := context.Background()
+
+	const workers, each = 20, 50
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range each {
+				store.Increment(ctx, RateLimitTTL, 1, "client", "global")
+				store.Add(ctx, "added", 2, RateLimitTTL)
+			}
+		}()
+	}
+	wg.Wait()
+
+	counts, _ := store.Get(ctx, "client", "global", "added", "missing")
+	if want := []int64{workers * each, workers * each, 2 * workers * each, 0}; counts[0] != want[0] || counts[1] != want[1] || counts[2] != want[2] || counts[3] != want[3] {
+		t.Errorf("counts = %v, want %v", counts, want)
+	}
+}
+
+func TestInMemoryStoreExpiry(t *testing.T) {
+	useConfig(t, nil)
+	store := NewInMemoryStore()
+	defer store.Close()
+	ctx := context.Background()
+
+	if err := IncrementRateLimit(ctx, store, "203.0.113.1", 1); err != nil {
+		t.Fatalf("IncrementRateLimit: %v", err)
+	}
+	ttl, _ := store.TTL(ctx, clientRateLimitKey("203.0.113.1", getTodayKey()))
+	if ttl <= RateLimitTTL-time.Minute || ttl > RateLimitTTL {
+		t.Errorf("TTL = %s, want RateLimitTTL", ttl)
+	}
+
+	store.Increment(ctx, 20*time.Millisecond, 5, "short")
+	time.Sleep(40 * time.Millisecond)
+	if counts, _ := store.Get(ctx, "short"); counts[0] != 0 {
+		t.Errorf("expired counter reads %d, want 0", counts[0])
+	}
+	store.Increment(ctx, time.Hour, 1, "short")
+	if counts, _ := store.Get(ctx, "short"); counts[0] != 1 {
+		t.Errorf("counter restarted at %d, want 1", counts[0])
+	}
+
+	store.Increment(ctx, time.Millisecond, 1, "swept")
+	store.sweep(time.Now().Add(time.Second))
+	store.mu.Lock()
+	_, present := store.entries["swept"]
+	store.mu.Unlock()
+	if present {
+		t.Error("sweep left an expired counter behind")
+	}
+}
+
+func TestInMemoryStoreSetIfAbsent(t *testing.T) {
+	store := NewInMemoryStore()
+	defer store.Close()
+	ctx := context.Background()
+
+	if created, _ := store.SetIfAbsent(ctx, "flag", time.Hour); !created {
+		t.Error("first SetIfAbsent did not create the key")
+	}
+	if created, _ := store.SetIfAbsent(ctx, "flag", time.Hour); created {
+		t.Error("second SetIfAbsent created the key again")
+	}
+	store.Delete(ctx, "flag")
+	if created, _ := store.SetIfAbsent(ctx, "flag", time.Hour); !created {
+		t.Error("SetIfAbsent did not recreate a deleted key")
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"ratelimit:*", "ratelimit:client:1.2.3.4:2026-01-01", true},
+		{"ratelimit:client:*:2026-01-01", "ratelimit:client:1.2.3.4:2026-01-01", true},
+		{"ratelimit:client:*:2026-01-01", "ratelimit:client:1.2.3.4:2026-01-02", false},
+		{"ratelimit:client:*:2026-01-01", "ratelimit:global:2026-01-01", false},
+		{"*", "", true},
+		{"a*b*c", "abc", true},
+		{"a*b*c", "acb", false},
+		{"exact", "exact", true},
+		{"exact", "exactly", false},
+	}
+	for _, tt := range tests {
+		if got := globMatch(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
+
+// fakeRedis is a minimal RESP2 server holding string values and a single
+// hash. It answers GET, SET, MGET, SCAN, HGETALL and EVAL of incrementScript
+// and ensureExpiryScript, or fails every command when failing is set. It
+// records the commands it receives and the expiry each key was given, which
+// is empty for a key without one.
+type fakeRedis struct {
+	mu       sync.Mutex
+	values   map[string]string
+	hash     map[string]string
+	expiry   map[string]string
+	failing  bool
+	commands []string
+}
+
+// newFakeRedis starts a fakeRedis holding values and returns a client for it
+func newFakeRedis(t *testing.T, values map[string]string) (*fakeRedis, *redis.Client) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	if values == nil {
+		values = make(map[string]string)
+	}
+	srv := &fakeRedis{values: values, expiry: make(map[string]string)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(conn)
+		}
+	}()
+	client := redis.NewClient(&redis.Options{Addr: ln.Addr().String(), Protocol: 2})
+	t.Cleanup(func() { client.Close() })
+	return srv, client
+}
+
+func (s *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readRESPCommand(r)
+		if err != nil {
+			return
+		}
+		conn.Write([]byte(s.reply(args)))
+	}
+}
+
+func (s *fakeRedis) reply(args []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cmd := strings.ToUpper(args[0])
+	s.commands = append(s.commands, cmd)
+	switch {
+	case cmd == "CLIENT":
+		return "+OK\r\n"
+	case s.failing:
+		return "-ERR server unavailable\r\n"
+	case cmd == "GET":
+		v, ok := s.values[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	case cmd == "SET":
+		s.values[args[1]] = args[2]
+		s.expiry[args[1]] = strings.Join(args[3:], " ")
+		return "+OK\r\n"
+	case cmd == "MGET":
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "*%d\r\n", len(args)-1)
+		for _, key := range args[1:] {
+			if v, ok := s.values[key]; ok {
+				fmt.Fprintf(&sb, "$%d\r\n%s\r\n", len(v), v)
+			} else {
+				sb.WriteString("$-1\r\n")
+			}
+		}
+		return sb.String()
+	case cmd == "SCAN":
+		var matched []string
+		for key := range s.values {
+			if globMatch(args[3], key) {
+				matched = append(matched, key)
+			}
+		}
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "*2\r\n$1\r\n0\r\n*%d\r\n", len(matched))
+		for _, key := range matched {
+			fmt.Fprintf(&sb, "$%d\r\n%s\r\n", len(key), key)
+		}
+		return sb.String()
+	case cmd == "HGETALL":
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "*%d\r\n", 2*len(s.hash))
+		for field, v := range s.hash {
+			fmt.Fprintf(&sb, "$%d\r\n%s\r\n$%d\r\n%s\r\n", len(field), field, len(v), v)
+		}
+		return sb.String()
+	case cmd == "EVALSHA":
+		return "-NOSCRIPT No matching script\r\n"
+	case cmd == "EVAL" && strings.Contains(args[1], "PTTL"):
+		n, _ := strconv.Atoi(args[2])
+		fixed := 0
+		for _, key := range args[3 : 3+n] {
+			if _, ok := s.values[key]; ok && s.expiry[key] == "" {
+				s.expiry[key] = "px " + args[3+n]
+				fixed++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", fixed)
+	case cmd == "EVAL":
+		n, _ := strconv.Atoi(args[2])
+		keys, by, ttl := args[3:3+n], args[3+n], args[4+n]
+		for _, key := range keys {
+			current, _ := strconv.ParseInt(s.values[key], 10, 64)
+			add, _ := strconv.ParseInt(by, 10, 64)
+			s.values[key] = strconv.FormatInt(current+add, 10)
+			s.expiry[key] = "px " + ttl
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	}
+	return "-ERR unknown command\r\n"
+}
+
+// received reports whether the server was sent cmd
+func (s *fakeRedis) received(cmd string) bool {
+	return s.count(cmd) > 0
+}
+
+// count reports how many times the server was sent cmd
+func (s *fakeRedis) count(cmd string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, c := range s.commands {
+		if c == cmd {
+			n++
+		}
+	}
+	return n
+}
+
+// set runs fn with the server's state locked
+func (s *fakeRedis) set(fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn()
+}
+
+// readRESPCommand reads one command sent as a RESP array of bulk strings
+func readRESPCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func TestRedisStoreReadWriteSplit(t *testing.T) {
+	useConfig(t, nil)
+	ctx := context.Background()
+	tests := []struct {
+		name           string
+		replica        bool
+		replicaFailing bool
+		want           int64
+	}{
+		// A lagging replica serves its own, older count
+		{"replica", true, false, 3},
+		{"replica failing", true, true, 5},
+		{"no replica", false, false, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary, primaryClient := newFakeRedis(t, map[string]string{"counter": "5"})
+			var replica *fakeRedis
+			var replicaClient *redis.Client
+			if tt.replica {
+				replica, replicaClient = newFakeRedis(t, map[string]string{"counter": "3"})
+				replica.failing = tt.replicaFailing
+			}
+			store := NewRedisStore(primaryClient, replicaClient)
+
+			counts, err := store.Get(ctx, "counter", "missing")
+			if err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+			if counts[0] != tt.want || counts[1] != 0 {
+				t.Errorf("counts = %v, want [%d 0]", counts, tt.want)
+			}
+			if got := primary.received("MGET"); got != (!tt.replica || tt.replicaFailing) {
+				t.Errorf("primary read = %v", got)
+			}
+
+			if err := store.Increment(ctx, time.Hour, 2, "counter"); err != nil {
+				t.Fatalf("Increment: %v", err)
+			}
+			if primary.values["counter"] != "7" {
+				t.Errorf("primary counter = %s, want 7", primary.values["counter"])
+			}
+			if replica != nil && (replica.received("EVAL") || replica.received("EVALSHA")) {
+				t.Error("the replica received a write")
+			}
+		})
+	}
+}
+
+func TestRepairRateLimitTTLs(t *testing.T) {
+	useConfig(t, nil)
+	ctx := context.Background()
+	day := getTodayKey()
+	ttl := fmt.Sprintf("px %d", RateLimitTTL.Milliseconds())
+	tests := []struct {
+		name   string
+		key    string
+		expiry string
+		want   string
+		fixed  int
+	}{
+		// A counter whose EXPIRE never landed would block the client for good
+		{"client counter without TTL", clientRateLimitKey("203.0.113.9", day), "", ttl, 1},
+		{"global counter without TTL", globalRateLimitKey(day), "", ttl, 1},
+		{"counter with TTL", clientRateLimitKey("203.0.113.10", day), "px 1000", "px 1000", 0},
+		{"other key without TTL", featureFlagsKey(), "", "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, client := newFakeRedis(t, map[string]string{tt.key: "3"})
+			srv.expiry[tt.key] = tt.expiry
+			store := NewRedisStore(client, nil)
+
+			repaired, err := RepairRateLimitTTLs(ctx, store)
+			if err != nil {
+				t.Fatalf("RepairRateLimitTTLs: %v", err)
+			}
+			if repaired != tt.fixed {
+				t.Errorf("repaired = %d, want %d", repaired, tt.fixed)
+			}
+			if got := srv.expiry[tt.key]; got != tt.want {
+				t.Errorf("expiry = %q, want %q", got, tt.want)
+			}
+			if srv.values[tt.key] != "3" {
+				t.Errorf("counter = %s, want it left at 3", srv.values[tt.key])
+			}
+		})
+	}
+}
+
+func TestIncrementSetsTTL(t *testing.T) {
+	useConfig(t, nil)
+	srv, client := newFakeRedis(t, nil)
+	if err := IncrementRateLimit(context.Background(), NewRedisStore(client, nil), "203.0.113.9", 1); err != nil {
+		t.Fatalf("IncrementRateLimit: %v", err)
+	}
+	if len(srv.values) == 0 {
+		t.Fatal("no counters were written")
+	}
+	for key, value := range srv.values {
+		if srv.expiry[key] == "" {
+			t.Errorf("%s = %s was written without a TTL", key, value)
+		}
+	}
+}
@@ -0,0 +1,412 @@
+package shared
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// =============================================================================
+// Tracing
+// =============================================================================
+
+// Spans are exported as OTLP/HTTP JSON, which every OpenTelemetry collector
+// accepts, so tracing needs no SDK dependency
+
+// Span kinds and status codes, as numbered by OTLP
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+
+	spanStatusError = 2
+)
+
+// Tracer tuning
+const (
+	tracerBufferSize   = 2048             // Spans held before new ones are dropped
+	tracerBatchSize    = 256              // Spans per export
+	tracerTimeout      = 5 * time.Second  // Per-export deadline
+	tracerCloseTimeout = 10 * time.Second // Flush budget on shutdown
+)
+
+// spanContext identifies a span within a trace, local or remote. An
+// unsampled context suppresses every span started under it.
+type spanContext struct {
+	traceID   [16]byte
+	spanID    [8]byte
+	unsampled bool
+}
+
+type spanContextKey struct{}
+
+// Span is one timed operation of a trace. A nil *Span is valid and records
+// nothing, which is what StartSpan returns when tracing is off.
+type Span struct {
+	spanContext
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+
+	mu         sync.Mutex
+	attributes []otlpAttribute
+	status     *otlpStatus
+	ended      bool
+}
+
+// SetAttribute records a string, bool, integer or float attribute on the span
+func (s *Span) SetAttribute(key string, value any) {
+	if s == nil {
+		return
+	}
+	var v map[string]any
+	switch value := value.(type) {
+	case string:
+		v = map[string]any{"stringValue": value}
+	case bool:
+		v = map[string]any{"boolValue": value}
+	case int:
+		v = map[string]any{"intValue": strconv.Itoa(value)}
+	case int64:
+		v = map[string]any{"intValue": strconv.FormatInt(value, 10)}
+	case float64:
+		v = map[string]any{"doubleValue": value}
+	default:
+		v = map[string]any{"stringValue": fmt.Sprint(value)}
+	}
+	s.mu.Lock()
+	s.attributes = append(s.attributes, otlpAttribute{Key: key, Value: v})
+	s.mu.Unlock()
+}
+
+// RecordError marks the span as failed with err's category code. Causes are
+// not recorded, since they can quote provider output.
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	code := ToAPIError(err).Code
+	s.mu.Lock()
+	s.status = &otlpStatus{Code: spanStatusError, Message: code}
+	s.mu.Unlock()
+}
+
+// End finishes the span and buffers it for export. Later calls do nothing.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	end := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return
+	}
+	s.ended = true
+
+	span := otlpSpan{
+		TraceID:    hex.EncodeToString(s.traceID[:]),
+		SpanID:     hex.EncodeToString(s.spanID[:]),
+		Name:       s.name,
+		Kind:       s.kind,
+		Start:      strconv.FormatInt(s.start.UnixNano(), 10),
+		End:        strconv.FormatInt(end.UnixNano(), 10),
+		Attributes: s.attributes,
+		Status:     s.status,
+	}
+	if s.parentID != [8]byte{} {
+		span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	activeTracer.enqueue(span)
+}
+
+// StartSpan starts an internal span as a child of the span in ctx, or a new
+// trace when there is none. It returns ctx unchanged and a nil span when
+// tracing is off.
+func StartSpan(ctx context.Context, name string) (context.Context, *Span) {
+	return startSpan(ctx, name, spanKindInternal)
+}
+
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if activeTracer == nil {
+		return ctx, nil
+	}
+	span := &Span{name: name, kind: kind, start: time.Now()}
+	parent, ok := ctx.Value(spanContextKey{}).(spanContext)
+	if ok && parent.unsampled {
+		return ctx, nil
+	}
+	if ok {
+		span.traceID, span.parentID = parent.traceID, parent.spanID
+	} else {
+		rand.Read(span.traceID[:])
+	}
+	rand.Read(span.spanID[:])
+	return context.WithValue(ctx, spanContextKey{}, span.spanContext), span
+}
+
+// StartRequestSpan starts the server span for an incoming request, continuing
+// the trace named by its traceparent header. The returned request carries the
+// span for StartSpan, and the returned writer records the response status and
+// card count, which the returned function adds to the span as it ends it.
+// That function also exports the request's spans before returning, since a
+// serverless instance may be frozen as soon as the handler does.
+// A traceparent marked as not sampled is honored by not tracing the request,
+// though the decision is still passed on to outbound calls.
+//
+//	w, r, end := shared.StartRequestSpan(w, r)
+//	defer end()
+func StartRequestSpan(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, func()) {
+	// The span opens before CheckServerConfig, so start the exporter here too
+	StartTracing()
+	if activeTracer == nil {
+		return w, r, func() {}
+	}
+	ctx := r.Context()
+	if parent := r.Header.Get("traceparent"); parent != "" {
+		if remote, ok := parseTraceparent(parent); ok {
+			ctx = context.WithValue(ctx, spanContextKey{}, remote)
+			if remote.unsampled {
+				return w, r.WithContext(ctx), func() {}
+			}
+		}
+	}
+
+	ctx, span := startSpan(ctx, r.Method+" "+r.URL.Path, spanKindServer)
+	span.SetAttribute("http.request.method", r.Method)
+	span.SetAttribute("url.path", r.URL.Path)
+	span.SetAttribute("http.request.body.size", r.ContentLength)
+
+	lw, ok := w.(*accessLogWriter)
+	if !ok {
+		lw = &accessLogWriter{ResponseWriter: w}
+	}
+	return lw, r.WithContext(ctx), func() {
+		status := lw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttribute("http.response.status_code", status)
+		span.SetAttribute("swipenotes.card_count", lw.cards)
+		if status >= http.StatusInternalServerError {
+			span.mu.Lock()
+			span.status = &otlpStatus{Code: spanStatusError}
+			span.mu.Unlock()
+		}
+		span.End()
+		activeTracer.flush()
+	}
+}
+
+// InjectTraceparent sets the traceparent header for the span in ctx, so the
+// callee can continue the trace
+func InjectTraceparent(ctx context.Context, header http.Header) {
+	if sc, ok := ctx.Value(spanContextKey{}).(spanContext); ok {
+		flags := "01"
+		if sc.unsampled {
+			flags = "00"
+		}
+		header.Set("traceparent", "00-"+hex.EncodeToString(sc.traceID[:])+"-"+hex.EncodeToString(sc.spanID[:])+"-"+flags)
+	}
+}
+
+// parseTraceparent decodes a W3C traceparent header
+// ("00-<trace id>-<parent id>-<flags>"), reporting whether the header was
+// valid
+func parseTraceparent(header string) (spanContext, bool) {
+	var sc spanContext
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, false
+	}
+	traceID, err1 := hex.DecodeString(parts[1])
+	spanID, err2 := hex.DecodeString(parts[2])
+	flags, err3 := hex.DecodeString(parts[3])
+	if err1 != nil || err2 != nil || err3 != nil || len(traceID) != 16 || len(spanID) != 8 || len(flags) != 1 {
+		return sc, false
+	}
+	copy(sc.traceID[:], traceID)
+	copy(sc.spanID[:], spanID)
+	if sc.traceID == [16]byte{} || sc.spanID == [8]byte{} {
+		return sc, false
+	}
+	sc.unsampled = flags[0]&1 == 0
+	return sc, true
+}
+
+// -----------------------------------------------------------------------------
+// OTLP Export
+// -----------------------------------------------------------------------------
+
+type otlpAttribute struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       *otlpStatus     `json:"status,omitempty"`
+}
+
+// spanExporter delivers a batch of ended spans
+type spanExporter interface {
+	export(batch []otlpSpan)
+}
+
+// tracer buffers ended spans until they are flushed, which every request
+// does as it ends
+type tracer struct {
+	exporter spanExporter
+
+	mu      sync.Mutex
+	pending []otlpSpan
+}
+
+var (
+	activeTracer *tracer
+	tracerOnce   sync.Once
+	tracerClose  sync.Once
+)
+
+// StartTracing enables span export to OTLPTracesEndpoint when it is set.
+// Spans outside a request are flushed by CloseTracing and on SIGTERM.
+func StartTracing() {
+	tracerOnce.Do(func() {
+		cfg := GetConfig()
+		if cfg.OTLPTracesEndpoint == "" {
+			return
+		}
+		activeTracer = &tracer{exporter: &otlpExporter{
+			endpoint: cfg.OTLPTracesEndpoint,
+			headers:  cfg.OTLPHeaders,
+			resource: []otlpAttribute{
+				{Key: "service.name", Value: map[string]any{"stringValue": cfg.OTelServiceName}},
+				{Key: "service.version", Value: map[string]any{"stringValue": Version}},
+			},
+			client: outboundClient(tracerTimeout),
+		}}
+		flushOnShutdown()
+	})
+}
+
+// CloseTracing exports pending spans, waiting at most tracerCloseTimeout. It
+// is safe to call when tracing was never started.
+func CloseTracing() {
+	t := activeTracer
+	if t == nil {
+		return
+	}
+	tracerClose.Do(func() {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			t.flush()
+		}()
+		select {
+		case <-done:
+		case <-time.After(tracerCloseTimeout):
+			fmt.Fprintln(os.Stderr, "Tracing: timed out flushing spans on shutdown")
+		}
+	})
+}
+
+// enqueue buffers a span, dropping it when the buffer is full
+func (t *tracer) enqueue(span otlpSpan) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.pending) < tracerBufferSize {
+		t.pending = append(t.pending, span)
+	}
+}
+
+// flush exports every buffered span in batches of tracerBatchSize, returning
+// once the exporter is done with them
+func (t *tracer) flush() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	spans := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+
+	for len(spans) > 0 {
+		n := min(len(spans), tracerBatchSize)
+		t.exporter.export(spans[:n])
+		spans = spans[n:]
+	}
+}
+
+// otlpExporter POSTs spans to an OTLP/HTTP collector
+type otlpExporter struct {
+	endpoint string
+	headers  map[string]string
+	resource []otlpAttribute
+	client   *http.Client
+}
+
+// export POSTs one batch as an OTLP ExportTraceServiceRequest. Failures go to
+// stderr and the batch is dropped; traces are best-effort.
+func (e *otlpExporter) export(batch []otlpSpan) {
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []map[string]any{{
+			"resource": map[string]any{"attributes": e.resource},
+			"scopeSpans": []map[string]any{{
+				"scope": map[string]any{"name": ServiceName, "version": Version},
+				"spans": batch,
+			}},
+		}},
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Tracing: failed to encode spans: %v\n", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), tracerTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Tracing: failed to create export request: %v\n", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", GetConfig().GeminiUserAgent)
+	for name, value := range e.headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Tracing: dropping %d spans: %v\n", len(batch), err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		fmt.Fprintf(os.Stderr, "Tracing: dropping %d spans: collector returned status %d\n", len(batch), resp.StatusCode)
+	}
+}
@@ -0,0 +1,118 @@
+package shared
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// spanRecorder keeps exported spans in memory
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []otlpSpan
+}
+
+func (r *spanRecorder) export(batch []otlpSpan) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, batch...)
+}
+
+func (r *spanRecorder) exported() []otlpSpan {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]otlpSpan(nil), r.spans...)
+}
+
+// useSpanRecorder enables tracing with an in-memory exporter for the rest of
+// the test
+func useSpanRecorder(t *testing.T) *spanRecorder {
+	t.Helper()
+	StartTracing()
+	rec := &spanRecorder{}
+	prev := activeTracer
+	activeTracer = &tracer{exporter: rec}
+	t.Cleanup(func() { activeTracer = prev })
+	return rec
+}
+
+func TestRequestSpanFlushesOnEnd(t *testing.T) {
+	rec := useSpanRecorder(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/ai-extraction", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w, r, end := StartRequestSpan(httptest.NewRecorder(), req)
+	_, child := StartSpan(r.Context(), "extraction.extract")
+	child.RecordError(errors.New("boom"))
+	child.End()
+	w.WriteHeader(http.StatusBadGateway)
+
+	if got := len(rec.exported()); got != 0 {
+		t.Fatalf("exported %d spans before the request ended, want 0", got)
+	}
+	end()
+
+	spans := rec.exported()
+	if len(spans) != 2 {
+		t.Fatalf("exported %d spans by the time end returned, want 2", len(spans))
+	}
+	child0, server := spans[0], spans[1]
+	if server.Name != "POST /api/ai-extraction" || server.Kind != spanKindServer {
+		t.Errorf("server span = %q kind %d", server.Name, server.Kind)
+	}
+	if server.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || server.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("server span did not continue the incoming trace: %+v", server)
+	}
+	if server.Status == nil || server.Status.Code != spanStatusError {
+		t.Errorf("server span status = %+v, want an error for a 502", server.Status)
+	}
+	if child0.ParentSpanID != server.SpanID || child0.TraceID != server.TraceID {
+		t.Errorf("child span is not parented to the server span: %+v", child0)
+	}
+	if child0.Status == nil || child0.Status.Message != ErrCodeInternal {
+		t.Errorf("child span status = %+v, want %s", child0.Status, ErrCodeInternal)
+	}
+}
+
+func TestUnsampledRequestRecordsNothing(t *testing.T) {
+	rec := useSpanRecorder(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/ai-extraction", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	_, r, end := StartRequestSpan(httptest.NewRecorder(), req)
+	_, child := StartSpan(r.Context(), "extraction.extract")
+	child.End()
+	end()
+
+	if spans := rec.exported(); len(spans) != 0 {
+		t.Errorf("exported %d spans for an unsampled request, want 0", len(spans))
+	}
+	header := http.Header{}
+	InjectTraceparent(r.Context(), header)
+	if got := header.Get("traceparent"); got != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00" {
+		t.Errorf("traceparent = %q, want the unsampled decision passed on", got)
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		header string
+		ok     bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false},
+		{"00-4bf92f-00f067aa0ba902b7-01", false},
+		{"garbage", false},
+	}
+	for _, tt := range tests {
+		if _, ok := parseTraceparent(tt.header); ok != tt.ok {
+			t.Errorf("parseTraceparent(%q) ok = %v, want %v", tt.header, ok, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package shared
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// =============================================================================
+// Outbound HTTP
+// =============================================================================
+
+var (
+	outboundTransport     *http.Transport
+	outboundTransportOnce sync.Once
+)
+
+// OutboundTransport returns the process-wide transport for calls to the
+// provider, alert webhook and log collector, so warm connections are reused
+// across requests handled by the same instance
+func OutboundTransport() *http.Transport {
+	outboundTransportOnce.Do(func() {
+		outboundTransport = NewOutboundTransport(GetConfig())
+	})
+	return outboundTransport
+}
+
+// NewOutboundTransport builds a transport from cfg's HTTP_* settings. Requests
+// are routed through the proxy named by HTTPS_PROXY or HTTP_PROXY (by the
+// target's scheme) unless the host matches NO_PROXY.
+func NewOutboundTransport(cfg *Config) *http.Transport {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: cfg.HTTPKeepAlive}
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		DisableKeepAlives:     cfg.HTTPDisableKeepAlives,
+		MaxIdleConns:          cfg.HTTPMaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.HTTPMaxIdleConnsPerHost,
+		IdleConnTimeout:       cfg.HTTPIdleConnTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+// outboundClient returns a client on OutboundTransport whose calls are
+// bounded by timeout
+func outboundClient(timeout time.Duration) *http.Client {
+	return &http.Client{Transport: OutboundTransport(), Timeout: timeout}
+}
+
+// proxyFor returns the proxy URL requests to rawURL are sent through, or ""
+// when they go direct
+func proxyFor(rawURL string) string {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	proxy, err := http.ProxyFromEnvironment(&http.Request{URL: target})
+	if err != nil || proxy == nil {
+		return ""
+	}
+	return proxy.String()
+}
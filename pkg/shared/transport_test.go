@@ -0,0 +1,76 @@
+package shared
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestOutboundTransportSettings(t *testing.T) {
+	t.Setenv("HTTP_KEEPALIVE", "15s")
+	t.Setenv("HTTP_DISABLE_KEEPALIVES", "true")
+	t.Setenv("HTTP_MAX_IDLE_CONNS", "20")
+	t.Setenv("HTTP_MAX_IDLE_CONNS_PER_HOST", "4")
+	t.Setenv("HTTP_IDLE_CONN_TIMEOUT", "45s")
+	cfg := useConfig(t, nil)
+
+	transport := NewOutboundTransport(cfg)
+	if !transport.DisableKeepAlives || transport.MaxIdleConns != 20 || transport.MaxIdleConnsPerHost != 4 || transport.IdleConnTimeout != 45*time.Second {
+		t.Errorf("transport ignores the HTTP_* settings: keep-alives disabled %v, idle %d (%d per host) for %s",
+			transport.DisableKeepAlives, transport.MaxIdleConns, transport.MaxIdleConnsPerHost, transport.IdleConnTimeout)
+	}
+	if cfg.HTTPKeepAlive != 15*time.Second {
+		t.Errorf("HTTPKeepAlive = %s, want 15s", cfg.HTTPKeepAlive)
+	}
+}
+
+// The standard library reads the proxy variables once per process, so the
+// proxy test runs in a child process started with them set
+const proxyTestEnv = "SWIPENOTES_TEST_PROXY"
+
+func TestOutboundTransportProxy(t *testing.T) {
+	if os.Getenv(proxyTestEnv) == "" {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestOutboundTransportProxy$")
+		cmd.Env = append(os.Environ(),
+			proxyTestEnv+"=1",
+			"HTTPS_PROXY=http://proxy.corp.example:3128",
+			"HTTP_PROXY=http://plain-proxy.corp.example:8080",
+			"NO_PROXY=internal.corp.example",
+		)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("proxy test failed: %v\n%s", err, out)
+		}
+		return
+	}
+
+	tests := []struct {
+		name, target, want string
+	}{
+		{"https target", "https://gemini-army.vercel.app/generate", "http://proxy.corp.example:3128"},
+		{"http target", "http://gemini.example.com/generate", "http://plain-proxy.corp.example:8080"},
+		{"no proxy host", "https://internal.corp.example/generate", ""},
+	}
+	transport := NewOutboundTransport(useConfig(t, nil))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, _ := url.Parse(tt.target)
+			proxy, err := transport.Proxy(&http.Request{URL: target})
+			if err != nil {
+				t.Fatalf("Proxy: %v", err)
+			}
+			got := ""
+			if proxy != nil {
+				got = proxy.String()
+			}
+			if got != tt.want {
+				t.Errorf("proxy = %q, want %q", got, tt.want)
+			}
+			if proxyFor(tt.target) != tt.want {
+				t.Errorf("proxyFor = %q, want %q", proxyFor(tt.target), tt.want)
+			}
+		})
+	}
+}
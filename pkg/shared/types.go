@@ -1,39 +1,488 @@
 package shared
 
 import (
+	"errors"
 	"fmt"
+	"slices"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 // =============================================================================
 // Constants
 // =============================================================================
 
-// Rate limiting constants - easily modifiable
+// Rate limiting defaults - overridable via Config
 const (
-	ClientRateLimitPerDay = 5  // Maximum requests per client (IP) per day
-	GlobalRateLimitPerDay = 50 // Maximum total requests per day across all clients
-	RateLimitTTL          = 24 * time.Hour
+	DefaultClientRateLimitPerDay = 5  // Maximum requests per client (IP) per day
+	DefaultGlobalRateLimitPerDay = 50 // Maximum total requests per day across all clients
+	RateLimitTTL                 = 24 * time.Hour
 )
 
-// Gemini Army API
-const GeminiArmyBaseURL = "https://gemini-army.vercel.app"
+// MaxExistingCardChars caps each existing card interpolated into the prompt
+const MaxExistingCardChars = 1000
+
+// MaxForceTags caps the number of force_tags a request may set
+const MaxForceTags = 5
+
+// Length caps for the note title and summary requested via include_summary
+const (
+	MaxTitleChars   = 100
+	MaxSummaryChars = 300
+)
+
+// Caps on the existing note titles interpolated into the prompt
+const (
+	MaxExistingNoteTitles     = 50
+	MaxExistingNoteTitleChars = 200
+)
+
+// Caps on the references interpolated into the prompt for cite_sources
+const (
+	MaxReferences     = 50
+	MaxReferenceChars = 300
+)
+
+// MaxCardContentChars caps the card_content of a regeneration request, which
+// is interpolated into the prompt alongside the note
+const MaxCardContentChars = 4000
+
+// MaxCustomInstructionsChars caps the custom_instructions interpolated into
+// the prompt
+const MaxCustomInstructionsChars = 500
+
+// MaxOutputTokensLimit is the largest max_output_tokens a client may request
+const MaxOutputTokensLimit = 65536
+
+// Gemini Army API defaults, overridable with GEMINI_BASE_URL and
+// GEMINI_GENERATE_PATH
+const (
+	DefaultGeminiBaseURL      = "https://gemini-army.vercel.app"
+	DefaultGeminiGeneratePath = "/generate"
+)
+
+// Service identification, sent upstream in the User-Agent header
+const ServiceName = "swipenotes-api"
+
+// Version is the service version; override at build time with
+// -ldflags "-X github.com/hassanaziz0012/swipenotes-api/pkg/shared.Version=..."
+var Version = "1.0.0"
 
 // =============================================================================
 // Types
 // =============================================================================
 
-// AIExtractionRequest represents the incoming request body
+// Supported values for AIExtractionRequest.ContentType
+const (
+	ContentTypeNote       = "note"       // Free-form note (default)
+	ContentTypeTranscript = "transcript" // Transcript with "Speaker: ..." labels
+)
+
+// Supported values for AIExtractionRequest.ContentFormat
+const (
+	ContentFormatMarkdown = "markdown" // Flat markdown text (default)
+	ContentFormatJSON     = "json"     // A StructuredNote encoded as a JSON string
+	ContentFormatHTML     = "html"     // An HTML document, e.g. a forwarded email
+)
+
+// Supported values for AIExtractionRequest.Format
+const (
+	CardFormatProse   = "prose"   // Paragraphs of markdown (default)
+	CardFormatOutline = "outline" // Nested bullet outline
+)
+
+// AIExtractionRequest represents the incoming request body. When
+// ContentFormat is "json", Content holds a JSON-encoded StructuredNote; when it
+// is "html", Content holds an HTML document converted to text by Prepare.
 type AIExtractionRequest struct {
 	Content          string   `json:"content"`
+	ContentType      string   `json:"content_type,omitempty"`
+	ContentFormat    string   `json:"content_format,omitempty"`
+	Format           string   `json:"format,omitempty"`
 	ExistingTags     []string `json:"existing_tags"`
 	ExistingProjects []string `json:"existing_projects"`
+
+	// Model selects a Gemini model from SupportedModels; empty uses the
+	// provider default
+	Model string `json:"model,omitempty"`
+
+	// Generation parameters forwarded to Gemini Army. Omitted values fall back
+	// to the provider defaults.
+	Temperature     *float64 `json:"temperature,omitempty"`
+	TopP            *float64 `json:"top_p,omitempty"`
+	MaxOutputTokens *int     `json:"max_output_tokens,omitempty"`
+
+	// ExistingCards lists card contents the user already kept from earlier
+	// extractions of this note, so only new insights are extracted
+	ExistingCards []string `json:"existing_cards,omitempty"`
+
+	// PreviousCards are the cards of an earlier extraction of this note; when
+	// set the response carries a diff against them
+	PreviousCards []PreviousCard `json:"previous_cards,omitempty"`
+
+	// ForceTags are added to every card's suggested_tags regardless of what
+	// the model suggests
+	ForceTags []string `json:"force_tags,omitempty"`
+
+	// StrictProjects clears any suggested_project not in ExistingProjects
+	StrictProjects bool `json:"strict_projects,omitempty"`
+
+	// IncludeDifficulty asks the model to rate each card easy, medium or hard
+	IncludeDifficulty bool `json:"include_difficulty,omitempty"`
+
+	// RedactPII replaces emails, phone numbers, card numbers and SSNs in
+	// Content with placeholders before prompting (best-effort)
+	RedactPII bool `json:"redact_pii,omitempty"`
+
+	// IncludeSummary asks the model for a short title and one-line summary of
+	// the whole note
+	IncludeSummary bool `json:"include_summary,omitempty"`
+
+	// CustomInstructions is an optional user instruction appended to the
+	// prompt, e.g. "focus on financial figures". The core requirements and
+	// JSON output format always take precedence over it.
+	CustomInstructions string `json:"custom_instructions,omitempty"`
+
+	// StripMedia removes markdown images and link URLs (keeping link text)
+	// before prompting to save tokens
+	StripMedia bool `json:"strip_media,omitempty"`
+
+	// ExistingNoteTitles lists the user's other notes; with IncludeRelated
+	// the model links each card to the ones it relates to
+	ExistingNoteTitles []string `json:"existing_note_titles,omitempty"`
+	IncludeRelated     bool     `json:"include_related,omitempty"`
+
+	// References lists the note's sources, e.g. bibliography entries; with
+	// CiteSources each card cites the one it draws from
+	References  []string `json:"references,omitempty"`
+	CiteSources bool     `json:"cite_sources,omitempty"`
+
+	// IncludeConfidence asks the model to rate each card's confidence and
+	// importance from 0 to 1. The rating is self-reported by the model, so
+	// treat it as a rough ordering hint rather than a calibrated probability.
+	IncludeConfidence bool `json:"include_confidence,omitempty"`
+
+	// IncludeIcon asks the model to suggest one emoji per card
+	IncludeIcon bool `json:"include_icon,omitempty"`
+
+	// OrderByImportance asks the model to rank cards by importance. Cards are
+	// returned most important first, each with a distinct priority starting
+	// at 1.
+	OrderByImportance bool `json:"order_by_importance,omitempty"`
+
+	// GroupByLanguage asks the model to tag each card with the ISO 639 code of
+	// the language it is written in. Cards are grouped by language, the most
+	// common first, unless OrderByImportance already sets the order.
+	GroupByLanguage bool `json:"group_by_language,omitempty"`
+
+	// Minimal requests a MinimalExtractionResponse (also settable via ?minimal=true)
+	Minimal bool `json:"minimal,omitempty"`
+
+	// merged marks Content as several notes combined by MergeNotes
+	merged bool
+
+	// piiRedacted records that Prepare redacted PII from Content
+	piiRedacted bool
+
+	// mediaBytesStripped counts the bytes StripMedia removed from Content
+	mediaBytesStripped int
+}
+
+// MediaBytesStripped reports how many bytes strip_media removed from Content
+// during Prepare
+func (r *AIExtractionRequest) MediaBytesStripped() int {
+	return r.mediaBytesStripped
+}
+
+// ValidationIssue describes one problem with a request field
+type ValidationIssue struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationIssues checks every request field and returns all problems found,
+// in field order
+func (r *AIExtractionRequest) ValidationIssues() []ValidationIssue {
+	var issues []ValidationIssue
+	add := func(field, format string, args ...any) {
+		issues = append(issues, ValidationIssue{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if r.Content == "" {
+		add("content", "Content is required")
+	} else if !utf8.ValidString(r.Content) {
+		add("content", "Content must be valid UTF-8")
+	}
+	switch r.ContentType {
+	case "", ContentTypeNote, ContentTypeTranscript:
+	default:
+		add("content_type", "Invalid content_type %q. Must be one of: %s, %s", r.ContentType, ContentTypeNote, ContentTypeTranscript)
+	}
+	switch r.ContentFormat {
+	case "", ContentFormatMarkdown, ContentFormatJSON, ContentFormatHTML:
+	default:
+		add("content_format", "Invalid content_format %q. Must be one of: %s, %s, %s", r.ContentFormat, ContentFormatMarkdown, ContentFormatJSON, ContentFormatHTML)
+	}
+	switch r.Format {
+	case "", CardFormatProse, CardFormatOutline:
+	default:
+		add("format", "Invalid format %q. Must be one of: %s, %s", r.Format, CardFormatProse, CardFormatOutline)
+	}
+	if models := GetConfig().SupportedModels; r.Model != "" && !slices.Contains(models, r.Model) {
+		add("model", "Unsupported model %q. Must be one of: %s", r.Model, strings.Join(models, ", "))
+	}
+	if r.Temperature != nil && (*r.Temperature < 0 || *r.Temperature > 2) {
+		add("temperature", "temperature must be between 0 and 2")
+	}
+	if r.TopP != nil && (*r.TopP <= 0 || *r.TopP > 1) {
+		add("top_p", "top_p must be greater than 0 and at most 1")
+	}
+	if r.MaxOutputTokens != nil && (*r.MaxOutputTokens < 1 || *r.MaxOutputTokens > MaxOutputTokensLimit) {
+		add("max_output_tokens", "max_output_tokens must be between 1 and %d", MaxOutputTokensLimit)
+	}
+	if n := utf8.RuneCountInString(r.CustomInstructions); n > MaxCustomInstructionsChars {
+		add("custom_instructions", "custom_instructions is too long (%d characters). Maximum is %d", n, MaxCustomInstructionsChars)
+	}
+	if len(r.ForceTags) > MaxForceTags {
+		add("force_tags", "At most %d force_tags are allowed", MaxForceTags)
+	}
+	for _, tag := range r.ForceTags {
+		if !tagPattern.MatchString(NormalizeTag(tag)) {
+			add("force_tags", "Invalid force_tags entry %q. Tags must contain only letters, digits and dashes", tag)
+		}
+	}
+	return issues
+}
+
+// Validate checks the request fields, returning the first problem as a
+// client-facing error
+func (r *AIExtractionRequest) Validate() error {
+	if issues := r.ValidationIssues(); len(issues) > 0 {
+		return errors.New(issues[0].Message)
+	}
+	return nil
+}
+
+// GeminiRequest builds the Gemini Army request for prompt using the
+// request's model selection and generation parameters
+func (r *AIExtractionRequest) GeminiRequest(prompt string) GeminiArmyRequest {
+	return GeminiArmyRequest{
+		Prompt:          prompt,
+		Model:           r.Model,
+		Temperature:     r.Temperature,
+		TopP:            r.TopP,
+		MaxOutputTokens: r.MaxOutputTokens,
+	}
+}
+
+// Prepare validates the request and normalizes Content for prompting, e.g.
+// flattening structured JSON notes or HTML into markdown. It is safe to call
+// more than once.
+func (r *AIExtractionRequest) Prepare() error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+
+	if r.ContentFormat == ContentFormatJSON {
+		flattened, err := FlattenStructuredNote(r.Content)
+		if err != nil {
+			return err
+		}
+		r.Content = flattened
+		r.ContentFormat = ContentFormatMarkdown
+	}
+	if r.ContentFormat == ContentFormatHTML {
+		text, err := HTMLToText(r.Content)
+		if err != nil {
+			return err
+		}
+		r.Content = text
+		r.ContentFormat = ContentFormatMarkdown
+	}
+
+	r.Content = NormalizeText(r.Content)
+
+	if r.StripMedia {
+		var stripped int
+		r.Content, stripped = StripMedia(r.Content)
+		r.mediaBytesStripped += stripped
+	}
+	if strings.TrimSpace(r.Content) == "" {
+		return errors.New("Content is empty after preprocessing")
+	}
+
+	if r.RedactPII {
+		var redacted bool
+		r.Content, redacted = RedactPII(r.Content)
+		r.piiRedacted = r.piiRedacted || redacted
+	}
+
+	r.ForceTags = NormalizeTags(r.ForceTags)
+
+	// Variants like "Go", "go " and "GO" would only repeat options in the
+	// prompt. The request's own spelling wins over DEFAULT_EXISTING_TAGS.
+	r.ExistingTags = dedupeFold(slices.Concat(r.ExistingTags, GetConfig().DefaultExistingTags))
+	r.ExistingProjects = dedupeFold(r.ExistingProjects)
+
+	// Bound the note titles interpolated into the prompt
+	if len(r.ExistingNoteTitles) > MaxExistingNoteTitles {
+		r.ExistingNoteTitles = r.ExistingNoteTitles[:MaxExistingNoteTitles]
+	}
+	for i, title := range r.ExistingNoteTitles {
+		r.ExistingNoteTitles[i] = truncateRunes(strings.Join(strings.Fields(title), " "), MaxExistingNoteTitleChars)
+	}
+
+	// Bound the references interpolated into the prompt, dropping blank ones
+	// so the numbering the model cites stays meaningful
+	references := r.References[:0]
+	for _, ref := range r.References {
+		if ref = strings.Join(strings.Fields(ref), " "); ref != "" && len(references) < MaxReferences {
+			references = append(references, truncateRunes(ref, MaxReferenceChars))
+		}
+	}
+	r.References = references
+	r.CustomInstructions = sanitizeInstructions(r.CustomInstructions)
+
+	// Bound the previous_cards the response is diffed against; they never
+	// reach the prompt
+	if len(r.PreviousCards) > MaxPreviousCards {
+		r.PreviousCards = r.PreviousCards[:MaxPreviousCards]
+	}
+
+	// Bound the existing cards interpolated into the prompt
+	if maxCards := GetConfig().MaxExistingCards; len(r.ExistingCards) > maxCards {
+		r.ExistingCards = r.ExistingCards[:maxCards]
+	}
+	for i, card := range r.ExistingCards {
+		r.ExistingCards[i] = truncateRunes(strings.TrimSpace(card), MaxExistingCardChars)
+	}
+	return nil
+}
+
+// sanitizeInstructions flattens user instructions onto a single line and
+// strips quote and brace characters, so they can't close the delimited prompt
+// section or imitate new requirements or JSON output
+func sanitizeInstructions(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r == '"' || r == '`' || r == '{' || r == '}':
+			return -1
+		case unicode.IsControl(r):
+			return ' '
+		}
+		return r
+	}, s)
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// dedupeFold trims values and collapses inner whitespace, dropping blanks
+// and case-insensitive duplicates. The first spelling seen is kept.
+func dedupeFold(values []string) []string {
+	if values == nil {
+		return nil
+	}
+	seen := make(map[string]bool, len(values))
+	deduped := make([]string, 0, len(values))
+	for _, value := range values {
+		value = strings.Join(strings.Fields(value), " ")
+		key := strings.ToLower(value)
+		if value == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		deduped = append(deduped, value)
+	}
+	return deduped
+}
+
+// truncateRunes shortens s to at most n runes
+func truncateRunes(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n]) + "…"
+}
+
+// MergeExtractionRequest represents the request body for extracting one
+// unified card set from several related notes. Notes replaces Content; all
+// other extraction options apply to the merged result.
+type MergeExtractionRequest struct {
+	Notes []string `json:"notes"`
+	AIExtractionRequest
+}
+
+// ToExtractionRequest merges the notes into a single extraction request
+func (r *MergeExtractionRequest) ToExtractionRequest() (AIExtractionRequest, error) {
+	if r.Content != "" {
+		return AIExtractionRequest{}, errors.New("Use notes instead of content for merged extraction")
+	}
+	merged, err := MergeNotes(r.Notes, GetConfig().MaxMergedContentChars)
+	if err != nil {
+		return AIExtractionRequest{}, err
+	}
+
+	req := r.AIExtractionRequest
+	req.Content = merged
+	req.merged = true
+	return req, nil
+}
+
+// RegenerateCardRequest represents the request body for regenerating a single
+// card. Content is the original note; CardContent is the card to replace.
+type RegenerateCardRequest struct {
+	AIExtractionRequest
+	CardContent string `json:"card_content"`
+}
+
+// Prepare validates the request and normalizes the note content. The card
+// reaches the prompt too, so it is normalized, capped and redacted like the
+// note.
+func (r *RegenerateCardRequest) Prepare() error {
+	if strings.TrimSpace(r.CardContent) == "" {
+		return errors.New("card_content is required")
+	}
+	if err := r.AIExtractionRequest.Prepare(); err != nil {
+		return err
+	}
+
+	r.CardContent = NormalizeText(r.CardContent)
+	if strings.TrimSpace(r.CardContent) == "" {
+		return errors.New("card_content is empty after preprocessing")
+	}
+	if n := utf8.RuneCountInString(r.CardContent); n > MaxCardContentChars {
+		return fmt.Errorf("card_content is too long (%d characters). Maximum is %d", n, MaxCardContentChars)
+	}
+	if r.RedactPII {
+		var redacted bool
+		r.CardContent, redacted = RedactPII(r.CardContent)
+		r.piiRedacted = r.piiRedacted || redacted
+	}
+	return nil
+}
+
+// RegenerateCardResponse represents the response for a regenerated card
+type RegenerateCardResponse struct {
+	Card          Card           `json:"card"`
+	Model         string         `json:"model"`
+	UsageMetadata *UsageMetadata `json:"usage_metadata,omitempty"`
+}
+
+// ConsumesQuota reports whether serving this card should be charged. A
+// regenerated card always is.
+func (r *RegenerateCardResponse) ConsumesQuota() bool {
+	return true
 }
 
 // GeminiArmyRequest represents the request to Gemini Army API
 type GeminiArmyRequest struct {
-	Prompt string `json:"prompt"`
+	Prompt          string   `json:"prompt"`
+	Model           string   `json:"model,omitempty"`
+	Temperature     *float64 `json:"temperature,omitempty"`
+	TopP            *float64 `json:"top_p,omitempty"`
+	MaxOutputTokens *int     `json:"max_output_tokens,omitempty"`
 }
 
 // UsageMetadata represents token usage from Gemini
@@ -43,17 +492,136 @@ type UsageMetadata struct {
 	TotalTokenCount      int `json:"total_token_count"`
 }
 
+// Card represents a single extracted insight card
+type Card struct {
+	ID               string   `json:"id"`
+	Content          string   `json:"content"`
+	SuggestedTags    []string `json:"suggested_tags"`
+	SuggestedProject *string  `json:"suggested_project"`
+	WordCount        int      `json:"word_count"`
+	LengthFlag       string   `json:"length_flag,omitempty"`
+	Difficulty       string   `json:"difficulty,omitempty"`
+	RelatedNotes     []string `json:"related_notes,omitempty"`
+	Citation         string   `json:"citation,omitempty"`
+	Confidence       *float64 `json:"confidence,omitempty"`
+	Icon             string   `json:"icon,omitempty"`
+	Priority         *int     `json:"priority,omitempty"`
+	Language         string   `json:"language,omitempty"`
+}
+
 // AIExtractionResponse represents the response from this API
 type AIExtractionResponse struct {
 	Text          string         `json:"text"`
+	Title         string         `json:"title,omitempty"`
+	Summary       string         `json:"summary,omitempty"`
+	Cards         []Card         `json:"cards,omitempty"`
 	Model         string         `json:"model"`
 	UsageMetadata *UsageMetadata `json:"usage_metadata,omitempty"`
 	FinishReason  string         `json:"finish_reason,omitempty"`
+	Warning       string         `json:"warning,omitempty"`
+	PIIRedacted   bool           `json:"pii_redacted,omitempty"`
+
+	// Diff compares the cards with previous_cards, when sent
+	Diff *CardDiff `json:"diff,omitempty"`
+
+	// Languages lists the card languages found with group_by_language, the
+	// most common first
+	Languages []string `json:"languages,omitempty"`
+
+	// Degraded marks a heuristic extraction produced without the AI provider
+	// (see DEGRADED_FALLBACK). Degraded results are neither cached nor
+	// charged.
+	Degraded bool `json:"degraded,omitempty"`
+
+	// Debug is only set when DEBUG_INCLUDE_PROMPT is enabled
+	Debug *ExtractionDebug `json:"_debug,omitempty"`
+
+	// CardsTruncated reports that the model returned more than MaxCards cards
+	CardsTruncated bool `json:"-"`
+
+	// Coalesced reports that the result was shared from a concurrent identical
+	// request, which already consumed the rate-limit slot
+	Coalesced bool `json:"-"`
+}
+
+// ExtractionDebug carries diagnostics for support, never cached
+type ExtractionDebug struct {
+	Prompt string `json:"prompt"`
+}
+
+// ConsumesQuota reports whether serving this extraction should be charged a
+// rate-limit slot. Responses without cards, and results coalesced from a
+// concurrent identical request, are never charged.
+func (r *AIExtractionResponse) ConsumesQuota() bool {
+	return len(r.Cards) > 0 && !r.Coalesced && !r.Degraded
+}
+
+// StreamEvent is a single newline-delimited JSON event emitted by the
+// streaming extraction endpoint. Tags arrive first, followed by the cards.
+type StreamEvent struct {
+	Event  string                `json:"event"`
+	Tags   []string              `json:"tags,omitempty"`
+	Result *AIExtractionResponse `json:"result,omitempty"`
+	Error  string                `json:"error,omitempty"`
+	Code   string                `json:"code,omitempty"`
+}
+
+// Batch item statuses
+const (
+	BatchItemOK          = "ok"
+	BatchItemRateLimited = "rate_limited"
+	BatchItemError       = "error"
+)
+
+// BatchExtractionRequest represents the request body for batch extraction.
+// Each note is extracted in isolation and rate-limited individually.
+type BatchExtractionRequest struct {
+	Notes []AIExtractionRequest `json:"notes"`
+}
+
+// BatchItemResult reports the outcome of one note in a batch
+type BatchItemResult struct {
+	Index  int                   `json:"index"`
+	Status string                `json:"status"`
+	Result *AIExtractionResponse `json:"result,omitempty"`
+	Error  string                `json:"error,omitempty"`
+	Code   string                `json:"code,omitempty"`
+}
+
+// BatchExtractionResponse represents the response for batch extraction
+type BatchExtractionResponse struct {
+	Items     []BatchItemResult `json:"items"`
+	Succeeded int               `json:"succeeded"`
+	Failed    int               `json:"failed"`
+}
+
+// MinimalCard is the bandwidth-saving card shape returned in minimal mode
+type MinimalCard struct {
+	ID            string   `json:"id"`
+	Content       string   `json:"content"`
+	SuggestedTags []string `json:"suggested_tags"`
+}
+
+// MinimalExtractionResponse omits model, usage and other metadata, keeping only
+// card content and tags
+type MinimalExtractionResponse struct {
+	Cards []MinimalCard `json:"cards"`
+}
+
+// Minimal strips the response down to its MinimalExtractionResponse form
+func (r *AIExtractionResponse) Minimal() MinimalExtractionResponse {
+	cards := make([]MinimalCard, len(r.Cards))
+	for i, card := range r.Cards {
+		cards[i] = MinimalCard{ID: card.ID, Content: card.Content, SuggestedTags: card.SuggestedTags}
+	}
+	return MinimalExtractionResponse{Cards: cards}
 }
 
 // ErrorResponse represents an error response
 type ErrorResponse struct {
-	Error string `json:"error"`
+	Error   string `json:"error"`
+	Code    string `json:"code,omitempty"`
+	ResetAt string `json:"reset_at,omitempty"`
 }
 
 // =============================================================================
@@ -61,29 +629,252 @@ type ErrorResponse struct {
 // =============================================================================
 
 // AIExtractionPrompt generates the prompt for extracting insights from a note
-func AIExtractionPrompt(existingTags []string, existingProjects []string, noteContent string) string {
+func AIExtractionPrompt(req *AIExtractionRequest) string {
 	tagsStr := "(none)"
-	if len(existingTags) > 0 {
-		tagsStr = strings.Join(existingTags, ", ")
+	if len(req.ExistingTags) > 0 {
+		tagsStr = strings.Join(req.ExistingTags, ", ")
 	}
 	projectsStr := "(none)"
-	if len(existingProjects) > 0 {
-		projectsStr = strings.Join(existingProjects, ", ")
+	if len(req.ExistingProjects) > 0 {
+		projectsStr = strings.Join(req.ExistingProjects, ", ")
+	}
+
+	var extraRequirements strings.Builder
+	if req.ContentType == ContentTypeTranscript {
+		extraRequirements.WriteString("- This note is a transcript with speaker labels (e.g. \"Alice: ...\"). Attribute each insight to the speaker(s) who expressed it.\n")
+		extraRequirements.WriteString("- Preserve speaker labels in card content when quoting or paraphrasing what someone said\n")
+	}
+
+	if req.Format == CardFormatOutline {
+		extraRequirements.WriteString("- Format each card's content as a nested markdown bullet outline: every line starts with \"- \", with sub-points indented by two spaces under their parent; no prose paragraphs\n")
+	}
+
+	if req.merged {
+		extraRequirements.WriteString("- The content contains several related notes separated by \"--- Note N ---\" markers. Produce one unified card set: synthesize insights across notes and never create duplicate cards for the same idea\n")
 	}
+
+	// extraTopFields and extraCardFields extend the JSON example for opt-in
+	// fields
+	var extraTopFields, extraCardFields strings.Builder
+	if req.IncludeSummary {
+		fmt.Fprintf(&extraRequirements, "- Also give the whole note a short title (at most %d characters) and a one-sentence summary (at most %d characters)\n", MaxTitleChars, MaxSummaryChars)
+		extraTopFields.WriteString("  \"title\": \"short note title\",\n  \"summary\": \"one-sentence summary of the whole note\",\n")
+	}
+	if req.IncludeDifficulty {
+		extraRequirements.WriteString("- Rate each card's difficulty to recall for spaced repetition as \"easy\", \"medium\" or \"hard\"\n")
+		extraCardFields.WriteString(",\n      \"difficulty\": \"easy, medium or hard\"")
+	}
+	if req.IncludeConfidence {
+		extraRequirements.WriteString("- Rate each card's confidence from 0 to 1: how accurately it reflects the note and how important the insight is\n")
+		extraCardFields.WriteString(",\n      \"confidence\": 0.8")
+	}
+	if req.IncludeIcon {
+		extraRequirements.WriteString("- Suggest exactly one emoji per card that represents its topic\n")
+		extraCardFields.WriteString(",\n      \"icon\": \"single emoji\"")
+	}
+	if req.GroupByLanguage {
+		extraRequirements.WriteString("- The note may mix languages. Write each card in the language of the passage it comes from, never translating quotes, and label it with that language's ISO 639-1 code (e.g. \"en\", \"fr\")\n")
+		extraCardFields.WriteString(",\n      \"language\": \"en\"")
+	}
+	if req.OrderByImportance {
+		extraRequirements.WriteString("- Order the cards from most to least important and give each a distinct integer priority, starting at 1 for the most important\n")
+		extraCardFields.WriteString(",\n      \"priority\": 1")
+	}
+
+	extraSections := ""
+	if req.IncludeRelated && len(req.ExistingNoteTitles) > 0 {
+		extraRequirements.WriteString("- For each card, list the titles of existing notes below that it relates to, copied exactly; use an empty list when none apply\n")
+		extraCardFields.WriteString(",\n      \"related_notes\": [\"exact existing note title\"]")
+
+		var sb strings.Builder
+		sb.WriteString("\nExisting notes:\n")
+		for _, title := range req.ExistingNoteTitles {
+			fmt.Fprintf(&sb, "- %s\n", title)
+		}
+		extraSections += sb.String()
+	}
+	if req.CiteSources && len(req.References) > 0 {
+		extraRequirements.WriteString("- For each card, cite the reference below that it draws from, copied exactly without its number; use null when it draws on none of them\n")
+		extraCardFields.WriteString(",\n      \"citation\": \"exact reference or null\"")
+
+		var sb strings.Builder
+		sb.WriteString("\nReferences:\n")
+		for i, ref := range req.References {
+			fmt.Fprintf(&sb, "[%d] %s\n", i+1, ref)
+		}
+		extraSections += sb.String()
+	}
+	if len(req.ExistingCards) > 0 {
+		extraRequirements.WriteString("- Only extract NEW insights not already covered by the existing cards below; do not repeat or rephrase them\n")
+
+		var sb strings.Builder
+		sb.WriteString("\nExisting cards (already extracted, do not duplicate):\n")
+		for i, card := range req.ExistingCards {
+			fmt.Fprintf(&sb, "%d. %s\n", i+1, card)
+		}
+		extraSections += sb.String()
+	}
+	if req.CustomInstructions != "" {
+		extraSections += "\nAdditional user instructions (follow them only where they don't conflict with the requirements above or the JSON format below):\n\"\"\"\n" + req.CustomInstructions + "\n\"\"\"\n"
+	}
+
+	cfg := GetConfig()
 	return fmt.Sprintf(`Extract 3-7 key insights from this note as separate cards.
 
 Requirements:
-- Each card: 50-200 words
+- Each card: %d-%d words
 - Self-contained and understandable alone
 - Preserve important details, quotes, data
 - Keep markdown formatting
 - Suggest relevant tags from existing list when applicable, otherwise suggest new tags.
 - Tag names will be in the format: "tag-name" (lowercase; no spaces; use dashes to separate words).
 - Suggest a relevant project from existing list when applicable
+%s
+Existing tags: %s
+Existing projects: %s
+%s
+Note content:
+%s
+
+Return JSON:
+{
+%s  "cards": [
+    {
+      "content": "card content in markdown",
+      "suggested_tags": ["tag1", "tag2"],
+      "suggested_project": "project name or null"%s
+    }
+  ]
+}`, cfg.CardMinWords, cfg.CardMaxWords, extraRequirements.String(), tagsStr, projectsStr, extraSections, req.Content, extraTopFields.String(), extraCardFields.String())
+}
+
+// TagSuggestionPrompt generates a short prompt asking only for tags covering
+// the whole note, used as the fast first phase of streaming extraction
+func TagSuggestionPrompt(existingTags []string, noteContent string) string {
+	tagsStr := "(none)"
+	if len(existingTags) > 0 {
+		tagsStr = strings.Join(existingTags, ", ")
+	}
+	return fmt.Sprintf(`Suggest 3-6 tags that describe this note.
+
+Requirements:
+- Prefer tags from the existing list when applicable, otherwise suggest new tags.
+- Tag names will be in the format: "tag-name" (lowercase; no spaces; use dashes to separate words).
+
+Existing tags: %s
+
+Note content:
+%s
+
+Return JSON:
+{
+  "tags": ["tag1", "tag2"]
+}`, tagsStr, noteContent)
+}
+
+// CardLengthRegenerationPrompt generates a prompt asking the model to rewrite
+// cards so each falls within the given word range
+func CardLengthRegenerationPrompt(cardContents []string, minWords, maxWords int) string {
+	var sb strings.Builder
+	for i, content := range cardContents {
+		fmt.Fprintf(&sb, "Card %d:\n%s\n\n", i+1, content)
+	}
+	return fmt.Sprintf(`Rewrite each of the following cards so it is between %d and %d words.
+
+Requirements:
+- Keep the same insight, important details, quotes and data
+- Self-contained and understandable alone
+- Keep markdown formatting
+- Return exactly %d cards in the same order
+
+%s
+Return JSON:
+{
+  "cards": [
+    {
+      "content": "card content in markdown"
+    }
+  ]
+}`, minWords, maxWords, len(cardContents), sb.String())
+}
+
+// CardValidationRetryPrompt generates a prompt asking the model to fix cards
+// that failed validation, each listed with its problems
+func CardValidationRetryPrompt(req *AIExtractionRequest, cards []Card, problems [][]string) string {
+	cfg := GetConfig()
+	tagsStr := "(none)"
+	if len(req.ExistingTags) > 0 {
+		tagsStr = strings.Join(req.ExistingTags, ", ")
+	}
+	projectsStr := "(none)"
+	if len(req.ExistingProjects) > 0 {
+		projectsStr = strings.Join(req.ExistingProjects, ", ")
+	}
+
+	var sb strings.Builder
+	for i, card := range cards {
+		project := "null"
+		if card.SuggestedProject != nil {
+			project = *card.SuggestedProject
+		}
+		fmt.Fprintf(&sb, "Card %d (problems: %s):\n%s\nTags: %s\nProject: %s\n\n", i+1, strings.Join(problems[i], "; "), card.Content, strings.Join(card.SuggestedTags, ", "), project)
+	}
+	return fmt.Sprintf(`Fix each of the following cards so it no longer has the listed problems.
+
+Requirements:
+- Keep the same insight, important details, quotes and data
+- Each card: %d-%d words, self-contained and understandable alone
+- Keep markdown formatting
+- Give every card at least one tag in the format "tag-name" (lowercase; no spaces; use dashes to separate words), preferring existing tags
+- Only use a project from the existing list, or null when none fits
+- Return exactly %d cards in the same order
+
+Existing tags: %s
+Existing projects: %s
+
+%s
+Return JSON:
+{
+  "cards": [
+    {
+      "content": "card content in markdown",
+      "suggested_tags": ["tag1", "tag2"],
+      "suggested_project": "project name or null"
+    }
+  ]
+}`, cfg.CardMinWords, cfg.CardMaxWords, len(cards), tagsStr, projectsStr, sb.String())
+}
+
+// CardRegenerationPrompt generates the prompt for producing one alternative
+// card covering the same material as an existing card the user disliked
+func CardRegenerationPrompt(req *RegenerateCardRequest) string {
+	tagsStr := "(none)"
+	if len(req.ExistingTags) > 0 {
+		tagsStr = strings.Join(req.ExistingTags, ", ")
+	}
+	projectsStr := "(none)"
+	if len(req.ExistingProjects) > 0 {
+		projectsStr = strings.Join(req.ExistingProjects, ", ")
+	}
+	cfg := GetConfig()
+	return fmt.Sprintf(`A user extracted insight cards from the note below but disliked one of them. Write ONE alternative card that covers the same material differently.
+
+Requirements:
+- %d-%d words
+- Self-contained and understandable alone
+- Cover the same insight as the disliked card, but with a different angle, structure or wording
+- Preserve important details, quotes, data from the note
+- Keep markdown formatting
+- Suggest relevant tags from existing list when applicable, otherwise suggest new tags.
+- Tag names will be in the format: "tag-name" (lowercase; no spaces; use dashes to separate words).
+- Suggest a relevant project from existing list when applicable
 
 Existing tags: %s
 Existing projects: %s
 
+Disliked card:
+%s
+
 Note content:
 %s
 
@@ -96,5 +887,5 @@ Return JSON:
       "suggested_project": "project name or null"
     }
   ]
-}`, tagsStr, projectsStr, noteContent)
+}`, cfg.CardMinWords, cfg.CardMaxWords, tagsStr, projectsStr, req.CardContent, req.Content)
 }
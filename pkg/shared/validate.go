@@ -0,0 +1,56 @@
+package shared
+
+// =============================================================================
+// Request Validation Report
+// =============================================================================
+
+// ValidationReport is the body returned by the validate endpoint
+type ValidationReport struct {
+	Accepted bool                `json:"accepted"`
+	Issues   []ValidationIssue   `json:"issues"`
+	Warnings []ValidationIssue   `json:"warnings"`
+	Estimate *ExtractionEstimate `json:"estimate,omitempty"`
+}
+
+// ValidateExtractionRequest runs all the checks a real extraction applies to
+// req, including preprocessing, and reports every problem found. Warnings
+// flag notes that would be accepted but likely extract poorly. The request
+// is prepared in place when accepted.
+func ValidateExtractionRequest(req *AIExtractionRequest) ValidationReport {
+	report := ValidationReport{
+		Issues:   append([]ValidationIssue{}, req.ValidationIssues()...),
+		Warnings: []ValidationIssue{},
+	}
+	if len(report.Issues) == 0 {
+		// Preprocessing can still reject the note, e.g. malformed JSON content
+		if err := req.Prepare(); err != nil {
+			report.Issues = append(report.Issues, ValidationIssue{Field: "content", Message: err.Error()})
+		} else if err := CheckContentPolicy(req.Content); err != nil {
+			report.Issues = append(report.Issues, ValidationIssue{Field: "content", Message: ToAPIError(err).Message})
+		}
+	}
+	if len(report.Issues) > 0 {
+		return report
+	}
+
+	report.Accepted = true
+	estimate := EstimateExtraction(req)
+	report.Estimate = &estimate
+	if estimate.WordCount < previewMinMultiCardWords {
+		report.Warnings = append(report.Warnings, ValidationIssue{Field: "content", Message: "Content is very short and will likely yield a single card"})
+	}
+	if req.MaxOutputTokens != nil && *req.MaxOutputTokens < estimate.EstimatedOutputTokens {
+		report.Warnings = append(report.Warnings, ValidationIssue{Field: "max_output_tokens", Message: "max_output_tokens is below the estimated output size; cards may be cut off"})
+	}
+	return report
+}
+
+// Localize translates every issue and warning message into lang
+func (v *ValidationReport) Localize(lang string) {
+	for i := range v.Issues {
+		v.Issues[i].Message = Translate(lang, v.Issues[i].Message)
+	}
+	for i := range v.Warnings {
+		v.Warnings[i].Message = Translate(lang, v.Warnings[i].Message)
+	}
+}
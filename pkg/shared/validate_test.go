@@ -0,0 +1,56 @@
+package shared
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestValidateExtractionRequest(t *testing.T) {
+	words := strings.TrimSpace(strings.Repeat("insight ", 80))
+	tiny := 1
+	tests := []struct {
+		name         string
+		req          AIExtractionRequest
+		wantAccepted bool
+		wantIssues   []string
+		wantWarnings []string
+	}{
+		{"valid", AIExtractionRequest{Content: words}, true, nil, nil},
+		{"short", AIExtractionRequest{Content: "Tiny note"}, true, nil, []string{"content"}},
+		{"output budget too small", AIExtractionRequest{Content: words, MaxOutputTokens: &tiny}, true, nil, []string{"max_output_tokens"}},
+		{"empty", AIExtractionRequest{}, false, []string{"content"}, nil},
+		{"invalid utf-8", AIExtractionRequest{Content: "bad \xff bytes"}, false, []string{"content"}, nil},
+		{"several fields", AIExtractionRequest{Content: words, ContentType: "podcast", Format: "poem"}, false, []string{"content_type", "format"}, nil},
+		{"malformed json note", AIExtractionRequest{Content: "{not json", ContentFormat: ContentFormatJSON}, false, []string{"content"}, nil},
+		{"empty after preprocessing", AIExtractionRequest{Content: "\u200b\u200b"}, false, []string{"content"}, nil},
+		{"content policy", AIExtractionRequest{Content: "this note is forbidden"}, false, []string{"content"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, func(c *Config) { c.ContentDenylist = []*regexp.Regexp{regexp.MustCompile(`forbidden`)} })
+			report := ValidateExtractionRequest(&tt.req)
+			if report.Accepted != tt.wantAccepted {
+				t.Errorf("accepted = %v, want %v (issues %+v)", report.Accepted, tt.wantAccepted, report.Issues)
+			}
+			if got := issueFields(report.Issues); got != strings.Join(tt.wantIssues, ",") {
+				t.Errorf("issues on %q, want %q", got, strings.Join(tt.wantIssues, ","))
+			}
+			if got := issueFields(report.Warnings); got != strings.Join(tt.wantWarnings, ",") {
+				t.Errorf("warnings on %q, want %q", got, strings.Join(tt.wantWarnings, ","))
+			}
+			if (report.Estimate != nil) != tt.wantAccepted {
+				t.Errorf("estimate present = %v, want %v", report.Estimate != nil, tt.wantAccepted)
+			}
+		})
+	}
+}
+
+// issueFields joins the fields of issues with commas
+func issueFields(issues []ValidationIssue) string {
+	fields := make([]string, len(issues))
+	for i, issue := range issues {
+		fields[i] = issue.Field
+	}
+	return strings.Join(fields, ",")
+}
@@ -0,0 +1,107 @@
+package shared
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// =============================================================================
+// Warmup
+// =============================================================================
+
+// warmedUp records whether this process instance has already been warmed
+var warmedUp atomic.Bool
+
+// WarmupReport describes the cost of initializing this instance
+type WarmupReport struct {
+	ColdStart      bool    `json:"cold_start"`
+	StoreBackend   string  `json:"store_backend"`
+	RedisMs        float64 `json:"redis_ms"`
+	RedisStatus    string  `json:"redis_status"`
+	ProviderMs     float64 `json:"provider_ms,omitempty"`
+	ProviderStatus int     `json:"provider_status,omitempty"`
+	ProviderError  string  `json:"provider_error,omitempty"`
+}
+
+// Warmup initializes the shared rate-limit store (through the same sync.Once
+// used by real requests) and optionally pings the provider, reporting how long
+// each step took. Vercel runs every function in its own instances, so each
+// function must be warmed separately.
+func Warmup(ctx context.Context, pingProvider bool) WarmupReport {
+	report := WarmupReport{ColdStart: !warmedUp.Swap(true), StoreBackend: GetConfig().StoreBackend, RedisStatus: "ok"}
+
+	start := time.Now()
+	if _, err := GetRateLimitStore(); err != nil {
+		report.RedisStatus = err.Error()
+	}
+	report.RedisMs = msSince(start)
+
+	if pingProvider {
+		status, latency, err := PingProvider(ctx)
+		report.ProviderMs = float64(latency.Microseconds()) / 1000
+		report.ProviderStatus = status
+		if err != nil {
+			report.ProviderError = err.Error()
+		}
+	}
+	return report
+}
+
+// PingProvider performs a minimal timed GET against GeminiBaseURL, which
+// also establishes a pooled connection for later calls
+func PingProvider(ctx context.Context) (int, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, GetConfig().GeminiBaseURL, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("User-Agent", GetConfig().GeminiUserAgent)
+
+	start := time.Now()
+	resp, err := outboundClient(10 * time.Second).Do(req)
+	latency := time.Since(start)
+	if err != nil {
+		return 0, latency, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, latency, nil
+}
+
+// Upstream health statuses
+const (
+	UpstreamStatusOK   = "ok"   // The provider answered without a server error
+	UpstreamStatusDown = "down" // The provider was unreachable or returned a 5xx
+)
+
+// UpstreamHealth reports a single timed probe of the AI provider
+type UpstreamHealth struct {
+	Status         string  `json:"status"`
+	Provider       string  `json:"provider"`
+	LatencyMs      float64 `json:"latency_ms"`
+	ProviderStatus int     `json:"provider_status,omitempty"`
+	Error          string  `json:"error,omitempty"`
+}
+
+// CheckUpstreamHealth probes GeminiBaseURL with PingProvider. Only a
+// transport failure or 5xx counts as down, since the bare base URL needn't
+// serve a 200.
+func CheckUpstreamHealth(ctx context.Context) UpstreamHealth {
+	status, latency, err := PingProvider(ctx)
+	health := UpstreamHealth{
+		Status:         UpstreamStatusOK,
+		Provider:       GetConfig().GeminiBaseURL,
+		LatencyMs:      float64(latency.Microseconds()) / 1000,
+		ProviderStatus: status,
+	}
+	if err != nil {
+		health.Status, health.Error = UpstreamStatusDown, err.Error()
+	} else if status >= http.StatusInternalServerError {
+		health.Status = UpstreamStatusDown
+	}
+	return health
+}
+
+func msSince(start time.Time) float64 {
+	return float64(time.Since(start).Microseconds()) / 1000
+}
@@ -0,0 +1,50 @@
+package shared
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCheckUpstreamHealth(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		delay      time.Duration
+		down       bool
+		wantStatus string
+	}{
+		{"fast", http.StatusOK, 0, false, UpstreamStatusOK},
+		{"base url not found", http.StatusNotFound, 0, false, UpstreamStatusOK},
+		{"slow", http.StatusOK, 50 * time.Millisecond, false, UpstreamStatusOK},
+		{"failing", http.StatusBadGateway, 0, false, UpstreamStatusDown},
+		{"unreachable", 0, 0, true, UpstreamStatusDown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := useConfig(t, nil)
+			srv := fakeProvider(t, cfg, func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(tt.delay)
+				w.WriteHeader(tt.status)
+			})
+			if tt.down {
+				srv.Close()
+			}
+
+			health := CheckUpstreamHealth(context.Background())
+			if health.Status != tt.wantStatus || health.ProviderStatus != tt.status {
+				t.Errorf("status %q, provider status %d; want %q, %d", health.Status, health.ProviderStatus, tt.wantStatus, tt.status)
+			}
+			if (health.Error != "") != tt.down {
+				t.Errorf("error = %q, want one only when unreachable", health.Error)
+			}
+			if health.LatencyMs < float64(tt.delay.Milliseconds()) {
+				t.Errorf("latency %.1fms, want at least %s", health.LatencyMs, tt.delay)
+			}
+			if health.Provider != cfg.GeminiBaseURL {
+				t.Errorf("provider = %q, want %q", health.Provider, cfg.GeminiBaseURL)
+			}
+		})
+	}
+}